@@ -0,0 +1,129 @@
+package main
+
+import (
+	"fmt"
+	"github.com/jmoiron/sqlx"
+	"os"
+	"strings"
+)
+
+// activityFilter decides which pg_stat_activity rows the activity checks
+// look at. Our own session, other pgdiagnose sessions and, on 10 and up,
+// everything that isn't a client backend are always left out. Sessions whose
+// application_name or usename match one of the ignore patterns are too.
+type activityFilter struct {
+	IgnoreApplications []string
+	IgnoreUsers        []string
+
+	clientOnly bool
+}
+
+// loadActivityFilter reads the ignore patterns. They are Postgres regular
+// expressions, so they can only be checked against a target, which
+// filterForServer does.
+func loadActivityFilter() (activityFilter, error) {
+	var filter activityFilter
+	filter.IgnoreApplications = splitPatterns(os.Getenv("IGNORE_APPLICATION_NAMES"))
+	filter.IgnoreUsers = splitPatterns(os.Getenv("IGNORE_USERS"))
+	return filter, nil
+}
+
+func splitPatterns(s string) []string {
+	var patterns []string
+	for _, pattern := range strings.Split(s, ",") {
+		if pattern = strings.TrimSpace(pattern); pattern != "" {
+			patterns = append(patterns, pattern)
+		}
+	}
+	return patterns
+}
+
+// filterForServer returns the filter to use on the server db is connected
+// to, after checking that Postgres accepts each ignore pattern.
+func filterForServer(db *sqlx.DB, filter activityFilter) (activityFilter, error) {
+	for _, pattern := range append(filter.IgnoreApplications, filter.IgnoreUsers...) {
+		var matched bool
+		if err := db.QueryRow("SELECT '' ~ $1", pattern).Scan(&matched); err != nil {
+			return filter, fmt.Errorf("bad ignore pattern %q: %v", pattern, err)
+		}
+	}
+
+	version, err := serverVersionNum(db)
+	if err != nil {
+		return filter, err
+	}
+	return filter.forServer(version), nil
+}
+
+// forServer returns the filter to use on a server with the given
+// server_version_num.
+func (f activityFilter) forServer(version int) activityFilter {
+	f.clientOnly = version >= 100000
+	return f
+}
+
+// clause returns the SQL condition for pg_stat_activity, using $1 to $3.
+func (f activityFilter) clause() string {
+	clause := `pid <> pg_backend_pid()
+		AND coalesce(application_name, '') <> $1
+		AND ($2 = '' OR coalesce(application_name, '') !~ $2)
+		AND ($3 = '' OR coalesce(usename::text, '') !~ $3)`
+	if f.clientOnly {
+		clause += `
+		AND backend_type = 'client backend'`
+	}
+	return clause
+}
+
+func (f activityFilter) args() []interface{} {
+	return []interface{}{
+		diagnosticApplicationName,
+		joinPatterns(f.IgnoreApplications),
+		joinPatterns(f.IgnoreUsers),
+	}
+}
+
+// query fills the filter clause into an activity query.
+func (f activityFilter) query(sql string) string {
+	return fmt.Sprintf(sql, f.clause())
+}
+
+func joinPatterns(patterns []string) string {
+	if len(patterns) == 0 {
+		return ""
+	}
+	return "(" + strings.Join(patterns, ")|(") + ")"
+}
+
+type backendTypeResult struct {
+	BackendType string `db:"backend_type" json:"backend_type"`
+	Count       int64  `db:"count" json:"count"`
+	LongRunning int64  `db:"long_running" json:"long_running"`
+}
+
+// backendTypesCheck reports what the activity checks leave out: background
+// workers, autovacuum, replication and so on.
+func backendTypesCheck(db *sqlx.DB, filter activityFilter) Check {
+	checkTitle := "Backend Types"
+	if !filter.clientOnly {
+		reason := make(map[string]string)
+		reason["error"] = "backend types need postgres 10 or later"
+		return Check{checkTitle, "skipped", reason}
+	}
+
+	var results []backendTypeResult
+	err := db.Select(&results, backendTypesSQL)
+	if err != nil {
+		return makeErrorCheck(checkTitle, err)
+	}
+	return Check{checkTitle, "green", results}
+}
+
+const backendTypesSQL = `
+	SELECT backend_type, count(*) as count,
+	  count(*) FILTER (WHERE state = 'active' AND now() - query_start > '1 minute'::interval) as long_running
+	FROM pg_stat_activity
+	WHERE backend_type <> 'client backend'
+	GROUP BY backend_type
+	ORDER BY backend_type
+	;`
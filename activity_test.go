@@ -0,0 +1,61 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestActivityFilter(t *testing.T) {
+	filter := activityFilter{IgnoreApplications: []string{"^pgbouncer", "sidekiq"}}
+
+	old := filter.forServer(90600)
+	if strings.Contains(old.clause(), "backend_type") {
+		t.Fatal("expected no backend_type filter before 10")
+	}
+
+	current := filter.forServer(100000)
+	if !strings.Contains(current.clause(), "backend_type = 'client backend'") {
+		t.Fatal("expected only client backends on 10 and up")
+	}
+	if !strings.Contains(current.clause(), "pg_backend_pid()") {
+		t.Fatal("expected our own pid to be left out")
+	}
+
+	args := current.args()
+	if args[0] != diagnosticApplicationName || args[1] != "(^pgbouncer)|(sidekiq)" || args[2] != "" {
+		t.Fatalf("unexpected args %v", args)
+	}
+
+	query := current.query(idleQueriesSQL)
+	if !strings.Contains(query, "like 'idle in trans%'") || strings.Contains(query, "%!") {
+		t.Fatalf("expected the filter to be filled in cleanly, got %v", query)
+	}
+}
+
+func TestSplitPatterns(t *testing.T) {
+	patterns := splitPatterns(" a, ,b ")
+	if len(patterns) != 2 || patterns[0] != "a" || patterns[1] != "b" {
+		t.Fatalf("unexpected patterns %v", patterns)
+	}
+
+	if splitPatterns("") != nil {
+		t.Fatal("expected no patterns from an empty string")
+	}
+}
+
+func TestFilterForServer(t *testing.T) {
+	addr := fakeQueryPostgres(t, map[string][]string{
+		"'' ~ $1":            {"f"},
+		"server_version_num": {"160002"},
+	})
+	db, err := connectDB("postgres://u@" + addr + "/db?sslmode=disable")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	filter, err := filterForServer(db, activityFilter{IgnoreApplications: []string{"^pgbouncer"}})
+	if err != nil || !filter.clientOnly {
+		t.Fatalf("expected a filter for a server with backend_type, got %+v (%v)", filter, err)
+	}
+}
@@ -0,0 +1,233 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"github.com/go-martini/martini"
+	"log"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// apiToken grants access to the reports API. Tokens with an App can only
+// create and read reports for that app, tokens without one can access
+// every report. Only a hash of the secret is ever stored.
+type apiToken struct {
+	Id        string     `json:"id"`
+	Name      string     `json:"name"`
+	App       string     `json:"app"`
+	Hash      string     `json:"hash"`
+	CreatedAt time.Time  `json:"created_at"`
+	RevokedAt *time.Time `json:"revoked_at"`
+}
+
+type TokenStore interface {
+	// SaveToken assigns the token an id and creation time and stores it.
+	SaveToken(token *apiToken) error
+	// FindToken returns the unrevoked token with the given hash.
+	FindToken(hash string) (*apiToken, error)
+	RevokeToken(id string) error
+}
+
+var ErrTokenNotFound = errors.New("token not found")
+
+// anonymousToken is used for every request when auth is not required.
+var anonymousToken = &apiToken{Name: "anonymous"}
+
+const tokenPrefix = "pgd_"
+
+func (t *apiToken) canAccess(app string) bool {
+	return t.App == "" || t.App == app
+}
+
+// newToken returns a new random secret and the token record for it.
+func newToken(name, app string) (string, *apiToken) {
+	b := make([]byte, 32)
+	_, err := rand.Read(b)
+	if err != nil {
+		panic(err)
+	}
+	secret := tokenPrefix + hex.EncodeToString(b)
+	return secret, &apiToken{Name: name, App: app, Hash: hashToken(secret)}
+}
+
+func hashToken(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+func bearerToken(req *http.Request) string {
+	header := req.Header.Get("Authorization")
+	if !strings.HasPrefix(header, "Bearer ") {
+		return ""
+	}
+	return strings.TrimSpace(strings.TrimPrefix(header, "Bearer "))
+}
+
+// authenticate maps the *apiToken of the request for the handlers after it,
+// or stops the request with a 401.
+func authenticate(res http.ResponseWriter, req *http.Request, c martini.Context, tokens TokenStore, config Config) {
+	if !config.RequireAuth {
+		c.Map(anonymousToken)
+		return
+	}
+
+	secret := bearerToken(req)
+	if secret == "" {
+		res.WriteHeader(http.StatusUnauthorized)
+		res.Write([]byte(`{"error": "missing token"}`))
+		return
+	}
+
+	token, err := tokens.FindToken(hashToken(secret))
+	if err == ErrTokenNotFound {
+		res.WriteHeader(http.StatusUnauthorized)
+		res.Write([]byte(`{"error": "invalid token"}`))
+		return
+	} else if err != nil {
+		log.Printf("%v", err)
+		res.WriteHeader(http.StatusInternalServerError)
+		res.Write([]byte(`{"error": "Couldn't check token"}`))
+		return
+	}
+	c.Map(token)
+}
+
+func (s *postgresStore) SaveToken(token *apiToken) error {
+	row := s.db.QueryRow(
+		"INSERT INTO api_tokens (name, app, token_hash) values ($1, nullif($2, ''), $3) returning id, created_at",
+		token.Name, token.App, token.Hash)
+	return row.Scan(&token.Id, &token.CreatedAt)
+}
+
+func (s *postgresStore) FindToken(hash string) (*apiToken, error) {
+	var token apiToken
+	row := s.db.QueryRow(
+		"SELECT id, name, coalesce(app, ''), token_hash, created_at FROM api_tokens WHERE token_hash = $1 AND revoked_at IS NULL",
+		hash)
+	err := row.Scan(&token.Id, &token.Name, &token.App, &token.Hash, &token.CreatedAt)
+	if err == sql.ErrNoRows {
+		return nil, ErrTokenNotFound
+	} else if err != nil {
+		return nil, err
+	}
+	return &token, nil
+}
+
+func (s *postgresStore) RevokeToken(id string) error {
+	res, err := s.db.Exec("UPDATE api_tokens SET revoked_at = now() WHERE id = $1 AND revoked_at IS NULL", id)
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrTokenNotFound
+	}
+	return nil
+}
+
+func (s *memoryStore) SaveToken(token *apiToken) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	token.Id = newUUID()
+	token.CreatedAt = time.Now()
+	s.tokens = append(s.tokens, *token)
+	return nil
+}
+
+func (s *memoryStore) FindToken(hash string) (*apiToken, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return findToken(s.tokens, hash)
+}
+
+func (s *memoryStore) RevokeToken(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return revokeToken(s.tokens, id)
+}
+
+func (s *fileStore) tokensPath() string {
+	return filepath.Join(s.dir, "tokens")
+}
+
+func (s *fileStore) readTokens() ([]apiToken, error) {
+	var tokens []apiToken
+	err := s.readJSON(s.tokensPath(), &tokens)
+	return tokens, err
+}
+
+func (s *fileStore) writeTokens(tokens []apiToken) error {
+	return s.writeJSON(s.tokensPath(), tokens)
+}
+
+func (s *fileStore) SaveToken(token *apiToken) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	tokens, err := s.readTokens()
+	if err != nil {
+		return err
+	}
+	token.Id = newUUID()
+	token.CreatedAt = time.Now()
+	return s.writeTokens(append(tokens, *token))
+}
+
+func (s *fileStore) FindToken(hash string) (*apiToken, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	tokens, err := s.readTokens()
+	if err != nil {
+		return nil, err
+	}
+	return findToken(tokens, hash)
+}
+
+func (s *fileStore) RevokeToken(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	tokens, err := s.readTokens()
+	if err != nil {
+		return err
+	}
+	err = revokeToken(tokens, id)
+	if err != nil {
+		return err
+	}
+	return s.writeTokens(tokens)
+}
+
+func findToken(tokens []apiToken, hash string) (*apiToken, error) {
+	for _, token := range tokens {
+		if token.Hash == hash && token.RevokedAt == nil {
+			t := token
+			return &t, nil
+		}
+	}
+	return nil, ErrTokenNotFound
+}
+
+func revokeToken(tokens []apiToken, id string) error {
+	for i := range tokens {
+		if tokens[i].Id == id && tokens[i].RevokedAt == nil {
+			now := time.Now()
+			tokens[i].RevokedAt = &now
+			return nil
+		}
+	}
+	return ErrTokenNotFound
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"github.com/go-martini/martini"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestTokenAccess(t *testing.T) {
+	if !anonymousToken.canAccess("any") {
+		t.Fatal("expected unscoped token to access every app")
+	}
+
+	scoped := &apiToken{App: "sushi"}
+	if !scoped.canAccess("sushi") || scoped.canAccess("other") || scoped.canAccess("") {
+		t.Fatal("expected scoped token to only access its own app")
+	}
+}
+
+func TestNewToken(t *testing.T) {
+	secret, token := newToken("ci", "sushi")
+	if !strings.HasPrefix(secret, tokenPrefix) {
+		t.Fatalf("expected token to start with %v, got %v", tokenPrefix, secret)
+	}
+	if token.Hash != hashToken(secret) || strings.Contains(token.Hash, secret) {
+		t.Fatal("expected only the hash of the secret to be kept")
+	}
+}
+
+func TestTokenStore(t *testing.T) {
+	store := newMemoryStore()
+	secret, token := newToken("ci", "sushi")
+	if err := store.SaveToken(token); err != nil {
+		t.Fatal(err)
+	}
+
+	found, err := store.FindToken(hashToken(secret))
+	if err != nil || found.App != "sushi" {
+		t.Fatalf("expected to find token, got %+v (%v)", found, err)
+	}
+
+	if err = store.RevokeToken(token.Id); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = store.FindToken(hashToken(secret)); err != ErrTokenNotFound {
+		t.Fatalf("expected revoked token to be gone, got %v", err)
+	}
+}
+
+func TestAuthenticate(t *testing.T) {
+	store := newMemoryStore()
+	secret, token := newToken("ci", "sushi")
+	store.SaveToken(token)
+
+	m := martini.New()
+	m.Map(Config{RequireAuth: true})
+	m.MapTo(store, (*TokenStore)(nil))
+	r := martini.NewRouter()
+	r.Get("/reports/:id", authenticate, func(token *apiToken) string { return token.App })
+	m.Action(r.Handle)
+
+	var authtests = []struct {
+		header string
+		code   int
+	}{
+		{"", 401},
+		{"Bearer nope", 401},
+		{"Bearer " + secret, 200},
+	}
+
+	for i, tt := range authtests {
+		req, _ := http.NewRequest("GET", "/reports/1", nil)
+		if tt.header != "" {
+			req.Header.Set("Authorization", tt.header)
+		}
+		res := httptest.NewRecorder()
+		m.ServeHTTP(res, req)
+		if res.Code != tt.code {
+			t.Errorf("%d. Expected %v, but was %v", i, tt.code, res.Code)
+		}
+	}
+}
+
+func TestAuthenticateStoreError(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pgdiagnose")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	store, err := newFileStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ioutil.WriteFile(filepath.Join(dir, "tokens"), []byte("not json"), 0600)
+
+	m := martini.New()
+	m.Map(Config{RequireAuth: true})
+	m.MapTo(store, (*TokenStore)(nil))
+	r := martini.NewRouter()
+	r.Get("/reports/:id", authenticate, func(token *apiToken) string { return token.App })
+	m.Action(r.Handle)
+
+	req, _ := http.NewRequest("GET", "/reports/1", nil)
+	req.Header.Set("Authorization", "Bearer "+tokenPrefix+"secret")
+	res := httptest.NewRecorder()
+	m.ServeHTTP(res, req)
+	if res.Code != 500 {
+		t.Fatalf("expected a broken token store to be a 500, got %v", res.Code)
+	}
+}
@@ -0,0 +1,319 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// slackMessage is a Slack message with Block Kit blocks. Text is the
+// fallback shown in notifications and by clients without blocks.
+type slackMessage struct {
+	Text   string       `json:"text"`
+	Blocks []slackBlock `json:"blocks"`
+}
+
+type slackBlock struct {
+	Type     string       `json:"type"`
+	Text     *slackText   `json:"text,omitempty"`
+	Elements []*slackText `json:"elements,omitempty"`
+}
+
+type slackText struct {
+	Type string `json:"type"`
+	Text string `json:"text"`
+}
+
+var slackEmoji = map[string]string{
+	"green":   ":large_green_circle:",
+	"yellow":  ":large_yellow_circle:",
+	"red":     ":red_circle:",
+	"skipped": ":white_circle:",
+}
+
+var markdownEmoji = map[string]string{
+	"green":   "🟢",
+	"yellow":  "🟡",
+	"red":     "🔴",
+	"skipped": "⚪",
+}
+
+const maxOffenders = 3
+
+// reportLink links to a report from chat. People reading chat may not have
+// API tokens, so it's a share link when sharing is configured. Chat goes
+// to more people than the report's owners, so the link only shows the
+// summary, and the full report still takes a token.
+func reportLink(config Config, id string) string {
+	if len(config.ShareSecret) > 0 {
+		link, _, err := newShareLink(id, shareSummary, defaultShareTTL, config.ShareSecret)
+		if err == nil {
+			return config.BaseURL + link
+		}
+	}
+	return config.BaseURL + "/reports/" + id
+}
+
+// chatLine is a check as shown in chat, labelled with its database for
+// reports run on every database.
+type chatLine struct {
+	label string
+	check Check
+}
+
+func chatLines(report *Report) []chatLine {
+	var lines []chatLine
+	for _, check := range report.Checks {
+		lines = append(lines, chatLine{check.Name, check})
+	}
+	for _, d := range report.Databases {
+		for _, check := range d.Checks {
+			lines = append(lines, chatLine{d.Name + ": " + check.Name, check})
+		}
+	}
+	return lines
+}
+
+func chatTitle(report *Report) string {
+	target := report.App
+	if report.Database != "" {
+		target += "/" + report.Database
+	}
+	if target == "" {
+		target = report.Id
+	}
+	return fmt.Sprintf("pgdiagnose: %s is %s", target, report.SummaryStatus)
+}
+
+// renderSlack renders a report, and any check status changes since the
+// previous one, as a Slack message linking back to the report.
+func renderSlack(report *Report, changes []statusChange, link string) slackMessage {
+	title := chatTitle(report)
+	msg := slackMessage{Text: title}
+	msg.Blocks = append(msg.Blocks, slackBlock{Type: "header", Text: &slackText{"plain_text", title}})
+
+	if len(changes) > 0 {
+		var b strings.Builder
+		b.WriteString("*Changed since the last report*")
+		for _, c := range changes {
+			fmt.Fprintf(&b, "\n%s %s: %s → %s", slackEmoji[c.To], changeLabel(c), c.From, c.To)
+		}
+		msg.Blocks = append(msg.Blocks, slackSection(b.String()))
+	}
+
+	var checks []string
+	for _, line := range chatLines(report) {
+		checks = append(checks, slackEmoji[line.check.Status]+" "+line.label)
+	}
+	if len(checks) > 0 {
+		msg.Blocks = append(msg.Blocks, slackSection(strings.Join(checks, "\n")))
+	}
+
+	for _, line := range chatLines(report) {
+		offenders := checkOffenders(line.check)
+		if line.check.Status != "red" || len(offenders) == 0 {
+			continue
+		}
+		text := "*" + line.label + "*"
+		for _, o := range offenders {
+			text += "\n• " + o
+		}
+		msg.Blocks = append(msg.Blocks, slackSection(text))
+	}
+
+	if link != "" {
+		msg.Blocks = append(msg.Blocks, slackBlock{Type: "context", Elements: []*slackText{
+			{"mrkdwn", fmt.Sprintf("<%s|View report %s>", link, report.Id)},
+		}})
+	}
+	return msg
+}
+
+func slackSection(text string) slackBlock {
+	// sections hold at most 3000 characters
+	if len(text) > 3000 {
+		text = text[:2997] + "..."
+	}
+	return slackBlock{Type: "section", Text: &slackText{"mrkdwn", text}}
+}
+
+// renderMarkdown renders the same message as renderSlack in plain markdown,
+// for chats that don't understand Block Kit.
+func renderMarkdown(report *Report, changes []statusChange, link string) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "**%s**\n", chatTitle(report))
+
+	if len(changes) > 0 {
+		b.WriteString("\nChanged since the last report:\n")
+		for _, c := range changes {
+			fmt.Fprintf(&b, "- %s %s: %s → %s\n", markdownEmoji[c.To], changeLabel(c), c.From, c.To)
+		}
+	}
+
+	b.WriteString("\n")
+	for _, line := range chatLines(report) {
+		fmt.Fprintf(&b, "- %s %s\n", markdownEmoji[line.check.Status], line.label)
+		if line.check.Status != "red" {
+			continue
+		}
+		for _, o := range checkOffenders(line.check) {
+			fmt.Fprintf(&b, "  - %s\n", o)
+		}
+	}
+
+	if link != "" {
+		fmt.Fprintf(&b, "\n[View report %s](%s)\n", report.Id, link)
+	}
+	return b.String()
+}
+
+func changeLabel(c statusChange) string {
+	if c.Database != "" {
+		return c.Database + ": " + c.Check
+	}
+	return c.Check
+}
+
+// checkOffenders describes the worst results of a check: the largest bloat,
+// the oldest blocking or long running pids, the sequences closest to full.
+// Results are decoded from JSON so reports read back from a store work too.
+func checkOffenders(check Check) []string {
+	js, err := json.Marshal(check.Results)
+	if err != nil {
+		return nil
+	}
+
+	var offenders []string
+	switch check.Name {
+	case "Bloat":
+		var results []bloatResult
+		if json.Unmarshal(js, &results) != nil {
+			return nil
+		}
+		// already ordered by wasted bytes
+		for _, r := range results {
+			offenders = append(offenders, fmt.Sprintf("%s %s: %dx bloat, %s wasted", r.Type, r.Object, r.Bloat, r.Waste))
+		}
+	case "Blocking Queries":
+		var results []blockingResult
+		if json.Unmarshal(js, &results) != nil {
+			return nil
+		}
+		sort.Stable(byBlockingDuration(results))
+		for _, r := range results {
+			offenders = append(offenders, fmt.Sprintf("pid %d blocking pid %d for %s",
+				r.Blocking_pid, r.Blocked_pid, r.Blocking_duration))
+		}
+	case "Long Queries", "Idle in Transaction":
+		var results []longQueriesResult
+		if json.Unmarshal(js, &results) != nil {
+			return nil
+		}
+		sort.Stable(byDuration(results))
+		for _, r := range results {
+			offenders = append(offenders, fmt.Sprintf("pid %d for %s", r.Pid, r.Duration))
+		}
+	case "Sequences":
+		var results []sequenceResult
+		if json.Unmarshal(js, &results) != nil {
+			return nil
+		}
+		sort.Stable(byPercentUsed(results))
+		for _, r := range results {
+			offenders = append(offenders, fmt.Sprintf("%s on %s: %.1f%% used", r.Seq, r.Col, r.Pct))
+		}
+	default:
+		var results []map[string]interface{}
+		if json.Unmarshal(js, &results) != nil {
+			return nil
+		}
+		for _, r := range results {
+			item, _ := json.Marshal(withoutQueries(r))
+			offenders = append(offenders, chatCode(string(item)))
+		}
+	}
+
+	if len(offenders) > maxOffenders {
+		offenders = offenders[:maxOffenders]
+	}
+	return offenders
+}
+
+// chatCode shortens text to a single line of code that fits in chat.
+func chatCode(text string) string {
+	text = strings.Join(strings.Fields(text), " ")
+	if len(text) > 80 {
+		text = text[:77] + "..."
+	}
+	return "`" + strings.Replace(text, "`", "'", -1) + "`"
+}
+
+// withoutQueries drops query text from a decoded result, however deep it
+// is. Chat messages go to channels with more readers than the reports, and
+// query text can hold anything the application sends, so they leave it out
+// whatever QUERY_REDACTION says.
+func withoutQueries(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		for key, value := range v {
+			if key == "query" || strings.HasSuffix(key, "_statement") {
+				delete(v, key)
+				continue
+			}
+			v[key] = withoutQueries(value)
+		}
+	case []interface{}:
+		for i := range v {
+			v[i] = withoutQueries(v[i])
+		}
+	}
+	return v
+}
+
+// intervalSeconds parses postgres interval output like "1 day 02:03:04.5"
+// well enough to order durations, returning 0 for anything else.
+func intervalSeconds(interval string) float64 {
+	var seconds float64
+	fields := strings.Fields(interval)
+	for i := 0; i < len(fields); i++ {
+		if i+1 < len(fields) && strings.HasPrefix(fields[i+1], "day") {
+			days, _ := strconv.ParseFloat(fields[i], 64)
+			seconds += days * 86400
+			i++
+			continue
+		}
+		parts := strings.Split(fields[i], ":")
+		if len(parts) != 3 {
+			continue
+		}
+		h, _ := strconv.ParseFloat(parts[0], 64)
+		m, _ := strconv.ParseFloat(parts[1], 64)
+		s, _ := strconv.ParseFloat(parts[2], 64)
+		seconds += h*3600 + m*60 + s
+	}
+	return seconds
+}
+
+type byBlockingDuration []blockingResult
+
+func (s byBlockingDuration) Len() int      { return len(s) }
+func (s byBlockingDuration) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
+func (s byBlockingDuration) Less(i, j int) bool {
+	return intervalSeconds(s[i].Blocking_duration) > intervalSeconds(s[j].Blocking_duration)
+}
+
+type byDuration []longQueriesResult
+
+func (s byDuration) Len() int      { return len(s) }
+func (s byDuration) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
+func (s byDuration) Less(i, j int) bool {
+	return intervalSeconds(s[i].Duration) > intervalSeconds(s[j].Duration)
+}
+
+type byPercentUsed []sequenceResult
+
+func (s byPercentUsed) Len() int           { return len(s) }
+func (s byPercentUsed) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s byPercentUsed) Less(i, j int) bool { return s[i].Pct > s[j].Pct }
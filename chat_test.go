@@ -0,0 +1,145 @@
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+var intervalTests = []struct {
+	interval string
+	expected float64
+}{
+	{"00:01:30", 90},
+	{"02:00:00.5", 7200.5},
+	{"1 day 00:00:01", 86401},
+	{"3 days", 259200},
+	{"", 0},
+}
+
+func TestIntervalSeconds(t *testing.T) {
+	for i, test := range intervalTests {
+		actual := intervalSeconds(test.interval)
+		if actual != test.expected {
+			t.Errorf("%d. Expected %v, but was %v", i, test.expected, actual)
+		}
+	}
+}
+
+func TestCheckOffenders(t *testing.T) {
+	blocking := Check{"Blocking Queries", "red", []blockingResult{
+		{Blocked_pid: 1, Blocking_pid: 10, Blocking_duration: "00:02:00", Blocking_statement: "update a"},
+		{Blocked_pid: 2, Blocking_pid: 20, Blocking_duration: "1 day 00:00:00", Blocking_statement: "update b"},
+		{Blocked_pid: 3, Blocking_pid: 30, Blocking_duration: "00:10:00", Blocking_statement: "update c"},
+		{Blocked_pid: 4, Blocking_pid: 40, Blocking_duration: "00:01:00", Blocking_statement: "update d"},
+	}}
+	offenders := checkOffenders(blocking)
+	if len(offenders) != 3 || !strings.HasPrefix(offenders[0], "pid 20 ") || !strings.HasPrefix(offenders[1], "pid 30 ") {
+		t.Fatalf("expected the three oldest blocking pids, got %v", offenders)
+	}
+
+	// reports read back from a store have maps instead of typed results
+	var sequences Check
+	js, _ := json.Marshal(Check{"Sequences", "red", []sequenceResult{
+		{"a.id", "a_id_seq", 80},
+		{"b.id", "b_id_seq", 99.5},
+	}})
+	json.Unmarshal(js, &sequences)
+	offenders = checkOffenders(sequences)
+	expected := []string{"b_id_seq on b.id: 99.5% used", "a_id_seq on a.id: 80.0% used"}
+	if !reflect.DeepEqual(offenders, expected) {
+		t.Fatalf("Expected %v, but was %v", expected, offenders)
+	}
+
+	// query text stays out of chat, where the reports' readers aren't
+	// the only ones to see it
+	for i, check := range []Check{
+		blocking,
+		{"Long Queries", "red", []longQueriesResult{{Pid: 1, Duration: "01:00:00", Query: "select secret"}}},
+		{"Activity Sample", "red", []map[string]interface{}{{"top_queries": []map[string]interface{}{{"query": "select secret", "count": 3}}}}},
+	} {
+		for _, o := range checkOffenders(check) {
+			if strings.Contains(o, "update") || strings.Contains(o, "secret") {
+				t.Errorf("%d. Expected no query text, but was %v", i, o)
+			}
+		}
+	}
+
+	if offenders = checkOffenders(Check{"Bloat", "red", nil}); len(offenders) != 0 {
+		t.Fatalf("expected no offenders without results, got %v", offenders)
+	}
+}
+
+func chatReport() *Report {
+	return &Report{
+		Id:            "id",
+		App:           "app",
+		Database:      "db",
+		SummaryStatus: "red",
+		Checks: []Check{
+			{"Bloat", "red", []bloatResult{{"table", "public.big", 12, "1 GB"}}},
+			{"Hit Rate", "green", nil},
+			{"Load", "skipped", nil},
+		},
+	}
+}
+
+func TestRenderSlack(t *testing.T) {
+	msg := renderSlack(chatReport(), []statusChange{{"Bloat", "", "yellow", "red"}}, "https://pgd.example.com/reports/id")
+
+	if msg.Text != "pgdiagnose: app/db is red" {
+		t.Fatalf("unexpected fallback text %q", msg.Text)
+	}
+	var types []string
+	for _, b := range msg.Blocks {
+		types = append(types, b.Type)
+	}
+	if !reflect.DeepEqual(types, []string{"header", "section", "section", "section", "context"}) {
+		t.Fatalf("unexpected blocks %v", types)
+	}
+	if !strings.Contains(msg.Blocks[2].Text.Text, ":red_circle: Bloat\n:large_green_circle: Hit Rate\n:white_circle: Load") {
+		t.Fatalf("expected an emoji per check, got %q", msg.Blocks[2].Text.Text)
+	}
+	if !strings.Contains(msg.Blocks[3].Text.Text, "public.big: 12x bloat, 1 GB wasted") {
+		t.Fatalf("expected the red check's offenders, got %q", msg.Blocks[3].Text.Text)
+	}
+	if msg.Blocks[4].Elements[0].Text != "<https://pgd.example.com/reports/id|View report id>" {
+		t.Fatalf("unexpected link %q", msg.Blocks[4].Elements[0].Text)
+	}
+}
+
+func TestRenderMarkdown(t *testing.T) {
+	report := chatReport()
+	report.Databases = []databaseReport{{"other", "red", []Check{{"Sequences", "red", []sequenceResult{{"a.id", "a_id_seq", 95}}}}}}
+	md := renderMarkdown(report, nil, "")
+
+	for _, expected := range []string{
+		"**pgdiagnose: app/db is red**",
+		"- 🔴 Bloat\n  - table public.big: 12x bloat, 1 GB wasted\n",
+		"- 🟢 Hit Rate\n",
+		"- 🔴 other: Sequences\n  - a_id_seq on a.id: 95.0% used\n",
+	} {
+		if !strings.Contains(md, expected) {
+			t.Errorf("expected %q in\n%s", expected, md)
+		}
+	}
+	if strings.Contains(md, "View report") {
+		t.Error("expected no link without one")
+	}
+}
+
+func TestReportLink(t *testing.T) {
+	if link := reportLink(Config{BaseURL: "https://pgd.example.com"}, "id"); link != "https://pgd.example.com/reports/id" {
+		t.Fatalf("unexpected link %s", link)
+	}
+	link := reportLink(Config{BaseURL: "https://pgd.example.com", ShareSecret: []byte("secret")}, "id")
+	if !strings.HasPrefix(link, "https://pgd.example.com/r/") {
+		t.Fatalf("expected a share link, got %s", link)
+	}
+	claims, err := verifyShareToken(strings.TrimPrefix(link, "https://pgd.example.com/r/"), []byte("secret"), time.Now())
+	if err != nil || claims.Scope != shareSummary {
+		t.Fatalf("expected a summary share link, got %+v (%v)", claims, err)
+	}
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"github.com/jmoiron/sqlx"
+)
+
+type checkpointResult struct {
+	CheckpointsTimed    int64    `db:"checkpoints_timed" json:"checkpoints_timed"`
+	CheckpointsReq      int64    `db:"checkpoints_req" json:"checkpoints_req"`
+	BuffersCheckpoint   int64    `db:"buffers_checkpoint" json:"buffers_checkpoint"`
+	BuffersClean        int64    `db:"buffers_clean" json:"buffers_clean"`
+	BuffersBackend      int64    `db:"buffers_backend" json:"buffers_backend"`
+	BuffersBackendFsync int64    `db:"buffers_backend_fsync" json:"buffers_backend_fsync"`
+	StatsAge            float64  `db:"stats_age" json:"stats_age_seconds"`
+	WalBytesPerSecond   *float64 `db:"-" json:"wal_bytes_per_second"`
+}
+
+const (
+	// a few requested checkpoints are normal right after a stats reset,
+	// only judge the ratio once there is something to compare
+	minCheckpointsForRatio = 10
+	backendWritesYellow    = 0.2
+	walBytesPerSecondHigh  = 10 * 1024 * 1024
+)
+
+func checkpointCheck(db *sqlx.DB) Check {
+	checkTitle := "Checkpoints"
+
+	version, err := serverVersionNum(db)
+	if err != nil {
+		return makeErrorCheck(checkTitle, err)
+	}
+
+	query := bgwriterSQL
+	if version >= 170000 {
+		query = checkpointerSQL
+	}
+
+	var results []checkpointResult
+	err = db.Select(&results, query)
+	if err != nil {
+		return makeErrorCheck(checkTitle, err)
+	}
+
+	if version >= 140000 && len(results) > 0 {
+		var wal struct {
+			Bytes float64 `db:"wal_bytes"`
+			Age   float64 `db:"stats_age"`
+		}
+		err = db.Get(&wal, walSQL)
+		if err == nil && wal.Age > 0 {
+			rate := wal.Bytes / wal.Age
+			results[0].WalBytesPerSecond = &rate
+		}
+	}
+
+	return Check{checkTitle, checkpointStatus(results), results}
+}
+
+func checkpointStatus(results []checkpointResult) string {
+	if len(results) == 0 {
+		return "green"
+	}
+	r := results[0]
+
+	if r.CheckpointsTimed+r.CheckpointsReq >= minCheckpointsForRatio &&
+		r.CheckpointsReq > r.CheckpointsTimed {
+		return "red"
+	}
+
+	if r.BuffersBackendFsync > 0 {
+		return "red"
+	}
+
+	written := r.BuffersCheckpoint + r.BuffersClean + r.BuffersBackend
+	if written > 0 && float64(r.BuffersBackend)/float64(written) > backendWritesYellow {
+		return "yellow"
+	}
+
+	if r.WalBytesPerSecond != nil && *r.WalBytesPerSecond > walBytesPerSecondHigh {
+		return "yellow"
+	}
+
+	return "green"
+}
+
+func serverVersionNum(db *sqlx.DB) (int, error) {
+	var version int
+	err := db.QueryRow("SELECT current_setting('server_version_num')::int").Scan(&version)
+	return version, err
+}
+
+const (
+	bgwriterSQL = `
+	SELECT checkpoints_timed, checkpoints_req,
+	  buffers_checkpoint, buffers_clean,
+	  buffers_backend, buffers_backend_fsync,
+	  coalesce(extract(epoch from now() - stats_reset), 0) as stats_age
+	FROM pg_stat_bgwriter
+	;`
+
+	// 17 split checkpointer stats out of pg_stat_bgwriter and moved
+	// backend writes into pg_stat_io
+	checkpointerSQL = `
+	SELECT c.num_timed as checkpoints_timed, c.num_requested as checkpoints_req,
+	  c.buffers_written as buffers_checkpoint, b.buffers_clean,
+	  coalesce(io.writes, 0)::bigint as buffers_backend,
+	  coalesce(io.fsyncs, 0)::bigint as buffers_backend_fsync,
+	  coalesce(extract(epoch from now() - c.stats_reset), 0) as stats_age
+	FROM pg_stat_checkpointer c, pg_stat_bgwriter b,
+	  (SELECT sum(writes) as writes, sum(fsyncs) as fsyncs
+	   FROM pg_stat_io
+	   WHERE backend_type = 'client backend' AND object = 'relation') io
+	;`
+
+	walSQL = `
+	SELECT wal_bytes::float8 as wal_bytes,
+	  coalesce(extract(epoch from now() - stats_reset), 0) as stats_age
+	FROM pg_stat_wal
+	;`
+)
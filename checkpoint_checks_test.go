@@ -0,0 +1,57 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestCheckpointStatus(t *testing.T) {
+	values := make([]checkpointResult, 0)
+	if checkpointStatus(values) != "green" {
+		t.Fatal("not green on empty results")
+	}
+
+	values = []checkpointResult{{CheckpointsTimed: 100, CheckpointsReq: 2, BuffersCheckpoint: 1000, BuffersClean: 100}}
+	if checkpointStatus(values) != "green" {
+		t.Fatal("not green on mostly timed checkpoints")
+	}
+
+	values = []checkpointResult{{CheckpointsTimed: 1, CheckpointsReq: 3}}
+	if checkpointStatus(values) != "green" {
+		t.Fatal("not green with too few checkpoints to judge")
+	}
+
+	values = []checkpointResult{{CheckpointsTimed: 10, CheckpointsReq: 30}}
+	if checkpointStatus(values) != "red" {
+		t.Fatal("not red when requested checkpoints outnumber timed ones")
+	}
+
+	values = []checkpointResult{{CheckpointsTimed: 100, BuffersBackendFsync: 1}}
+	if checkpointStatus(values) != "red" {
+		t.Fatal("not red when backends fsync on their own")
+	}
+
+	values = []checkpointResult{{CheckpointsTimed: 100, BuffersCheckpoint: 500, BuffersBackend: 500}}
+	if checkpointStatus(values) != "yellow" {
+		t.Fatal("not yellow when backends write many of their own buffers")
+	}
+
+	wal := 50.0 * 1024 * 1024
+	values = []checkpointResult{{CheckpointsTimed: 100, WalBytesPerSecond: &wal}}
+	if checkpointStatus(values) != "yellow" {
+		t.Fatal("not yellow on high WAL generation")
+	}
+}
+
+func TestServerVersionNum(t *testing.T) {
+	addr := fakeQueryPostgres(t, map[string][]string{"server_version_num": {"160002"}})
+	db, err := connectDB("postgres://u@" + addr + "/db?sslmode=disable")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	version, err := serverVersionNum(db)
+	if err != nil || version != 160002 {
+		t.Fatalf("Expected 160002, but was %v (%v)", version, err)
+	}
+}
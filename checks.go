@@ -6,6 +6,9 @@ import (
 	"github.com/jmoiron/sqlx"
 	_ "github.com/lib/pq"
 	"log"
+	"net/url"
+	"strings"
+	"time"
 )
 
 type Check struct {
@@ -14,23 +17,94 @@ type Check struct {
 	Results interface{} `json:"results"`
 }
 
-func CheckSql(connstring string, plan Plan) ([]Check, error) {
+// checkTimings holds how long each check took, in milliseconds.
+type checkTimings map[string]float64
+
+// sqlCheck is a check run against a target database. Per database checks
+// only see the database they are connected to; the rest see the whole
+// server from any database.
+type sqlCheck struct {
+	perDatabase bool
+	run         func(db *sqlx.DB, plan Plan, filter activityFilter) Check
+}
+
+var sqlChecks = []sqlCheck{
+	{false, func(db *sqlx.DB, plan Plan, filter activityFilter) Check {
+		return connCountCheck(db, plan.ConnectionLimit, filter)
+	}},
+	{false, func(db *sqlx.DB, plan Plan, filter activityFilter) Check { return longQueriesCheck(db, filter) }},
+	{false, func(db *sqlx.DB, plan Plan, filter activityFilter) Check { return idleQueriesCheck(db, filter) }},
+	{true, func(db *sqlx.DB, plan Plan, filter activityFilter) Check { return unusedIndexesCheck(db) }},
+	{true, func(db *sqlx.DB, plan Plan, filter activityFilter) Check { return bloatCheck(db) }},
+	{true, func(db *sqlx.DB, plan Plan, filter activityFilter) Check { return hitRateCheck(db) }},
+	{false, func(db *sqlx.DB, plan Plan, filter activityFilter) Check { return blockingCheck(db) }},
+	{true, func(db *sqlx.DB, plan Plan, filter activityFilter) Check { return seqCheck(db) }},
+	{false, func(db *sqlx.DB, plan Plan, filter activityFilter) Check { return checkpointCheck(db) }},
+	{true, func(db *sqlx.DB, plan Plan, filter activityFilter) Check { return xactCheck(db) }},
+	{false, func(db *sqlx.DB, plan Plan, filter activityFilter) Check { return preparedXactsCheck(db) }},
+	{false, func(db *sqlx.DB, plan Plan, filter activityFilter) Check { return xminHorizonCheck(db) }},
+	{false, func(db *sqlx.DB, plan Plan, filter activityFilter) Check { return waitEventsCheck(db, filter) }},
+	{false, func(db *sqlx.DB, plan Plan, filter activityFilter) Check { return backendTypesCheck(db, filter) }},
+}
+
+func CheckSql(connstring string, plan Plan, filter activityFilter) ([]Check, checkTimings, error) {
 	db, err := connectDB(connstring)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
+	}
+	defer db.Close()
+
+	filter, err = filterForServer(db, filter)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	timings := make(checkTimings)
+	checks := runSqlChecks(db, plan, filter, timings, "", func(c sqlCheck) bool { return true })
+	return checks, timings, nil
+}
+
+// ServerVersion is the target's server_version, like "16.2".
+func ServerVersion(connstring string) (string, error) {
+	db, err := connectDB(connstring)
+	if err != nil {
+		return "", err
 	}
 	defer db.Close()
 
-	v := make([]Check, 8)
-	v[0] = connCountCheck(db, plan.ConnectionLimit)
-	v[1] = longQueriesCheck(db)
-	v[2] = idleQueriesCheck(db)
-	v[3] = unusedIndexesCheck(db)
-	v[4] = bloatCheck(db)
-	v[5] = hitRateCheck(db)
-	v[6] = blockingCheck(db)
-	v[7] = seqCheck(db)
-	return v, nil
+	var version string
+	err = db.QueryRow("SHOW server_version").Scan(&version)
+	return version, err
+}
+
+// runSqlChecks runs the checks include picks, adding how long each took to
+// timings under prefix and the check name.
+func runSqlChecks(db *sqlx.DB, plan Plan, filter activityFilter, timings checkTimings, prefix string, include func(sqlCheck) bool) []Check {
+	var v []Check
+	for _, check := range sqlChecks {
+		if !include(check) {
+			continue
+		}
+		start := time.Now()
+		c := check.run(db, plan, filter)
+		timings[prefix+c.Name] = float64(time.Since(start)) / float64(time.Millisecond)
+		v = append(v, c)
+	}
+	return v
+}
+
+// summaryStatus is the worst status of all checks that ran.
+func summaryStatus(checks []Check) string {
+	status := "green"
+	for _, check := range checks {
+		switch check.Status {
+		case "red":
+			return "red"
+		case "yellow":
+			status = "yellow"
+		}
+	}
+	return status
 }
 
 func PrettyJSON(whatever interface{}) (string, error) {
@@ -38,20 +112,68 @@ func PrettyJSON(whatever interface{}) (string, error) {
 	return string(js), err
 }
 
+// diagnosticApplicationName marks our own sessions on the target database,
+// so DBAs can spot them and the activity checks can leave them out.
+const diagnosticApplicationName = "pgdiagnose"
+
+// diagnosticSettings are sent as startup parameters on every connection to
+// a target database, so no check can write, wait on locks, or run long
+// enough to hurt an already struggling database.
+var diagnosticSettings = [][2]string{
+	{"application_name", diagnosticApplicationName},
+	{"default_transaction_read_only", "on"},
+	{"statement_timeout", "20s"},
+	{"lock_timeout", "1s"},
+	{"idle_in_transaction_session_timeout", "10s"},
+}
+
 func connectDB(dbURL string) (*sqlx.DB, error) {
-	db, err := sqlx.Open("postgres", dbURL)
+	db, err := openDiagnosticDB(dbURL, diagnosticSettings)
+	if err != nil && strings.Contains(err.Error(), "idle_in_transaction_session_timeout") {
+		// not known before 9.6, where the rest still applies
+		db, err = openDiagnosticDB(dbURL, diagnosticSettings[:len(diagnosticSettings)-1])
+	}
+	return db, err
+}
+
+func openDiagnosticDB(dbURL string, settings [][2]string) (*sqlx.DB, error) {
+	db, err := sqlx.Open("postgres", withSettings(dbURL, settings))
 	if err != nil {
 		return nil, err
 	}
+	db.SetMaxOpenConns(1)
 
 	_, err = db.Exec("select 1")
 	if err != nil {
+		db.Close()
 		return nil, err
 	}
 
 	return db, nil
 }
 
+// withSettings adds settings to a postgres:// url or key=value connection
+// string, replacing any the caller set.
+func withSettings(connstring string, settings [][2]string) string {
+	if strings.HasPrefix(connstring, "postgres://") || strings.HasPrefix(connstring, "postgresql://") {
+		u, err := url.Parse(connstring)
+		if err != nil {
+			return connstring
+		}
+		q := u.Query()
+		for _, setting := range settings {
+			q.Set(setting[0], setting[1])
+		}
+		u.RawQuery = q.Encode()
+		return u.String()
+	}
+
+	for _, setting := range settings {
+		connstring += fmt.Sprintf(" %s='%s'", setting[0], setting[1])
+	}
+	return connstring
+}
+
 func makeErrorCheck(name string, err error) Check {
 	log.Println(err)
 	reason := make(map[string]string)
@@ -63,10 +185,10 @@ type connCountResult struct {
 	Count int64 `json:"count"`
 }
 
-func connCountCheck(db *sqlx.DB, limit int) Check {
+func connCountCheck(db *sqlx.DB, limit int, filter activityFilter) Check {
 	checkTitle := "Connection Count"
 	var result []connCountResult
-	err := db.Select(&result, "SELECT count(*) FROM pg_stat_activity where usename = current_user")
+	err := db.Select(&result, filter.query(connCountSQL), filter.args()...)
 	if err != nil {
 		return makeErrorCheck(checkTitle, err)
 	}
@@ -90,10 +212,10 @@ type longQueriesResult struct {
 	Query    string `json:"query"`
 }
 
-func longQueriesCheck(db *sqlx.DB) Check {
+func longQueriesCheck(db *sqlx.DB, filter activityFilter) Check {
 	checkTitle := "Long Queries"
 	var results []longQueriesResult
-	err := db.Select(&results, longQueriesSQL)
+	err := db.Select(&results, filter.query(longQueriesSQL), filter.args()...)
 	if err != nil {
 		return makeErrorCheck(checkTitle, err)
 	}
@@ -114,10 +236,10 @@ type idleQueriesResult struct {
 	Query    string `json:"query"`
 }
 
-func idleQueriesCheck(db *sqlx.DB) Check {
+func idleQueriesCheck(db *sqlx.DB, filter activityFilter) Check {
 	checkTitle := "Idle in Transaction"
 	var results []idleQueriesResult
-	err := db.Select(&results, idleQueriesSQL)
+	err := db.Select(&results, filter.query(idleQueriesSQL), filter.args()...)
 	if err != nil {
 		return makeErrorCheck(checkTitle, err)
 	}
@@ -256,7 +378,7 @@ func seqCheck(db *sqlx.DB) Check {
 	for _, seq := range tmpSeqs {
 		err = db.Get(&seq, fmt.Sprintf(sql, seq.Seq))
 		if err != nil {
-			log.Printf(err.Error())
+			log.Println(err)
 		}
 		if seq.Pct > yellowCutoff {
 			retSeqs = append(retSeqs, seq)
@@ -279,18 +401,28 @@ func seqCheck(db *sqlx.DB) Check {
 }
 
 const (
+	// the activity queries get an activityFilter clause filled in for %s
+	connCountSQL = `
+	  SELECT count(*)
+	  FROM pg_stat_activity
+	  WHERE usename = current_user
+		AND %s
+		;`
+
 	longQueriesSQL = `
 	  SELECT pid, now()-query_start as duration, query
 	  FROM pg_stat_activity
 	  WHERE now()-query_start > '1 minute'::interval
 		AND state = 'active'
+		AND %s
 		;`
 
 	idleQueriesSQL = `
 	  SELECT pid, now()-query_start as duration, query
 	  FROM pg_stat_activity
 	  WHERE now()-query_start > '1 minute'::interval
-		AND state like 'idle in trans%'
+		AND state like 'idle in trans%%'
+		AND %s
 		;`
 
 	// http://www.databasesoup.com/2014/05/new-finding-unused-indexes-query.html
@@ -0,0 +1,246 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+)
+
+// runCommand handles the subcommands pgdiagnose understands besides running
+// the server, and returns the process exit code.
+func runCommand(args []string) int {
+	switch args[0] {
+	case "check":
+		return checkCommand(args[1:])
+	case "fleet":
+		return fleetCommand(args[1:])
+	case "migrate":
+		return migrateCommand()
+	case "schema":
+		return schemaCommand()
+	case "token":
+		return tokenCommand(args[1:])
+	}
+	fmt.Fprintf(os.Stderr, "unknown command %q\n", args[0])
+	fmt.Fprintln(os.Stderr, "usage: pgdiagnose [check [flags] postgres://... | fleet [flags] inventory.json | migrate | schema | token create|revoke ...]")
+	return 2
+}
+
+func tokenCommand(args []string) int {
+	usage := "usage: pgdiagnose token create [-app name] name | token revoke id"
+	if len(args) == 0 {
+		fmt.Fprintln(os.Stderr, usage)
+		return 2
+	}
+	store, err := setupStore(os.Getenv("REPORT_STORE"))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	switch args[0] {
+	case "create":
+		flags := flag.NewFlagSet("token create", flag.ExitOnError)
+		app := flags.String("app", "", "only allow access to this app's reports")
+		flags.Parse(args[1:])
+		if flags.NArg() != 1 {
+			fmt.Fprintln(os.Stderr, usage)
+			return 2
+		}
+
+		secret, token := newToken(flags.Arg(0), *app)
+		err := store.SaveToken(token)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		fmt.Fprintf(os.Stderr, "created token %s, it won't be shown again:\n", token.Id)
+		fmt.Println(secret)
+		return 0
+
+	case "revoke":
+		if len(args) != 2 {
+			fmt.Fprintln(os.Stderr, usage)
+			return 2
+		}
+		err := store.RevokeToken(args[1])
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		return 0
+	}
+
+	fmt.Fprintln(os.Stderr, usage)
+	return 2
+}
+
+func migrateCommand() int {
+	db, err := setupDB()
+	if err == nil {
+		err = migrate(db)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	return 0
+}
+
+func checkCommand(args []string) int {
+	var params JobParams
+	flags := flag.NewFlagSet("check", flag.ExitOnError)
+	flags.StringVar(&params.Plan, "plan", "", "plan name, for connection limits")
+	flags.StringVar(&params.App, "app", "", "app the database belongs to")
+	flags.StringVar(&params.Database, "database", "", "name of the database within the app")
+	flags.BoolVar(&params.AllDatabases, "all-databases", false, "run the per database checks on every database on the server")
+	flags.IntVar(&params.SampleWindow, "sample-window", 0, "seconds to sample activity and locks for")
+	flags.IntVar(&params.SampleInterval, "sample-interval", 0, "seconds between samples")
+	flags.StringVar(&params.TLS.Mode, "sslmode", "", "disable, allow, prefer, require, verify-ca or verify-full (default TARGET_SSLMODE, the url's sslmode or require)")
+	rootCert := flags.String("sslrootcert", "", "file with root certificates to verify the server with")
+	cert := flags.String("sslcert", "", "file with a client certificate")
+	key := flags.String("sslkey", "", "file with the client certificate's key")
+	flags.StringVar(&params.Tunnel.SSH, "ssh", "", "user@host[:port] of an ssh jump host to connect through")
+	sshKey := flags.String("ssh-key", "", "file with the private key for the ssh jump host")
+	sshKnownHosts := flags.String("ssh-known-hosts", "", "known_hosts file to check the ssh jump host against")
+	flags.StringVar(&params.Tunnel.SOCKS5, "socks5", "", "socks5://[user:password@]host:port of a proxy to connect through")
+	redaction := flags.String("redaction", "", "how to keep query text: full, normalized or hidden (default QUERY_REDACTION or normalized)")
+	storeKind := flags.String("store", os.Getenv("REPORT_STORE"), "report store: postgres, file or memory (default memory)")
+	format := flags.String("format", "json", "print the report as "+strings.Join(exportFormats, ", "))
+	check := flags.String("check", "", "with -format csv, print the results of this check instead of the list of checks")
+	flags.Parse(args)
+
+	if flags.NArg() != 1 {
+		fmt.Fprintln(os.Stderr, "usage: pgdiagnose check [flags] postgres://...")
+		flags.PrintDefaults()
+		return 2
+	}
+	params.URL = flags.Arg(0)
+
+	for _, f := range []struct {
+		path string
+		pem  *string
+	}{
+		{*rootCert, &params.TLS.RootCert},
+		{*cert, &params.TLS.Cert},
+		{*key, &params.TLS.Key},
+		{*sshKey, &params.Tunnel.SSHKey},
+		{*sshKnownHosts, &params.Tunnel.SSHKnownHosts},
+	} {
+		if f.path == "" {
+			continue
+		}
+		pem, err := ioutil.ReadFile(f.path)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		*f.pem = string(pem)
+	}
+
+	if *storeKind == "" {
+		*storeKind = "memory"
+	}
+
+	config, err := loadConfig()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	if *redaction != "" {
+		if !validRedaction(*redaction) {
+			fmt.Fprintf(os.Stderr, "unknown redaction mode %q\n", *redaction)
+			return 2
+		}
+		config.Redaction = *redaction
+	}
+
+	if !validExportFormat(*format) {
+		fmt.Fprintf(os.Stderr, "unknown format %q\n", *format)
+		return 2
+	}
+
+	store, err := setupStore(*storeKind)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	report, err := createJob(store, config, logNotifier{}, params)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	out, err := formatReport(report, *format, *check, config)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	fmt.Println(out)
+	return 0
+}
+
+// formatReport renders a report for the terminal. Chat formats only link
+// to the report when BASE_URL says where it can be seen.
+func formatReport(report *Report, format, check string, config Config) (string, error) {
+	link := ""
+	if config.BaseURL != "" {
+		link = reportLink(config, report.Id)
+	}
+	return exportReport(report, format, check, link)
+}
+
+// schemaCommand prints the JSON Schema of -format envelope reports.
+func schemaCommand() int {
+	schema, err := PrettyJSON(reportSchema())
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	fmt.Println(schema)
+	return 0
+}
+
+func fleetCommand(args []string) int {
+	flags := flag.NewFlagSet("fleet", flag.ExitOnError)
+	parallel := flags.Int("parallel", 4, "how many databases to diagnose at once")
+	storeKind := flags.String("store", os.Getenv("REPORT_STORE"), "report store: postgres, file or memory (default postgres)")
+	flags.Parse(args)
+
+	if flags.NArg() != 1 {
+		fmt.Fprintln(os.Stderr, "usage: pgdiagnose fleet [flags] inventory.json")
+		flags.PrintDefaults()
+		return 2
+	}
+
+	targets, err := loadInventory(flags.Arg(0))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	config, err := loadConfig()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	store, err := setupStore(*storeKind)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	summary := runFleet(targets, *parallel, func(params JobParams) (*Report, error) {
+		return createJob(store, config, logNotifier{}, params)
+	})
+
+	js, err := PrettyJSON(summary)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	fmt.Println(js)
+	return 0
+}
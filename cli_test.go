@@ -0,0 +1,46 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"encoding/xml"
+	"reflect"
+	"testing"
+)
+
+func TestCheckCommandPrintsOnlyTheReport(t *testing.T) {
+	addr := fakeQueryPostgres(t, map[string][]string{"server_version_num": {"160002"}})
+	url := "postgres://u@" + addr + "/db?sslmode=disable"
+
+	for _, format := range []string{formatCSV, formatJUnit, formatSARIF, formatEnvelope} {
+		var code int
+		out := captureStdout(t, func() { code = checkCommand([]string{"-format", format, url}) })
+		if code != 0 {
+			t.Fatalf("%s. Expected the check to succeed, but was %d", format, code)
+		}
+
+		var err error
+		switch format {
+		case formatCSV:
+			var records [][]string
+			records, err = csv.NewReader(bytes.NewReader(out)).ReadAll()
+			if err == nil && (len(records) < 2 || !reflect.DeepEqual(records[0], []string{"database", "check", "status", "results"})) {
+				t.Errorf("%s. Expected a header and a row per check, but was %q", format, out)
+			}
+		case formatJUnit:
+			// xml skips text before the root element, so check for it too
+			var suites junitTestSuites
+			err = xml.Unmarshal(out, &suites)
+			if err == nil && (!bytes.HasPrefix(out, []byte("<")) || suites.Tests == 0) {
+				t.Errorf("%s. Expected only test suites, but was %q", format, out)
+			}
+		default:
+			var v map[string]interface{}
+			err = json.Unmarshal(out, &v)
+		}
+		if err != nil {
+			t.Errorf("%s. Expected only the report on stdout, but was %q (%v)", format, out, err)
+		}
+	}
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"fmt"
+	"github.com/go-martini/martini"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Config is the server-wide configuration, read from the environment at
+// startup.
+type Config struct {
+	Retention retentionPolicy
+	// Redaction is how query text is stored: full, normalized or hidden.
+	Redaction string
+	// RequireAuth makes the reports API require a token, and defaults to
+	// on in production.
+	RequireAuth bool
+	// ShareSecret signs shareable report links, which are disabled
+	// without one.
+	ShareSecret []byte
+	// BaseURL is where the server is reachable, for links to reports in
+	// chat messages.
+	BaseURL string
+
+	// MaxDiagnoses and MaxDiagnosesPerTarget cap how many diagnoses run at
+	// once. Requests for a target diagnosed within DedupeWindow get that
+	// report instead of a new one.
+	MaxDiagnoses          int
+	MaxDiagnosesPerTarget int
+	DedupeWindow          time.Duration
+
+	Activity activityFilter
+
+	// TLS is the default TLS for target connections, which requests can
+	// override.
+	TLS TLSOptions
+
+	// ScheduleURLEnvs are the environment variables schedules may read
+	// their url from with url_env. Any other variable, DATABASE_URL
+	// included, is off limits.
+	ScheduleURLEnvs []string
+}
+
+func loadConfig() (Config, error) {
+	var config Config
+	var err error
+
+	config.Retention, err = loadRetentionPolicy()
+	if err != nil {
+		return config, err
+	}
+
+	config.Redaction = os.Getenv("QUERY_REDACTION")
+	if config.Redaction == "" {
+		config.Redaction = redactNormalized
+	}
+	if !validRedaction(config.Redaction) {
+		return config, fmt.Errorf("QUERY_REDACTION: unknown mode %q", config.Redaction)
+	}
+
+	config.ShareSecret = []byte(os.Getenv("SHARE_SECRET"))
+	config.BaseURL = strings.TrimSuffix(os.Getenv("BASE_URL"), "/")
+
+	config.Activity, err = loadActivityFilter()
+	if err != nil {
+		return config, err
+	}
+
+	config.TLS, err = loadTLSOptions()
+	if err != nil {
+		return config, err
+	}
+	config.ScheduleURLEnvs = splitPatterns(os.Getenv("SCHEDULE_URL_ENVS"))
+
+	config.MaxDiagnoses, err = envInt("MAX_DIAGNOSES", 10)
+	if err != nil {
+		return config, err
+	}
+	config.MaxDiagnosesPerTarget, err = envInt("MAX_DIAGNOSES_PER_TARGET", 1)
+	if err != nil {
+		return config, err
+	}
+	config.DedupeWindow = 30 * time.Second
+	if os.Getenv("DEDUPE_WINDOW") != "" {
+		config.DedupeWindow, err = envDuration("DEDUPE_WINDOW")
+		if err != nil {
+			return config, err
+		}
+	}
+
+	switch os.Getenv("REQUIRE_AUTH") {
+	case "":
+		config.RequireAuth = martini.Env == "production"
+	case "true", "1":
+		config.RequireAuth = true
+	case "false", "0":
+		config.RequireAuth = false
+	default:
+		return config, fmt.Errorf("REQUIRE_AUTH: expected true or false, got %q", os.Getenv("REQUIRE_AUTH"))
+	}
+
+	return config, nil
+}
+
+// parseDurations parses a list like "app1=24h,app2=720h".
+func parseDurations(s string) (map[string]time.Duration, error) {
+	durations := make(map[string]time.Duration)
+	for _, pair := range strings.Split(s, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		parts := strings.SplitN(pair, "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("expected name=duration, got %q", pair)
+		}
+		d, err := time.ParseDuration(strings.TrimSpace(parts[1]))
+		if err != nil {
+			return nil, err
+		}
+		durations[strings.TrimSpace(parts[0])] = d
+	}
+	return durations, nil
+}
+
+func envInt(name string, def int) (int, error) {
+	s := os.Getenv(name)
+	if s == "" {
+		return def, nil
+	}
+	n, err := strconv.Atoi(s)
+	if err != nil {
+		return 0, fmt.Errorf("%s: %v", name, err)
+	}
+	return n, nil
+}
+
+func envDuration(name string) (time.Duration, error) {
+	s := os.Getenv(name)
+	if s == "" {
+		return 0, nil
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		return 0, fmt.Errorf("%s: %v", name, err)
+	}
+	return d, nil
+}
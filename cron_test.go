@@ -0,0 +1,47 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+var cronTests = []struct {
+	expr     string
+	after    string
+	expected string
+}{
+	{"*/15 * * * *", "2024-03-01T10:07:00Z", "2024-03-01T10:15:00Z"},
+	{"0 * * * *", "2024-03-01T10:00:00Z", "2024-03-01T11:00:00Z"},
+	{"@daily", "2024-03-01T10:07:00Z", "2024-03-02T00:00:00Z"},
+	{"30 2 * * 1-5", "2024-03-01T03:00:00Z", "2024-03-04T02:30:00Z"},
+	{"0 0 29 2 *", "2024-03-01T00:00:00Z", "2028-02-29T00:00:00Z"},
+	{"0 9 1,15 * *", "2024-03-02T00:00:00Z", "2024-03-15T09:00:00Z"},
+	// either day field matches when both are set
+	{"0 0 13 * 5", "2024-03-01T10:00:00Z", "2024-03-08T00:00:00Z"},
+	{"0 0 * * 7", "2024-03-01T10:00:00Z", "2024-03-03T00:00:00Z"},
+	{"0 12 * 6 *", "2024-07-01T00:00:00Z", "2025-06-01T12:00:00Z"},
+}
+
+func TestCronNext(t *testing.T) {
+	for i, test := range cronTests {
+		c, err := parseCron(test.expr)
+		if err != nil {
+			t.Errorf("%d. %v", i, err)
+			continue
+		}
+		after, _ := time.Parse(time.RFC3339, test.after)
+		expected, _ := time.Parse(time.RFC3339, test.expected)
+		actual := c.next(after)
+		if !actual.Equal(expected) {
+			t.Errorf("%d. Expected %v, but was %v", i, expected, actual)
+		}
+	}
+}
+
+func TestParseCronErrors(t *testing.T) {
+	for _, expr := range []string{"", "* * * *", "60 * * * *", "* * 0 * *", "5-1 * * * *", "*/0 * * * *", "a * * * *", "0 0 30 2 *"} {
+		if _, err := parseCron(expr); err == nil {
+			t.Errorf("expected %q to be rejected", expr)
+		}
+	}
+}
@@ -0,0 +1,355 @@
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+)
+
+// reportSchemaVersion is bumped whenever the envelope, or the results of a
+// check, change in a way clients have to know about.
+const reportSchemaVersion = 1
+
+// version is the pgdiagnose version, set when building with
+// -ldflags "-X main.version=v1.2.3".
+var version = "dev"
+
+const formatEnvelope = "envelope"
+
+// reportEnvelope is a report in a versioned shape that report.schema.json
+// describes, with the results of every check typed by the check's name and
+// the error of skipped checks kept apart from them.
+type reportEnvelope struct {
+	SchemaVersion     int                `json:"schema_version"`
+	PgdiagnoseVersion string             `json:"pgdiagnose_version"`
+	Id                string             `json:"id"`
+	App               string             `json:"app"`
+	Database          string             `json:"database"`
+	Plan              string             `json:"plan"`
+	Target            envelopeTarget     `json:"target"`
+	CreatedAt         time.Time          `json:"created_at"`
+	StartedAt         *time.Time         `json:"started_at"`
+	FinishedAt        *time.Time         `json:"finished_at"`
+	CompactedAt       *time.Time         `json:"compacted_at"`
+	Summary           envelopeSummary    `json:"summary"`
+	Checks            []typedCheck       `json:"checks"`
+	Databases         []typedDatabase    `json:"databases"`
+	Timings           map[string]float64 `json:"timings_ms"`
+}
+
+type envelopeTarget struct {
+	ServerVersion string          `json:"server_version"`
+	Connection    *connectionInfo `json:"connection"`
+}
+
+type envelopeSummary struct {
+	Status string       `json:"status"`
+	Checks int          `json:"checks"`
+	Counts statusCounts `json:"counts"`
+}
+
+type statusCounts struct {
+	Green   int `json:"green"`
+	Yellow  int `json:"yellow"`
+	Red     int `json:"red"`
+	Skipped int `json:"skipped"`
+}
+
+type typedDatabase struct {
+	Name   string       `json:"name"`
+	Status string       `json:"status"`
+	Checks []typedCheck `json:"checks"`
+}
+
+// typedCheck holds the results of a check as a list of the check's result
+// type. Results are empty for skipped checks, whose reason is in Error, and
+// for compacted reports.
+type typedCheck struct {
+	Name    string      `json:"name"`
+	Status  string      `json:"status"`
+	Error   string      `json:"error,omitempty"`
+	Results interface{} `json:"results"`
+}
+
+// The metrics checks keep their results in a map of strings; these are the
+// keys they use.
+type loadResult struct {
+	Load           string `json:"load,omitempty"`
+	LoadFrom       string `json:"load_from,omitempty"`
+	CPUCount       string `json:"cpu_count,omitempty"`
+	LoadPerCore    string `json:"load_per_core,omitempty"`
+	Bound          string `json:"bound,omitempty"`
+	ActiveSessions string `json:"active_sessions,omitempty"`
+	CPUSessions    string `json:"cpu_sessions,omitempty"`
+	IOSessions     string `json:"io_sessions,omitempty"`
+	LockSessions   string `json:"lock_sessions,omitempty"`
+	Source         string `json:"source,omitempty"`
+}
+
+type memoryResult struct {
+	MemoryUsed  string `json:"memory_used"`
+	MemoryTotal string `json:"memory_total"`
+	PercentUsed string `json:"percent_used"`
+	SwapUsed    string `json:"swap_used,omitempty"`
+	SwapTotal   string `json:"swap_total,omitempty"`
+	Source      string `json:"source,omitempty"`
+}
+
+type diskResult struct {
+	DiskUsed    string `json:"disk_used"`
+	DiskTotal   string `json:"disk_total"`
+	PercentUsed string `json:"percent_used"`
+	Source      string `json:"source,omitempty"`
+}
+
+type iopsResult struct {
+	IOPS        string `json:"iops"`
+	PlanIOPS    string `json:"plan_iops"`
+	PercentUsed string `json:"percent_used"`
+	Source      string `json:"source,omitempty"`
+}
+
+// checkResultTypes is the type of a result row of each check. A check
+// without a type, like the Connection check of a database that couldn't be
+// reached, never has results.
+var checkResultTypes = map[string]reflect.Type{
+	"Activity Sample":       reflect.TypeOf(sampleResult{}),
+	"All Databases":         nil,
+	"Backend Types":         reflect.TypeOf(backendTypeResult{}),
+	"Blocking Queries":      reflect.TypeOf(blockingResult{}),
+	"Bloat":                 reflect.TypeOf(bloatResult{}),
+	"Checkpoints":           reflect.TypeOf(checkpointResult{}),
+	"Connection":            nil,
+	"Connection Count":      reflect.TypeOf(connCountResult{}),
+	"Disk":                  reflect.TypeOf(diskResult{}),
+	"Hit Rate":              reflect.TypeOf(hitRateResult{}),
+	"Idle in Transaction":   reflect.TypeOf(idleQueriesResult{}),
+	"IOPS":                  reflect.TypeOf(iopsResult{}),
+	"Indexes":               reflect.TypeOf(unusedIndexesResult{}),
+	"Load":                  reflect.TypeOf(loadResult{}),
+	"Long Queries":          reflect.TypeOf(longQueriesResult{}),
+	"Memory":                reflect.TypeOf(memoryResult{}),
+	"Prepared Transactions": reflect.TypeOf(preparedXactResult{}),
+	"Sequences":             reflect.TypeOf(sequenceResult{}),
+	"Transactions":          reflect.TypeOf(xactResult{}),
+	"Wait Events":           reflect.TypeOf(waitProfileResult{}),
+	"Xmin Horizon":          reflect.TypeOf(xminHorizonResult{}),
+}
+
+var checkStatuses = []string{"green", "yellow", "red", "skipped"}
+
+func newEnvelope(report *Report) (*reportEnvelope, error) {
+	envelope := &reportEnvelope{
+		SchemaVersion:     reportSchemaVersion,
+		PgdiagnoseVersion: version,
+		Id:                report.Id,
+		App:               report.App,
+		Database:          report.Database,
+		Plan:              report.Plan,
+		Target:            envelopeTarget{report.ServerVersion, report.Connection},
+		CreatedAt:         report.CreatedAt,
+		StartedAt:         report.StartedAt,
+		FinishedAt:        report.FinishedAt,
+		CompactedAt:       report.CompactedAt,
+		Summary:           envelopeSummary{Status: report.SummaryStatus},
+		Databases:         []typedDatabase{},
+		Timings:           report.Timings,
+	}
+	if envelope.Timings == nil {
+		envelope.Timings = checkTimings{}
+	}
+
+	var err error
+	envelope.Checks, err = typedChecks(report.Checks)
+	if err != nil {
+		return nil, err
+	}
+	for _, d := range report.Databases {
+		checks, err := typedChecks(d.Checks)
+		if err != nil {
+			return nil, err
+		}
+		envelope.Databases = append(envelope.Databases, typedDatabase{d.Name, d.Status, checks})
+	}
+
+	for _, check := range allChecks(report.Checks, report.Databases) {
+		envelope.Summary.Checks++
+		switch check.Status {
+		case "green":
+			envelope.Summary.Counts.Green++
+		case "yellow":
+			envelope.Summary.Counts.Yellow++
+		case "red":
+			envelope.Summary.Counts.Red++
+		case "skipped":
+			envelope.Summary.Counts.Skipped++
+		}
+	}
+	return envelope, nil
+}
+
+func typedChecks(checks []Check) ([]typedCheck, error) {
+	typed := []typedCheck{}
+	for _, check := range checks {
+		t, err := typeCheck(check)
+		if err != nil {
+			return nil, err
+		}
+		typed = append(typed, t)
+	}
+	return typed, nil
+}
+
+// typeCheck decodes the results of a check into a slice of its result
+// type, which works the same for fresh reports and for ones read back from
+// a store. Checks of unknown names get untyped objects.
+func typeCheck(check Check) (typedCheck, error) {
+	typed := typedCheck{Name: check.Name, Status: check.Status, Results: []interface{}{}}
+
+	js, err := json.Marshal(check.Results)
+	if err != nil {
+		return typed, err
+	}
+
+	if check.Status == "skipped" {
+		var reason struct {
+			Error string `json:"error"`
+		}
+		// a skipped check's reason is a map, but anything else just has
+		// no error to show
+		json.Unmarshal(js, &reason)
+		typed.Error = reason.Error
+		return typed, nil
+	}
+
+	t, known := checkResultTypes[check.Name]
+	if !known {
+		t = reflect.TypeOf(map[string]interface{}{})
+	}
+	if t == nil || string(js) == "null" {
+		return typed, nil
+	}
+
+	// the metrics checks have a single object rather than a list
+	if strings.HasPrefix(string(js), "{") {
+		js = append(append([]byte("["), js...), ']')
+	}
+	results := reflect.New(reflect.SliceOf(t))
+	err = json.Unmarshal(js, results.Interface())
+	if err != nil {
+		return typed, err
+	}
+	typed.Results = results.Elem().Interface()
+	return typed, nil
+}
+
+// reportSchema is the JSON Schema of the envelope, built from the Go types
+// so the two can't drift apart. report.schema.json is a copy of it.
+func reportSchema() map[string]interface{} {
+	schema := jsonSchema(reflect.TypeOf(reportEnvelope{}))
+	schema["$schema"] = "https://json-schema.org/draft/2020-12/schema"
+	schema["title"] = "pgdiagnose report"
+	schema["properties"].(map[string]interface{})["schema_version"] = map[string]interface{}{"const": reportSchemaVersion}
+
+	var names []string
+	for name := range checkResultTypes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var byName []interface{}
+	for _, name := range names {
+		items := map[string]interface{}{"not": map[string]interface{}{}}
+		if t := checkResultTypes[name]; t != nil {
+			items = jsonSchema(t)
+		}
+		byName = append(byName, map[string]interface{}{
+			"if": map[string]interface{}{
+				"properties": map[string]interface{}{"name": map[string]interface{}{"const": name}},
+			},
+			"then": map[string]interface{}{
+				"properties": map[string]interface{}{
+					"results": map[string]interface{}{"type": "array", "items": items},
+				},
+			},
+		})
+	}
+
+	check := structSchema(typedCheckType)
+	check["properties"].(map[string]interface{})["status"] = map[string]interface{}{
+		"type": "string",
+		"enum": checkStatuses,
+	}
+	check["properties"].(map[string]interface{})["results"] = map[string]interface{}{"type": "array"}
+	check["allOf"] = byName
+	schema["$defs"] = map[string]interface{}{"check": check}
+	return schema
+}
+
+var (
+	timeType       = reflect.TypeOf(time.Time{})
+	typedCheckType = reflect.TypeOf(typedCheck{})
+)
+
+// jsonSchema describes how encoding/json marshals values of type t. Fields
+// without omitempty are required; nil slices and pointers may be null.
+func jsonSchema(t reflect.Type) map[string]interface{} {
+	switch {
+	case t == timeType:
+		return map[string]interface{}{"type": "string", "format": "date-time"}
+	case t == typedCheckType:
+		return map[string]interface{}{"$ref": "#/$defs/check"}
+	}
+
+	switch t.Kind() {
+	case reflect.Ptr:
+		return map[string]interface{}{"anyOf": []interface{}{jsonSchema(t.Elem()), map[string]interface{}{"type": "null"}}}
+	case reflect.Slice:
+		return map[string]interface{}{"type": []string{"array", "null"}, "items": jsonSchema(t.Elem())}
+	case reflect.Map:
+		return map[string]interface{}{"type": "object", "additionalProperties": jsonSchema(t.Elem())}
+	case reflect.String:
+		return map[string]interface{}{"type": "string"}
+	case reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]interface{}{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]interface{}{"type": "number"}
+	case reflect.Struct:
+		return structSchema(t)
+	}
+	return map[string]interface{}{}
+}
+
+func structSchema(t reflect.Type) map[string]interface{} {
+	properties := make(map[string]interface{})
+	required := []string{}
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if field.PkgPath != "" {
+			continue
+		}
+		name, options := field.Name, ""
+		if tag := field.Tag.Get("json"); tag != "" {
+			parts := strings.SplitN(tag, ",", 2)
+			if parts[0] == "-" {
+				continue
+			}
+			if parts[0] != "" {
+				name = parts[0]
+			}
+			if len(parts) > 1 {
+				options = parts[1]
+			}
+		}
+		properties[name] = jsonSchema(field.Type)
+		if !strings.Contains(options, "omitempty") {
+			required = append(required, name)
+		}
+	}
+	return map[string]interface{}{"type": "object", "properties": properties, "required": required}
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestNewEnvelope(t *testing.T) {
+	load := 3.0
+	report := &Report{
+		Id:            "id",
+		SummaryStatus: "red",
+		ServerVersion: "16.2",
+		Checks: []Check{
+			{"Long Queries", "red", []longQueriesResult{{1, "00:02:00", "select 1"}}},
+			{"Sequences", "green", []sequenceResult(nil)},
+			{"Load", "yellow", loadCheck(&load, nil, nil).Results},
+			makeErrorCheck("Hit Rate", nil),
+		},
+		Databases: []databaseReport{
+			{"orders", "green", []Check{{"Bloat", "green", []bloatResult{{"table", "orders", 2, "1 MB"}}}}},
+		},
+	}
+
+	// a report read back from a store has generic results
+	js, err := json.Marshal(report)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var stored Report
+	if err := json.Unmarshal(js, &stored); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, r := range []*Report{report, &stored} {
+		envelope, err := newEnvelope(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if envelope.SchemaVersion != reportSchemaVersion || envelope.Target.ServerVersion != "16.2" {
+			t.Errorf("unexpected envelope %+v", envelope)
+		}
+		expected := envelopeSummary{"red", 5, statusCounts{Green: 2, Yellow: 1, Red: 1, Skipped: 1}}
+		if envelope.Summary != expected {
+			t.Errorf("Expected %+v, but was %+v", expected, envelope.Summary)
+		}
+
+		var resulttests = []struct {
+			check    typedCheck
+			expected interface{}
+		}{
+			{envelope.Checks[0], []longQueriesResult{{1, "00:02:00", "select 1"}}},
+			{envelope.Checks[1], []interface{}{}},
+			{envelope.Checks[2], []loadResult{{Load: "3"}}},
+			{envelope.Checks[3], []interface{}{}},
+			{envelope.Databases[0].Checks[0], []bloatResult{{"table", "orders", 2, "1 MB"}}},
+		}
+		for i, tt := range resulttests {
+			if !reflect.DeepEqual(tt.check.Results, tt.expected) {
+				t.Errorf("%d. Expected %#v, but was %#v", i, tt.expected, tt.check.Results)
+			}
+		}
+		if envelope.Checks[3].Error != "could not do check" {
+			t.Errorf("expected the skipped check's error apart from its results, got %+v", envelope.Checks[3])
+		}
+	}
+}
+
+func TestReportSchemaFile(t *testing.T) {
+	schema, err := PrettyJSON(reportSchema())
+	if err != nil {
+		t.Fatal(err)
+	}
+	published, err := ioutil.ReadFile("report.schema.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.TrimSpace(string(published)) != schema {
+		t.Fatal("report.schema.json is out of date, regenerate it with: pgdiagnose schema > report.schema.json")
+	}
+}
+
+func TestReportSchemaTypesResults(t *testing.T) {
+	schema := reportSchema()
+	check := schema["$defs"].(map[string]interface{})["check"].(map[string]interface{})
+	for _, rule := range check["allOf"].([]interface{}) {
+		name := rule.(map[string]interface{})["if"].(map[string]interface{})["properties"].(map[string]interface{})["name"].(map[string]interface{})["const"]
+		if name != "Bloat" {
+			continue
+		}
+		items := rule.(map[string]interface{})["then"].(map[string]interface{})["properties"].(map[string]interface{})["results"].(map[string]interface{})["items"].(map[string]interface{})
+		expected := []string{"type", "object", "bloat", "waste"}
+		if !reflect.DeepEqual(items["required"], expected) {
+			t.Fatalf("Expected %v, but was %v", expected, items["required"])
+		}
+		return
+	}
+	t.Fatal("expected a rule for Bloat")
+}
+
+func TestTypeCheckKeepsMetricsSource(t *testing.T) {
+	check := Check{"Memory", "green", map[string]string{"memory_used": "1.0 GB", "memory_total": "4.0 GB", "percent_used": "25.00", "source": metricsFromProcfs}}
+	typed, err := typeCheck(check)
+	if err != nil {
+		t.Fatal(err)
+	}
+	results := typed.Results.([]memoryResult)
+	if len(results) != 1 || results[0].Source != metricsFromProcfs {
+		t.Fatalf("expected the metrics source to be kept, got %+v", typed.Results)
+	}
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"time"
+)
+
+// Events a finished report can emit.
+const (
+	eventReportCompleted = "report.completed"
+	// eventReportRed is emitted along with report.completed when any
+	// check is red.
+	eventReportRed     = "report.red"
+	eventStatusChanged = "check.status_changed"
+)
+
+var eventTypes = []string{eventReportCompleted, eventReportRed, eventStatusChanged}
+
+// event is emitted when a finished report says something worth telling
+// people about.
+type event struct {
+	Type          string         `json:"type"`
+	ReportId      string         `json:"report_id"`
+	App           string         `json:"app"`
+	Database      string         `json:"database"`
+	SummaryStatus string         `json:"summary_status"`
+	FailingChecks []string       `json:"failing_checks"`
+	CreatedAt     time.Time      `json:"created_at"`
+	Changes       []statusChange `json:"changes,omitempty"`
+
+	report *Report
+}
+
+// statusChange is a check whose status differs from the previous report
+// for the same app and database. Database is set for the per database
+// checks of reports run on every database.
+type statusChange struct {
+	Check    string `json:"check"`
+	Database string `json:"database,omitempty"`
+	From     string `json:"from"`
+	To       string `json:"to"`
+}
+
+type notifier interface {
+	Notify(e event)
+}
+
+// notifiers passes events on to each of several notifiers.
+type notifiers []notifier
+
+func (n notifiers) Notify(e event) {
+	for _, each := range n {
+		each.Notify(e)
+	}
+}
+
+// logNotifier writes events to the log, where they can be picked up when
+// nothing else is listening.
+type logNotifier struct{}
+
+func (logNotifier) Notify(e event) {
+	js, err := json.Marshal(e)
+	if err != nil {
+		log.Printf("%v", err)
+		return
+	}
+	log.Printf("event: %s", js)
+}
+
+// reportEvents returns the events for report, given the previous report for
+// the same app and database, which may be nil.
+func reportEvents(report, previous *Report) []event {
+	events := []event{newEvent(eventReportCompleted, report, nil)}
+	if len(events[0].FailingChecks) > 0 {
+		events = append(events, newEvent(eventReportRed, report, nil))
+	}
+
+	changes := statusChanges(report.Checks, previous, "")
+	for _, d := range report.Databases {
+		changes = append(changes, statusChanges(d.Checks, previous.forDatabase(d.Name), d.Name)...)
+	}
+	if len(changes) > 0 {
+		events = append(events, newEvent(eventStatusChanged, report, changes))
+	}
+	return events
+}
+
+func newEvent(kind string, report *Report, changes []statusChange) event {
+	return event{
+		Type:          kind,
+		ReportId:      report.Id,
+		App:           report.App,
+		Database:      report.Database,
+		SummaryStatus: report.SummaryStatus,
+		FailingChecks: checkNamesWithStatus(report, "red"),
+		CreatedAt:     time.Now(),
+		Changes:       changes,
+		report:        report,
+	}
+}
+
+// statusChanges compares checks with the previous report's. Checks that
+// were skipped either time can't have changed as far as anyone knows.
+func statusChanges(checks []Check, previous *Report, database string) []statusChange {
+	if previous == nil {
+		return nil
+	}
+	before := make(map[string]string)
+	for _, check := range previous.Checks {
+		before[check.Name] = check.Status
+	}
+
+	var changes []statusChange
+	for _, check := range checks {
+		from, ok := before[check.Name]
+		if !ok || from == check.Status || from == "skipped" || check.Status == "skipped" {
+			continue
+		}
+		changes = append(changes, statusChange{check.Name, database, from, check.Status})
+	}
+	return changes
+}
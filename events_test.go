@@ -0,0 +1,54 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestReportEvents(t *testing.T) {
+	previous := &Report{
+		Id:     "previous",
+		Checks: []Check{{"Sequences", "yellow", nil}, {"Bloat", "green", nil}, {"Load", "skipped", nil}},
+		Databases: []databaseReport{
+			{"other", "green", []Check{{"Bloat", "green", nil}}},
+		},
+	}
+	report := &Report{
+		Id:     "current",
+		App:    "app",
+		Checks: []Check{{"Sequences", "red", nil}, {"Bloat", "green", nil}, {"Load", "red", nil}, {"New", "red", nil}},
+		Databases: []databaseReport{
+			{"other", "yellow", []Check{{"Bloat", "yellow", nil}}},
+			{"added", "red", []Check{{"Bloat", "red", nil}}},
+		},
+	}
+
+	events := reportEvents(report, previous)
+	var types []string
+	for _, e := range events {
+		types = append(types, e.Type)
+	}
+	if !reflect.DeepEqual(types, []string{eventReportCompleted, eventReportRed, eventStatusChanged}) {
+		t.Fatalf("unexpected events %v", types)
+	}
+	if events[0].ReportId != "current" || events[0].App != "app" ||
+		!reflect.DeepEqual(events[0].FailingChecks, []string{"Sequences", "Load", "New", "Bloat"}) {
+		t.Fatalf("unexpected report.completed event %+v", events[0])
+	}
+	events = events[2:]
+
+	expected := []statusChange{
+		{"Sequences", "", "yellow", "red"},
+		{"Bloat", "other", "green", "yellow"},
+	}
+	if !reflect.DeepEqual(events[0].Changes, expected) {
+		t.Fatalf("Expected %v, but was %v", expected, events[0].Changes)
+	}
+
+	if len(reportEvents(report, nil)) != 2 {
+		t.Fatal("expected no status changes without a previous report")
+	}
+	if events := reportEvents(previous, previous); len(events) != 1 || events[0].Type != eventReportCompleted {
+		t.Fatalf("expected only report.completed for a green report that didn't change, got %+v", events)
+	}
+}
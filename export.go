@@ -0,0 +1,393 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Formats a report can be exported in, besides the chat formats.
+const (
+	formatJSON  = "json"
+	formatHTML  = "html"
+	formatJUnit = "junit"
+	formatSARIF = "sarif"
+	formatCSV   = "csv"
+)
+
+var exportFormats = []string{formatJSON, formatEnvelope, formatHTML, formatJUnit, formatSARIF, formatCSV, webhookMarkdown, webhookSlack}
+
+var contentTypes = map[string]string{
+	formatJSON:      "application/json",
+	formatEnvelope:  "application/json",
+	formatHTML:      "text/html; charset=utf-8",
+	formatJUnit:     "application/xml",
+	formatSARIF:     "application/sarif+json",
+	formatCSV:       "text/csv; charset=utf-8",
+	webhookMarkdown: "text/markdown; charset=utf-8",
+	webhookSlack:    "application/json",
+}
+
+var errUnknownFormat = errors.New("unknown format")
+
+func validExportFormat(format string) bool {
+	_, ok := contentTypes[format]
+	return ok
+}
+
+// exportReport renders report in format. CSV holds the results of the check
+// named check, or one row per check without one. Chat formats link to the
+// report at link if set.
+func exportReport(report *Report, format, check, link string) (string, error) {
+	switch format {
+	case formatJSON:
+		return PrettyJSON(report)
+	case formatEnvelope:
+		envelope, err := newEnvelope(report)
+		if err != nil {
+			return "", err
+		}
+		return PrettyJSON(envelope)
+	case formatHTML:
+		return renderHTML(report)
+	case formatJUnit:
+		return exportJUnit(report)
+	case formatSARIF:
+		return PrettyJSON(exportSARIF(report))
+	case formatCSV:
+		if check == "" {
+			return exportChecksCSV(report)
+		}
+		return exportCheckCSV(report, check)
+	case webhookMarkdown:
+		return renderMarkdown(report, nil, link), nil
+	case webhookSlack:
+		return PrettyJSON(renderSlack(report, nil, link))
+	}
+	return "", errUnknownFormat
+}
+
+// junitTestSuites has a suite for the server wide checks and one for each
+// database of reports run on every database. Red checks fail, skipped ones
+// are skipped, and yellow ones pass with a note so CI doesn't break on
+// warnings.
+type junitTestSuites struct {
+	XMLName  xml.Name         `xml:"testsuites"`
+	Name     string           `xml:"name,attr"`
+	Tests    int              `xml:"tests,attr"`
+	Failures int              `xml:"failures,attr"`
+	Skipped  int              `xml:"skipped,attr"`
+	Suites   []junitTestSuite `xml:"testsuite"`
+}
+
+type junitTestSuite struct {
+	Name      string          `xml:"name,attr"`
+	Tests     int             `xml:"tests,attr"`
+	Failures  int             `xml:"failures,attr"`
+	Skipped   int             `xml:"skipped,attr"`
+	Timestamp string          `xml:"timestamp,attr,omitempty"`
+	Cases     []junitTestCase `xml:"testcase"`
+}
+
+type junitTestCase struct {
+	Name      string        `xml:"name,attr"`
+	ClassName string        `xml:"classname,attr"`
+	Time      float64       `xml:"time,attr"`
+	Failure   *junitFailure `xml:"failure"`
+	Skipped   *junitSkipped `xml:"skipped"`
+	SystemOut string        `xml:"system-out,omitempty"`
+}
+
+type junitFailure struct {
+	Message string `xml:"message,attr"`
+	Type    string `xml:"type,attr"`
+	Text    string `xml:",chardata"`
+}
+
+type junitSkipped struct {
+	Message string `xml:"message,attr,omitempty"`
+}
+
+func exportJUnit(report *Report) (string, error) {
+	suites := junitTestSuites{Name: "pgdiagnose"}
+
+	target := report.App
+	if report.Database != "" {
+		target += "/" + report.Database
+	}
+	if target == "" {
+		target = report.Id
+	}
+	suites.Suites = append(suites.Suites, junitSuite(report, target, "", report.Checks))
+	for _, d := range report.Databases {
+		suites.Suites = append(suites.Suites, junitSuite(report, target+" "+d.Name, d.Name+"/", d.Checks))
+	}
+
+	for _, s := range suites.Suites {
+		suites.Tests += s.Tests
+		suites.Failures += s.Failures
+		suites.Skipped += s.Skipped
+	}
+
+	js, err := xml.MarshalIndent(suites, "", "  ")
+	if err != nil {
+		return "", err
+	}
+	return xml.Header + string(js), nil
+}
+
+func junitSuite(report *Report, name, timingPrefix string, checks []Check) junitTestSuite {
+	suite := junitTestSuite{Name: name, Tests: len(checks)}
+	if !report.CreatedAt.IsZero() {
+		suite.Timestamp = report.CreatedAt.UTC().Format("2006-01-02T15:04:05")
+	}
+
+	for _, check := range checks {
+		c := junitTestCase{
+			Name:      check.Name,
+			ClassName: "pgdiagnose." + name,
+			Time:      report.Timings[timingPrefix+check.Name] / 1000,
+		}
+		switch check.Status {
+		case "red":
+			suite.Failures++
+			c.Failure = &junitFailure{
+				Message: check.Name + " is red",
+				Type:    "red",
+				Text:    strings.Join(findingMessages(check), "\n"),
+			}
+		case "skipped":
+			suite.Skipped++
+			c.Skipped = &junitSkipped{Message: "could not do check"}
+		case "yellow":
+			c.SystemOut = check.Name + " is yellow\n" + strings.Join(findingMessages(check), "\n")
+		}
+		suite.Cases = append(suite.Cases, c)
+	}
+	return suite
+}
+
+// findingMessages describes each result row of a check on one line.
+func findingMessages(check Check) []string {
+	table := tableFromResults(check.Results)
+	if table == nil {
+		return nil
+	}
+	messages := make([]string, len(table.Rows))
+	for i, row := range table.Rows {
+		var fields []string
+		for j, value := range row {
+			if value != "" {
+				fields = append(fields, table.Columns[j]+"="+value)
+			}
+		}
+		messages[i] = strings.Join(fields, ", ")
+	}
+	return messages
+}
+
+// sarifLog follows the shape of SARIF 2.1.0, with a rule per check and a
+// result per result row of every red or yellow check.
+type sarifLog struct {
+	Schema  string     `json:"$schema"`
+	Version string     `json:"version"`
+	Runs    []sarifRun `json:"runs"`
+}
+
+type sarifRun struct {
+	Tool    sarifTool     `json:"tool"`
+	Results []sarifResult `json:"results"`
+}
+
+type sarifTool struct {
+	Driver sarifDriver `json:"driver"`
+}
+
+type sarifDriver struct {
+	Name  string      `json:"name"`
+	Rules []sarifRule `json:"rules"`
+}
+
+type sarifRule struct {
+	Id               string       `json:"id"`
+	Name             string       `json:"name"`
+	ShortDescription sarifMessage `json:"shortDescription"`
+}
+
+type sarifMessage struct {
+	Text string `json:"text"`
+}
+
+type sarifResult struct {
+	RuleId    string          `json:"ruleId"`
+	Level     string          `json:"level"`
+	Message   sarifMessage    `json:"message"`
+	Locations []sarifLocation `json:"locations"`
+}
+
+type sarifLocation struct {
+	LogicalLocations []sarifLogicalLocation `json:"logicalLocations"`
+}
+
+type sarifLogicalLocation struct {
+	Name               string `json:"name"`
+	FullyQualifiedName string `json:"fullyQualifiedName"`
+	Kind               string `json:"kind"`
+}
+
+var sarifLevels = map[string]string{
+	"red":    "error",
+	"yellow": "warning",
+}
+
+func exportSARIF(report *Report) sarifLog {
+	run := sarifRun{
+		Tool:    sarifTool{sarifDriver{Name: "pgdiagnose", Rules: []sarifRule{}}},
+		Results: []sarifResult{},
+	}
+
+	target := report.App
+	if report.Database != "" {
+		target += "/" + report.Database
+	}
+
+	rules := make(map[string]bool)
+	add := func(database string, checks []Check) {
+		location := sarifLocation{[]sarifLogicalLocation{{
+			Name:               database,
+			FullyQualifiedName: strings.Trim(target+"/"+database, "/"),
+			Kind:               "database",
+		}}}
+		if database == "" {
+			location.LogicalLocations[0].Name = target
+		}
+
+		for _, check := range checks {
+			id := ruleId(check.Name)
+			if !rules[id] {
+				rules[id] = true
+				run.Tool.Driver.Rules = append(run.Tool.Driver.Rules, sarifRule{id, check.Name, sarifMessage{check.Name}})
+			}
+
+			level, ok := sarifLevels[check.Status]
+			if !ok {
+				continue
+			}
+			messages := findingMessages(check)
+			if len(messages) == 0 {
+				messages = []string{check.Name + " is " + check.Status}
+			}
+			for _, message := range messages {
+				run.Results = append(run.Results, sarifResult{
+					RuleId:    id,
+					Level:     level,
+					Message:   sarifMessage{message},
+					Locations: []sarifLocation{location},
+				})
+			}
+		}
+	}
+	add("", report.Checks)
+	for _, d := range report.Databases {
+		add(d.Name, d.Checks)
+	}
+
+	return sarifLog{
+		Schema:  "https://json.schemastore.org/sarif-2.1.0.json",
+		Version: "2.1.0",
+		Runs:    []sarifRun{run},
+	}
+}
+
+// ruleId turns a check name like "Idle in Transaction" into
+// "idle-in-transaction".
+func ruleId(name string) string {
+	return strings.ToLower(strings.Join(strings.Fields(name), "-"))
+}
+
+// exportChecksCSV lists every check with its status and number of results.
+func exportChecksCSV(report *Report) (string, error) {
+	records := [][]string{{"database", "check", "status", "results"}}
+	add := func(database string, checks []Check) {
+		for _, check := range checks {
+			rows := 0
+			if table := tableFromResults(check.Results); table != nil && check.Status != "skipped" {
+				rows = len(table.Rows)
+			}
+			records = append(records, []string{database, check.Name, check.Status, fmt.Sprint(rows)})
+		}
+	}
+	add("", report.Checks)
+	for _, d := range report.Databases {
+		add(d.Name, d.Checks)
+	}
+	return writeCSV(records)
+}
+
+// exportCheckCSV lists the results of the check named name, from every
+// database for reports run on every database.
+func exportCheckCSV(report *Report, name string) (string, error) {
+	var tables []*resultTable
+	var databases []string
+	found := false
+	add := func(database string, checks []Check) {
+		for _, check := range checks {
+			if check.Name != name {
+				continue
+			}
+			found = true
+			if table := tableFromResults(check.Results); table != nil && check.Status != "skipped" {
+				tables = append(tables, table)
+				databases = append(databases, database)
+			}
+		}
+	}
+	add("", report.Checks)
+	for _, d := range report.Databases {
+		add(d.Name, d.Checks)
+	}
+	if !found {
+		return "", fmt.Errorf("no check named %q", name)
+	}
+
+	var columns []string
+	index := make(map[string]int)
+	for _, table := range tables {
+		for _, c := range table.Columns {
+			if _, ok := index[c]; !ok {
+				index[c] = len(columns)
+				columns = append(columns, c)
+			}
+		}
+	}
+
+	perDatabase := len(report.Databases) > 0
+	header := columns
+	if perDatabase {
+		header = append([]string{"database"}, columns...)
+	}
+	records := [][]string{header}
+	for i, table := range tables {
+		for _, row := range table.Rows {
+			record := make([]string, len(columns))
+			for j, value := range row {
+				record[index[table.Columns[j]]] = value
+			}
+			if perDatabase {
+				record = append([]string{databases[i]}, record...)
+			}
+			records = append(records, record)
+		}
+	}
+	return writeCSV(records)
+}
+
+func writeCSV(records [][]string) (string, error) {
+	var b bytes.Buffer
+	w := csv.NewWriter(&b)
+	err := w.WriteAll(records)
+	return b.String(), err
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"github.com/go-martini/martini"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func exportTestReport() *Report {
+	return &Report{
+		Id:            "id",
+		App:           "app",
+		SummaryStatus: "red",
+		Checks: []Check{
+			{"Long Queries", "red", []longQueriesResult{{1, "00:02:00", "select 1"}, {2, "00:03:00", "select 2"}}},
+			{"Hit Rate", "green", []hitRateResult{{"overall cache hit rate", 0.99}}},
+			{"Load", "skipped", map[string]string{"error": "could not do check"}},
+		},
+		Timings: checkTimings{"Long Queries": 1500},
+		Databases: []databaseReport{
+			{"orders", "yellow", []Check{{"Bloat", "yellow", []bloatResult{{"table", "orders", 12, "1 GB"}}}}},
+			{"users", "green", []Check{{"Bloat", "green", []bloatResult{}}}},
+		},
+	}
+}
+
+func TestExportJUnit(t *testing.T) {
+	out, err := exportJUnit(exportTestReport())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var suites junitTestSuites
+	if err := xml.Unmarshal([]byte(out), &suites); err != nil {
+		t.Fatalf("expected valid XML: %v", err)
+	}
+	if suites.Tests != 5 || suites.Failures != 1 || suites.Skipped != 1 || len(suites.Suites) != 3 {
+		t.Fatalf("unexpected totals %+v", suites)
+	}
+
+	failed := suites.Suites[0].Cases[0]
+	if failed.Failure == nil || !strings.Contains(failed.Failure.Text, "pid=2, duration=00:03:00, query=select 2") || failed.Time != 1.5 {
+		t.Errorf("expected a failure listing the results, got %+v", failed)
+	}
+	if suites.Suites[0].Cases[2].Skipped == nil {
+		t.Error("expected the skipped check to be skipped")
+	}
+	if warned := suites.Suites[1].Cases[0]; warned.Failure != nil || !strings.Contains(warned.SystemOut, "yellow") {
+		t.Errorf("expected yellow checks to pass with a note, got %+v", warned)
+	}
+}
+
+func TestExportSARIF(t *testing.T) {
+	log := exportSARIF(exportTestReport())
+	run := log.Runs[0]
+
+	if len(run.Tool.Driver.Rules) != 4 {
+		t.Errorf("expected a rule per check, got %+v", run.Tool.Driver.Rules)
+	}
+	if len(run.Results) != 3 {
+		t.Fatalf("expected a finding per result row, got %+v", run.Results)
+	}
+
+	var leveltests = []struct {
+		rule     string
+		level    string
+		location string
+	}{
+		{"long-queries", "error", "app"},
+		{"long-queries", "error", "app"},
+		{"bloat", "warning", "app/orders"},
+	}
+	for i, tt := range leveltests {
+		result := run.Results[i]
+		actual := []string{result.RuleId, result.Level, result.Locations[0].LogicalLocations[0].FullyQualifiedName}
+		expected := []string{tt.rule, tt.level, tt.location}
+		if strings.Join(actual, " ") != strings.Join(expected, " ") {
+			t.Errorf("%d. Expected %v, but was %v", i, expected, actual)
+		}
+	}
+}
+
+func TestExportCSV(t *testing.T) {
+	report := exportTestReport()
+
+	var csvtests = []struct {
+		check    string
+		expected string
+	}{
+		{"", "database,check,status,results\n,Long Queries,red,2\n,Hit Rate,green,1\n,Load,skipped,0\norders,Bloat,yellow,1\nusers,Bloat,green,0\n"},
+		{"Long Queries", "database,pid,duration,query\n,1,00:02:00,select 1\n,2,00:03:00,select 2\n"},
+		{"Bloat", "database,type,object,bloat,waste\norders,table,orders,12,1 GB\n"},
+	}
+	for i, tt := range csvtests {
+		actual, err := exportReport(report, formatCSV, tt.check, "")
+		if err != nil {
+			t.Fatalf("%d. %v", i, err)
+		}
+		if actual != tt.expected {
+			t.Errorf("%d. Expected %q, but was %q", i, tt.expected, actual)
+		}
+	}
+
+	if _, err := exportReport(report, formatCSV, "Nope", ""); err == nil {
+		t.Error("expected an error for an unknown check")
+	}
+}
+
+func TestGetReportFormat(t *testing.T) {
+	store := newMemoryStore()
+	report := exportTestReport()
+	store.Save(report)
+
+	m := martini.New()
+	m.MapTo(store, (*ReportStore)(nil))
+	m.Map(Config{})
+	m.Map(anonymousToken)
+	r := martini.NewRouter()
+	r.Get("/reports/:id", getReport)
+	m.Action(r.Handle)
+
+	var formattests = []struct {
+		query       string
+		code        int
+		contentType string
+	}{
+		{"?format=junit", 200, "application/xml"},
+		{"?format=sarif", 200, "application/sarif+json"},
+		{"?format=csv&check=Bloat", 200, "text/csv; charset=utf-8"},
+		{"?format=csv&check=Nope", 400, ""},
+		{"?format=pdf", 400, ""},
+	}
+	for i, tt := range formattests {
+		req, _ := http.NewRequest("GET", "/reports/"+report.Id+tt.query, nil)
+		req.Header.Set("Accept", "text/html")
+		res := httptest.NewRecorder()
+		m.ServeHTTP(res, req)
+		if res.Code != tt.code || (tt.contentType != "" && res.Header().Get("Content-Type") != tt.contentType) {
+			t.Errorf("%d. Expected %d %s, but was %d %s", i, tt.code, tt.contentType, res.Code, res.Header().Get("Content-Type"))
+		}
+		if tt.code == 400 {
+			var body map[string]string
+			if err := json.Unmarshal(res.Body.Bytes(), &body); err != nil || body["error"] == "" {
+				t.Errorf("%d. Expected a JSON error, but was %s (%v)", i, res.Body.String(), err)
+			}
+		}
+	}
+
+	// Input isn't echoed back, where it could break out of the JSON.
+	req, _ := http.NewRequest("GET", "/reports/"+report.Id+`?format=%22%7D%3Cscript%3E`, nil)
+	res := httptest.NewRecorder()
+	m.ServeHTTP(res, req)
+	if res.Code != 400 || strings.Contains(res.Body.String(), "script") {
+		t.Fatalf("expected a 400 without the format in it, got %d %s", res.Code, res.Body.String())
+	}
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+// databaseReport holds the per database checks for one database of a
+// server diagnosed with all_databases.
+type databaseReport struct {
+	Name   string  `json:"name"`
+	Status string  `json:"status"`
+	Checks []Check `json:"checks"`
+}
+
+// maxFanOutDatabases keeps servers with thousands of databases from turning
+// one diagnosis into thousands of connections.
+const maxFanOutDatabases = 100
+
+// CheckAllDatabases runs the server wide checks once, against the database
+// in connstring, and the per database checks against every database on the
+// server the user may connect to, one at a time.
+func CheckAllDatabases(connstring string, plan Plan, filter activityFilter) ([]Check, []databaseReport, checkTimings, error) {
+	db, err := connectDB(connstring)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	filter, err = filterForServer(db, filter)
+	if err != nil {
+		db.Close()
+		return nil, nil, nil, err
+	}
+
+	timings := make(checkTimings)
+	checks := runSqlChecks(db, plan, filter, timings, "", func(c sqlCheck) bool { return !c.perDatabase })
+
+	var rows []databaseRow
+	err = db.Select(&rows, databasesSQL, maxFanOutDatabases)
+	db.Close()
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	if len(rows) > 0 && rows[0].Total > len(rows) {
+		checks = append(checks, truncatedCheck(len(rows), rows[0].Total))
+	}
+
+	databases := make([]databaseReport, len(rows))
+	for i, row := range rows {
+		databases[i] = checkDatabase(withDatabase(connstring, row.Name), row.Name, plan, filter, timings)
+	}
+	return checks, databases, timings, nil
+}
+
+type databaseRow struct {
+	Name  string `db:"datname"`
+	Total int    `db:"total"`
+}
+
+// truncatedCheck says that only some of the databases were diagnosed, so a
+// report of a server with too many doesn't look complete.
+func truncatedCheck(diagnosed, total int) Check {
+	reason := make(map[string]string)
+	reason["error"] = fmt.Sprintf("only the first %d of %d databases were diagnosed", diagnosed, total)
+	return Check{"All Databases", "skipped", reason}
+}
+
+func checkDatabase(connstring, name string, plan Plan, filter activityFilter, timings checkTimings) databaseReport {
+	db, err := connectDB(connstring)
+	if err != nil {
+		return databaseReport{name, "skipped", []Check{makeErrorCheck("Connection", err)}}
+	}
+	defer db.Close()
+
+	checks := runSqlChecks(db, plan, filter, timings, name+"/", func(c sqlCheck) bool { return c.perDatabase })
+	return databaseReport{name, summaryStatus(checks), checks}
+}
+
+// allChecks returns the server wide checks along with every database's.
+func allChecks(checks []Check, databases []databaseReport) []Check {
+	all := append([]Check{}, checks...)
+	for _, d := range databases {
+		all = append(all, d.Checks...)
+	}
+	return all
+}
+
+// withDatabase points a postgres:// url or key=value connection string at
+// another database on the same server.
+func withDatabase(connstring, name string) string {
+	if strings.HasPrefix(connstring, "postgres://") || strings.HasPrefix(connstring, "postgresql://") {
+		u, err := url.Parse(connstring)
+		if err != nil {
+			return connstring
+		}
+		u.Path = "/" + name
+		u.RawPath = ""
+		return u.String()
+	}
+	escaped := strings.NewReplacer(`\`, `\\`, `'`, `\'`).Replace(name)
+	return fmt.Sprintf("%s dbname='%s'", connstring, escaped)
+}
+
+const databasesSQL = `
+SELECT datname, count(*) OVER () AS total
+FROM pg_database
+WHERE datallowconn AND NOT datistemplate
+  AND has_database_privilege(datname, 'CONNECT')
+ORDER BY datname
+LIMIT $1
+;`
+
+// forDatabase returns the report as it would look for one of its databases,
+// for comparing the next report's checks against.
+func (r *Report) forDatabase(name string) *Report {
+	if r == nil {
+		return nil
+	}
+	for _, d := range r.Databases {
+		if d.Name == name {
+			return &Report{Id: r.Id, CreatedAt: r.CreatedAt, Checks: d.Checks}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+var withDatabaseTests = []struct {
+	connstring string
+	name       string
+	expected   string
+}{
+	{"postgres://u:p@host:5432/first?sslmode=disable", "second", "postgres://u:p@host:5432/second?sslmode=disable"},
+	{"postgres://u@host/first", "with space", "postgres://u@host/with%20space"},
+	{"dbname=first host=h", "second", "dbname=first host=h dbname='second'"},
+	{"dbname=first", `it's\`, `dbname=first dbname='it\'s\\'`},
+}
+
+func TestWithDatabase(t *testing.T) {
+	for i, test := range withDatabaseTests {
+		actual := withDatabase(test.connstring, test.name)
+		if actual != test.expected {
+			t.Errorf("%d. Expected %v, but was %v", i, test.expected, actual)
+		}
+	}
+}
+
+func TestAllChecks(t *testing.T) {
+	checks := make([]Check, 1, 10)
+	checks[0] = Check{"Connections", "green", nil}
+	databases := []databaseReport{
+		{"a", "red", []Check{{"Bloat", "red", nil}}},
+		{"b", "green", []Check{{"Bloat", "green", nil}}},
+	}
+
+	all := allChecks(checks, databases)
+	if len(all) != 3 || summaryStatus(all) != "red" {
+		t.Fatalf("expected the server wide and every database's checks, got %v", all)
+	}
+	if checks[:2][1].Name != "" {
+		t.Fatal("expected allChecks to leave the server wide checks alone")
+	}
+}
+
+func TestTruncatedCheck(t *testing.T) {
+	check := truncatedCheck(100, 250)
+	typed, err := typeCheck(check)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if typed.Status != "skipped" || typed.Error != "only the first 100 of 250 databases were diagnosed" {
+		t.Fatalf("expected a skipped check saying how many databases were left out, got %+v", typed)
+	}
+	if summaryStatus([]Check{check}) != "green" {
+		t.Fatal("expected leaving databases out not to change the summary status")
+	}
+}
+
+func TestSqlChecksRunOncePerServer(t *testing.T) {
+	var perDatabase, serverWide int
+	for _, c := range sqlChecks {
+		if c.perDatabase {
+			perDatabase++
+		} else {
+			serverWide++
+		}
+	}
+	if perDatabase == 0 || serverWide == 0 {
+		t.Fatalf("expected both per database and server wide checks, got %d and %d", perDatabase, serverWide)
+	}
+}
+
+func TestReportForDatabase(t *testing.T) {
+	created := time.Now()
+	report := &Report{Id: "id", CreatedAt: created, Databases: []databaseReport{
+		{"a", "green", []Check{{xactCheckTitle, "green", nil}}},
+	}}
+
+	a := report.forDatabase("a")
+	if a == nil || a.Id != "id" || !a.CreatedAt.Equal(created) || len(a.Checks) != 1 {
+		t.Fatalf("expected database a's checks, got %+v", a)
+	}
+	if report.forDatabase("b") != nil {
+		t.Fatal("expected no report for a database that wasn't checked")
+	}
+	if (*Report)(nil).forDatabase("a") != nil {
+		t.Fatal("expected no report without a previous report")
+	}
+}
+
+func TestCompactReportDatabases(t *testing.T) {
+	report := &Report{Databases: []databaseReport{
+		{"a", "red", []Check{{"Bloat", "red", []string{"results"}}}},
+	}}
+	compactReport(report)
+	if report.Databases[0].Checks[0].Results != nil || report.Databases[0].Checks[0].Status != "red" {
+		t.Fatalf("expected per database results to be dropped, got %+v", report.Databases[0].Checks[0])
+	}
+}
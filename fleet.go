@@ -0,0 +1,237 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"gopkg.in/yaml.v2"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+)
+
+// fleetTarget is one database in a fleet inventory. It takes the same
+// fields as a report request, and url_env names an environment variable
+// holding the url so inventories can be checked in without credentials.
+type fleetTarget struct {
+	JobParams
+	URLEnv string `json:"url_env"`
+}
+
+type fleetResult struct {
+	App           string   `json:"app"`
+	Database      string   `json:"database"`
+	ReportId      string   `json:"report_id,omitempty"`
+	SummaryStatus string   `json:"summary_status"`
+	RedChecks     []string `json:"red_checks"`
+	YellowChecks  []string `json:"yellow_checks"`
+	Error         string   `json:"error,omitempty"`
+}
+
+type checkCount struct {
+	Name  string `json:"name"`
+	Count int    `json:"count"`
+}
+
+// fleetSummary ranks the fleet's databases from most to least severe, and
+// counts how many databases each check was red on.
+type fleetSummary struct {
+	Targets   int            `json:"targets"`
+	Statuses  map[string]int `json:"statuses"`
+	Databases []fleetResult  `json:"databases"`
+	RedChecks []checkCount   `json:"red_checks"`
+}
+
+// fleetFailed is the status of targets that couldn't be diagnosed at all,
+// which rank above red ones since nothing is known about them.
+const fleetFailed = "failed"
+
+// loadInventory reads a JSON inventory, or a YAML one for .yml and .yaml
+// files, which takes the same fields.
+func loadInventory(path string) ([]fleetTarget, error) {
+	js, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	switch filepath.Ext(path) {
+	case ".yml", ".yaml":
+		js, err = yamlToJSON(js)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", path, err)
+		}
+	}
+	var targets []fleetTarget
+	err = json.Unmarshal(js, &targets)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+
+	for i := range targets {
+		err = targets[i].resolveURL()
+		if err != nil {
+			return nil, fmt.Errorf("%s: target %d: %v", path, i+1, err)
+		}
+	}
+	return targets, nil
+}
+
+// yamlToJSON converts a YAML document to JSON, so it decodes with the same
+// field names as JSON does.
+func yamlToJSON(y []byte) ([]byte, error) {
+	var v interface{}
+	err := yaml.Unmarshal(y, &v)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(jsonValue(v))
+}
+
+// jsonValue replaces the maps with non-string keys YAML decodes to with
+// ones encoding/json can marshal.
+func jsonValue(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[interface{}]interface{}:
+		m := make(map[string]interface{}, len(v))
+		for key, value := range v {
+			m[fmt.Sprint(key)] = jsonValue(value)
+		}
+		return m
+	case []interface{}:
+		for i := range v {
+			v[i] = jsonValue(v[i])
+		}
+	}
+	return v
+}
+
+func (t *fleetTarget) resolveURL() error {
+	switch {
+	case t.URL != "" && t.URLEnv != "":
+		return errors.New("set either url or url_env, not both")
+	case t.URLEnv != "":
+		t.URL = os.Getenv(t.URLEnv)
+		if t.URL == "" {
+			return fmt.Errorf("%s is not set", t.URLEnv)
+		}
+	case t.URL == "":
+		return errors.New("url or url_env is required")
+	}
+	return nil
+}
+
+// runFleet diagnoses every target, at most parallel at a time, and
+// summarizes the results.
+func runFleet(targets []fleetTarget, parallel int, diagnose func(JobParams) (*Report, error)) fleetSummary {
+	if parallel < 1 {
+		parallel = 1
+	}
+
+	results := make([]fleetResult, len(targets))
+	slots := make(chan struct{}, parallel)
+	var wg sync.WaitGroup
+	for i, target := range targets {
+		wg.Add(1)
+		slots <- struct{}{}
+		go func(i int, params JobParams) {
+			defer func() {
+				<-slots
+				wg.Done()
+			}()
+			report, err := diagnose(params)
+			results[i] = newFleetResult(params, report, err)
+		}(i, target.JobParams)
+	}
+	wg.Wait()
+
+	return summarizeFleet(results)
+}
+
+func newFleetResult(params JobParams, report *Report, err error) fleetResult {
+	result := fleetResult{App: params.App, Database: params.Database}
+	if err != nil {
+		result.SummaryStatus = fleetFailed
+		result.Error = err.Error()
+		return result
+	}
+
+	result.ReportId = report.Id
+	result.SummaryStatus = report.SummaryStatus
+	result.RedChecks = checkNamesWithStatus(report, "red")
+	result.YellowChecks = checkNamesWithStatus(report, "yellow")
+	return result
+}
+
+// checkNamesWithStatus lists each check with status once, even when it has
+// that status on several of the report's databases.
+func checkNamesWithStatus(report *Report, status string) []string {
+	names := []string{}
+	seen := make(map[string]bool)
+	for _, check := range allChecks(report.Checks, report.Databases) {
+		if check.Status == status && !seen[check.Name] {
+			seen[check.Name] = true
+			names = append(names, check.Name)
+		}
+	}
+	return names
+}
+
+func summarizeFleet(results []fleetResult) fleetSummary {
+	summary := fleetSummary{
+		Targets:   len(results),
+		Statuses:  make(map[string]int),
+		Databases: results,
+		RedChecks: []checkCount{},
+	}
+
+	red := make(map[string]int)
+	for _, r := range results {
+		summary.Statuses[r.SummaryStatus]++
+		for _, name := range r.RedChecks {
+			red[name]++
+		}
+	}
+	for name, count := range red {
+		summary.RedChecks = append(summary.RedChecks, checkCount{name, count})
+	}
+
+	sort.Sort(bySeverity(summary.Databases))
+	sort.Sort(byCheckCount(summary.RedChecks))
+	return summary
+}
+
+var severities = map[string]int{
+	fleetFailed: 4,
+	"red":       3,
+	"yellow":    2,
+	"green":     1,
+}
+
+type bySeverity []fleetResult
+
+func (s bySeverity) Len() int      { return len(s) }
+func (s bySeverity) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
+func (s bySeverity) Less(i, j int) bool {
+	if severities[s[i].SummaryStatus] != severities[s[j].SummaryStatus] {
+		return severities[s[i].SummaryStatus] > severities[s[j].SummaryStatus]
+	}
+	if len(s[i].RedChecks) != len(s[j].RedChecks) {
+		return len(s[i].RedChecks) > len(s[j].RedChecks)
+	}
+	if len(s[i].YellowChecks) != len(s[j].YellowChecks) {
+		return len(s[i].YellowChecks) > len(s[j].YellowChecks)
+	}
+	return s[i].App+"/"+s[i].Database < s[j].App+"/"+s[j].Database
+}
+
+type byCheckCount []checkCount
+
+func (s byCheckCount) Len() int      { return len(s) }
+func (s byCheckCount) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
+func (s byCheckCount) Less(i, j int) bool {
+	if s[i].Count != s[j].Count {
+		return s[i].Count > s[j].Count
+	}
+	return s[i].Name < s[j].Name
+}
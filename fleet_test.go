@@ -0,0 +1,204 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"testing"
+)
+
+func TestLoadInventory(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pgdiagnose-fleet")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	os.Setenv("PGDIAGNOSE_TEST_URL", "postgres://u@from-env/db")
+	defer os.Unsetenv("PGDIAGNOSE_TEST_URL")
+
+	path := filepath.Join(dir, "inventory.json")
+	ioutil.WriteFile(path, []byte(`[
+		{"app": "a", "database": "main", "plan": "standard-0", "url": "postgres://u@a/db"},
+		{"app": "b", "database": "main", "url_env": "PGDIAGNOSE_TEST_URL", "all_databases": true}
+	]`), 0600)
+
+	targets, err := loadInventory(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(targets) != 2 || targets[0].Plan != "standard-0" || targets[1].URL != "postgres://u@from-env/db" || !targets[1].AllDatabases {
+		t.Fatalf("unexpected targets %+v", targets)
+	}
+
+	ioutil.WriteFile(path, []byte(`[{"app": "a", "url_env": "PGDIAGNOSE_TEST_UNSET"}]`), 0600)
+	if _, err = loadInventory(path); err == nil {
+		t.Fatal("expected a target whose url_env isn't set to be rejected")
+	}
+
+}
+
+func TestLoadYAMLInventory(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pgdiagnose-fleet")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	os.Setenv("PGDIAGNOSE_TEST_URL", "postgres://u@from-env/db")
+	defer os.Unsetenv("PGDIAGNOSE_TEST_URL")
+
+	path := filepath.Join(dir, "inventory.yml")
+	ioutil.WriteFile(path, []byte(`
+- app: a
+  database: main
+  plan: standard-0
+  url: postgres://u@a/db
+  tls:
+    sslmode: verify-full
+- app: b
+  database: main
+  url_env: PGDIAGNOSE_TEST_URL
+  all_databases: true
+`), 0600)
+
+	targets, err := loadInventory(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []fleetTarget{
+		{JobParams: JobParams{App: "a", Database: "main", Plan: "standard-0", URL: "postgres://u@a/db", TLS: TLSOptions{Mode: "verify-full"}}},
+		{JobParams: JobParams{App: "b", Database: "main", URL: "postgres://u@from-env/db", AllDatabases: true}, URLEnv: "PGDIAGNOSE_TEST_URL"},
+	}
+	if !reflect.DeepEqual(targets, expected) {
+		t.Fatalf("Expected %+v, but was %+v", expected, targets)
+	}
+
+	ioutil.WriteFile(path, []byte("- app: [a\n"), 0600)
+	if _, err = loadInventory(path); err == nil {
+		t.Fatal("expected a malformed YAML inventory to be rejected")
+	}
+}
+
+func TestRunFleet(t *testing.T) {
+	targets := []fleetTarget{
+		{JobParams: JobParams{App: "green", URL: "green"}},
+		{JobParams: JobParams{App: "broken", URL: "broken"}},
+		{JobParams: JobParams{App: "red1", URL: "red1"}},
+		{JobParams: JobParams{App: "red2", URL: "red2"}},
+		{JobParams: JobParams{App: "yellow", URL: "yellow"}},
+	}
+	reports := map[string]*Report{
+		"green":  {Id: "1", SummaryStatus: "green", Checks: []Check{{"Bloat", "green", nil}}},
+		"red1":   {Id: "2", SummaryStatus: "red", Checks: []Check{{"Bloat", "red", nil}}},
+		"red2":   {Id: "3", SummaryStatus: "red", Checks: []Check{{"Bloat", "red", nil}, {"Connections", "red", nil}}},
+		"yellow": {Id: "4", SummaryStatus: "yellow", Checks: []Check{{"Bloat", "yellow", nil}}},
+	}
+
+	var mu sync.Mutex
+	running, most := 0, 0
+	summary := runFleet(targets, 2, func(params JobParams) (*Report, error) {
+		mu.Lock()
+		running++
+		if running > most {
+			most = running
+		}
+		mu.Unlock()
+		defer func() {
+			mu.Lock()
+			running--
+			mu.Unlock()
+		}()
+
+		if report, ok := reports[params.URL]; ok {
+			return report, nil
+		}
+		return nil, errors.New("connection refused")
+	})
+
+	if most > 2 {
+		t.Fatalf("expected at most 2 diagnoses at once, got %d", most)
+	}
+
+	var order []string
+	for _, d := range summary.Databases {
+		order = append(order, d.App)
+	}
+	expected := []string{"broken", "red2", "red1", "yellow", "green"}
+	if !reflect.DeepEqual(order, expected) {
+		t.Fatalf("Expected %v, but was %v", expected, order)
+	}
+
+	if summary.Databases[0].Error == "" || summary.Statuses[fleetFailed] != 1 || summary.Statuses["red"] != 2 {
+		t.Fatalf("unexpected summary %+v", summary)
+	}
+
+	expectedChecks := []checkCount{{"Bloat", 2}, {"Connections", 1}}
+	if !reflect.DeepEqual(summary.RedChecks, expectedChecks) {
+		t.Fatalf("Expected %v, but was %v", expectedChecks, summary.RedChecks)
+	}
+}
+
+func TestCheckNamesWithStatusCountsEachCheckOnce(t *testing.T) {
+	report := &Report{
+		Checks: []Check{{"Connections", "red", nil}},
+		Databases: []databaseReport{
+			{"a", "red", []Check{{"Bloat", "red", nil}}},
+			{"b", "red", []Check{{"Bloat", "red", nil}}},
+		},
+	}
+	names := checkNamesWithStatus(report, "red")
+	if !reflect.DeepEqual(names, []string{"Connections", "Bloat"}) {
+		t.Fatalf("unexpected red checks %v", names)
+	}
+}
+
+func TestFleetCommandPrintsOnlyJSON(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pgdiagnose-fleet")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "inventory.json")
+	addr := fakeQueryPostgres(t, map[string][]string{"server_version_num": {"160002"}})
+	url := "postgres://u@" + addr + "/db?sslmode=disable"
+	ioutil.WriteFile(path, []byte(`[{"app": "a", "database": "main", "url": "`+url+`"}]`), 0600)
+
+	var code int
+	out := captureStdout(t, func() { code = fleetCommand([]string{"-store", "memory", path}) })
+	if code != 0 {
+		t.Fatalf("expected fleet to succeed, got %d", code)
+	}
+
+	var summary fleetSummary
+	if err := json.Unmarshal(out, &summary); err != nil {
+		t.Fatalf("expected only the summary on stdout, got %q (%v)", out, err)
+	}
+	if len(summary.Databases) != 1 || summary.Databases[0].ReportId == "" {
+		t.Fatalf("expected the diagnosis to finish, got %+v", summary)
+	}
+}
+
+// captureStdout returns what f prints to stdout.
+func captureStdout(t *testing.T, f func()) []byte {
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func(stdout *os.File) { os.Stdout = stdout }(os.Stdout)
+	os.Stdout = w
+
+	out := make(chan []byte)
+	go func() {
+		b, _ := ioutil.ReadAll(r)
+		out <- b
+	}()
+	f()
+	w.Close()
+	return <-out
+}
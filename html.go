@@ -0,0 +1,191 @@
+package main
+
+import (
+	"bytes"
+	_ "embed"
+	"encoding/json"
+	"html/template"
+	"net/http"
+	"strings"
+)
+
+//go:embed report.html
+var reportHTML string
+
+var reportTemplate = template.Must(template.New("report").Parse(reportHTML))
+
+type htmlReport struct {
+	Title  string
+	Report *Report
+	Counts []statusCount
+	Groups []htmlGroup
+}
+
+type statusCount struct {
+	Status string
+	Count  int
+}
+
+// htmlGroup is the server wide checks, or one database's checks in reports
+// run on every database.
+type htmlGroup struct {
+	Name     string
+	Status   string
+	Sections []htmlSection
+}
+
+type htmlSection struct {
+	Name   string
+	Status string
+	// red checks start out expanded
+	Open  bool
+	Table *resultTable
+}
+
+type resultTable struct {
+	Columns []string
+	Rows    [][]string
+}
+
+// wantsHTML says whether a request prefers HTML to JSON, going by which of
+// the two comes first in its Accept header.
+func wantsHTML(req *http.Request) bool {
+	for _, mediaRange := range strings.Split(req.Header.Get("Accept"), ",") {
+		parts := strings.Split(mediaRange, ";")
+		if len(parts) > 1 && strings.Replace(strings.TrimSpace(parts[1]), " ", "", -1) == "q=0" {
+			continue
+		}
+		switch strings.TrimSpace(parts[0]) {
+		case "text/html":
+			return true
+		case "application/json":
+			return false
+		}
+	}
+	return false
+}
+
+func renderHTML(report *Report) (string, error) {
+	view := htmlReport{Title: chatTitle(report), Report: report}
+
+	counts := make(map[string]int)
+	for _, check := range allChecks(report.Checks, report.Databases) {
+		counts[check.Status]++
+	}
+	for _, status := range []string{"red", "yellow", "green", "skipped"} {
+		if counts[status] > 0 {
+			view.Counts = append(view.Counts, statusCount{status, counts[status]})
+		}
+	}
+
+	view.Groups = append(view.Groups, htmlGroup{Sections: htmlSections(report.Checks)})
+	for _, d := range report.Databases {
+		view.Groups = append(view.Groups, htmlGroup{d.Name, d.Status, htmlSections(d.Checks)})
+	}
+
+	var b bytes.Buffer
+	err := reportTemplate.Execute(&b, view)
+	return b.String(), err
+}
+
+func htmlSections(checks []Check) []htmlSection {
+	sections := make([]htmlSection, len(checks))
+	for i, check := range checks {
+		sections[i] = htmlSection{
+			Name:   check.Name,
+			Status: check.Status,
+			Open:   check.Status == "red",
+			Table:  tableFromResults(check.Results),
+		}
+	}
+	return sections
+}
+
+// tableFromResults lays out a check's results as a table: a row per item
+// for lists, keys and values for anything else. Columns keep the order of
+// the result's fields.
+func tableFromResults(results interface{}) *resultTable {
+	js, err := json.Marshal(results)
+	if err != nil {
+		return nil
+	}
+
+	var items []json.RawMessage
+	if json.Unmarshal(js, &items) == nil {
+		if len(items) == 0 {
+			return nil
+		}
+		table := &resultTable{}
+		index := make(map[string]int)
+		var rows []map[string]string
+		for _, item := range items {
+			keys, values, ok := orderedObject(item)
+			if !ok {
+				keys, values = []string{"value"}, map[string]string{"value": cellText(item)}
+			}
+			for _, k := range keys {
+				if _, seen := index[k]; !seen {
+					index[k] = len(table.Columns)
+					table.Columns = append(table.Columns, k)
+				}
+			}
+			rows = append(rows, values)
+		}
+		for _, values := range rows {
+			row := make([]string, len(table.Columns))
+			for k, v := range values {
+				row[index[k]] = v
+			}
+			table.Rows = append(table.Rows, row)
+		}
+		return table
+	}
+
+	keys, values, ok := orderedObject(js)
+	if !ok || len(keys) == 0 {
+		return nil
+	}
+	table := &resultTable{Columns: []string{"name", "value"}}
+	for _, k := range keys {
+		table.Rows = append(table.Rows, []string{k, values[k]})
+	}
+	return table
+}
+
+// orderedObject returns the keys of a JSON object in order, and each value
+// as cell text.
+func orderedObject(js []byte) ([]string, map[string]string, bool) {
+	dec := json.NewDecoder(bytes.NewReader(js))
+	tok, err := dec.Token()
+	if err != nil || tok != json.Delim('{') {
+		return nil, nil, false
+	}
+
+	var keys []string
+	values := make(map[string]string)
+	for dec.More() {
+		tok, err = dec.Token()
+		if err != nil {
+			return nil, nil, false
+		}
+		key, _ := tok.(string)
+		var value json.RawMessage
+		if err = dec.Decode(&value); err != nil {
+			return nil, nil, false
+		}
+		keys = append(keys, key)
+		values[key] = cellText(value)
+	}
+	return keys, values, true
+}
+
+func cellText(value json.RawMessage) string {
+	var s string
+	if json.Unmarshal(value, &s) == nil {
+		return s
+	}
+	if string(value) == "null" {
+		return ""
+	}
+	return string(value)
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"github.com/go-martini/martini"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+var accepttests = []struct {
+	accept   string
+	expected bool
+}{
+	{"", false},
+	{"*/*", false},
+	{"application/json", false},
+	{"text/html,application/xhtml+xml,application/xml;q=0.9,*/*;q=0.8", true},
+	{"application/json, text/html", false},
+	{"text/html;q=0, application/json", false},
+}
+
+func TestWantsHTML(t *testing.T) {
+	for i, tt := range accepttests {
+		req, _ := http.NewRequest("GET", "/reports/1", nil)
+		req.Header.Set("Accept", tt.accept)
+		if actual := wantsHTML(req); actual != tt.expected {
+			t.Errorf("%d. Expected %v, but was %v", i, tt.expected, actual)
+		}
+	}
+}
+
+func TestTableFromResults(t *testing.T) {
+	table := tableFromResults([]longQueriesResult{{1, "00:02:00", "select 1"}, {2, "00:03:00", "select 2"}})
+	if !reflect.DeepEqual(table.Columns, []string{"pid", "duration", "query"}) {
+		t.Fatalf("expected columns in field order, got %v", table.Columns)
+	}
+	if !reflect.DeepEqual(table.Rows[1], []string{"2", "00:03:00", "select 2"}) {
+		t.Fatalf("unexpected row %v", table.Rows[1])
+	}
+
+	table = tableFromResults(map[string]string{"error": "could not do check"})
+	if !reflect.DeepEqual(table.Rows, [][]string{{"error", "could not do check"}}) {
+		t.Fatalf("expected a key and value table, got %+v", table)
+	}
+
+	if tableFromResults(nil) != nil || tableFromResults([]bloatResult{}) != nil {
+		t.Fatal("expected no table without results")
+	}
+}
+
+func TestRenderHTML(t *testing.T) {
+	report := &Report{
+		Id:            "id",
+		App:           "app",
+		SummaryStatus: "red",
+		Checks: []Check{
+			{"Long Queries", "red", []longQueriesResult{{1, "00:02:00", "select '<script>'"}}},
+			{"Hit Rate", "green", []hitRateResult{{"overall cache hit rate", 0.99}}},
+		},
+	}
+
+	page, err := renderHTML(report)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, expected := range []string{
+		`<details class="red" open>`,
+		`<details class="green">`,
+		`<th>pid</th><th>duration</th><th>query</th>`,
+		`select &#39;&lt;script&gt;&#39;`,
+	} {
+		if !strings.Contains(page, expected) {
+			t.Errorf("expected %q in the page", expected)
+		}
+	}
+	if strings.Contains(page, "<script>'") {
+		t.Error("expected query text to be escaped")
+	}
+}
+
+func TestGetReportNegotiates(t *testing.T) {
+	store := newMemoryStore()
+	report := &Report{App: "app", SummaryStatus: "green", Checks: []Check{{"Hit Rate", "green", nil}}}
+	store.Save(report)
+
+	m := martini.New()
+	m.MapTo(store, (*ReportStore)(nil))
+	m.Map(Config{})
+	m.Map(anonymousToken)
+	r := martini.NewRouter()
+	r.Get("/reports/:id", getReport)
+	m.Action(r.Handle)
+
+	req, _ := http.NewRequest("GET", "/reports/"+report.Id, nil)
+	req.Header.Set("Accept", "text/html")
+	res := httptest.NewRecorder()
+	m.ServeHTTP(res, req)
+	if res.Code != 200 || !strings.HasPrefix(res.Header().Get("Content-Type"), "text/html") || !strings.Contains(res.Body.String(), "<!DOCTYPE html>") {
+		t.Fatalf("expected an HTML page, got %d %s", res.Code, res.Header().Get("Content-Type"))
+	}
+	if res.Header().Get("Vary") != "Accept" {
+		t.Fatalf("expected the page to vary on Accept, got %q", res.Header().Get("Vary"))
+	}
+
+	req, _ = http.NewRequest("GET", "/reports/"+report.Id, nil)
+	res = httptest.NewRecorder()
+	m.ServeHTTP(res, req)
+	if res.Code != 200 || !strings.Contains(res.Body.String(), `"summary_status": "green"`) {
+		t.Fatalf("expected JSON, got %d %s", res.Code, res.Body.String())
+	}
+	if res.Header().Get("Vary") != "Accept" {
+		t.Fatalf("expected JSON to vary on Accept, got %q", res.Header().Get("Vary"))
+	}
+}
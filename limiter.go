@@ -0,0 +1,136 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"sync"
+	"time"
+)
+
+// diagnosisLimiter keeps pgdiagnose from piling load onto a database that
+// is probably unhealthy already. It caps how many diagnoses run at once,
+// overall and per target, and hands out the in-flight or recent report to
+// repeated requests for the same target and options instead of starting
+// another one.
+type diagnosisLimiter struct {
+	mu         sync.Mutex
+	global     int
+	perTarget  int
+	window     time.Duration
+	retryAfter time.Duration
+
+	running  int
+	targets  map[string]int
+	inflight map[string]*diagnosisJob
+	recent   map[string]recentDiagnosis
+}
+
+type diagnosisJob struct {
+	done   chan struct{}
+	report *Report
+	err    error
+
+	// started is closed once the running report is saved as reportId.
+	started  chan struct{}
+	reportId string
+}
+
+// start records the id of the running report for everyone waiting on the
+// job. Only the leader calls it, at most once.
+func (j *diagnosisJob) start(reportId string) {
+	j.reportId = reportId
+	close(j.started)
+}
+
+type recentDiagnosis struct {
+	reportId string
+	finished time.Time
+}
+
+func newDiagnosisLimiter(global, perTarget int, window time.Duration) *diagnosisLimiter {
+	return &diagnosisLimiter{
+		global:     global,
+		perTarget:  perTarget,
+		window:     window,
+		retryAfter: 10 * time.Second,
+		targets:    make(map[string]int),
+		inflight:   make(map[string]*diagnosisJob),
+		recent:     make(map[string]recentDiagnosis),
+	}
+}
+
+// acquire decides what to do with a request for target with the given
+// options, as returned by diagnosisOptions. Exactly one of the
+// results is set: the id of a recent report to return, a job to wait on
+// (leader says whether the caller has to run and finish it), or how long the
+// caller should wait before retrying.
+func (l *diagnosisLimiter) acquire(target, options string, now time.Time) (recentId string, job *diagnosisJob, leader bool, retryAfter time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	key := target + "|" + options
+	if l.window > 0 {
+		if r, ok := l.recent[key]; ok {
+			if now.Sub(r.finished) < l.window {
+				return r.reportId, nil, false, 0
+			}
+			delete(l.recent, key)
+		}
+		if job, ok := l.inflight[key]; ok {
+			return "", job, false, 0
+		}
+	}
+
+	if (l.perTarget > 0 && l.targets[target] >= l.perTarget) || (l.global > 0 && l.running >= l.global) {
+		return "", nil, false, l.retryAfter
+	}
+
+	job = &diagnosisJob{done: make(chan struct{}), started: make(chan struct{})}
+	l.running++
+	l.targets[target]++
+	l.inflight[key] = job
+	return "", job, true, 0
+}
+
+// finish records the outcome of a job started by acquire and wakes up
+// everyone waiting on it.
+func (l *diagnosisLimiter) finish(target, options string, job *diagnosisJob, report *Report, err error, now time.Time) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	key := target + "|" + options
+	l.running--
+	l.targets[target]--
+	if l.targets[target] <= 0 {
+		delete(l.targets, target)
+	}
+	if l.inflight[key] == job {
+		delete(l.inflight, key)
+	}
+	if err == nil && report != nil && l.window > 0 {
+		l.recent[key] = recentDiagnosis{report.Id, now}
+	}
+
+	job.report, job.err = report, err
+	close(job.done)
+}
+
+// diagnosisTarget identifies the database a request is for. It includes the
+// app so requests scoped to different apps never share reports.
+func diagnosisTarget(params JobParams) string {
+	return params.App + "|" + removePassword(params.URL)
+}
+
+// diagnosisOptions sums up everything else about a request that changes the
+// report, so only requests that would get the same report share one. It is
+// a hash because the options carry keys and passwords.
+func diagnosisOptions(params JobParams) string {
+	js, _ := json.Marshal([]interface{}{
+		params.URL, params.Database, params.Plan, params.Metrics,
+		params.SampleWindow, params.SampleInterval, params.AllDatabases,
+		params.TLS, params.Tunnel,
+	})
+	sum := sha256.Sum256(js)
+	return hex.EncodeToString(sum[:])
+}
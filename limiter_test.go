@@ -0,0 +1,89 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestLimiterDeduplicates(t *testing.T) {
+	l := newDiagnosisLimiter(10, 1, time.Minute)
+	now := time.Now()
+
+	_, job, leader, _ := l.acquire("a", "", now)
+	if job == nil || !leader {
+		t.Fatal("expected the first request to lead")
+	}
+
+	_, joined, leader, _ := l.acquire("a", "", now)
+	if joined != job || leader {
+		t.Fatal("expected a second request to join the in-flight job")
+	}
+
+	l.finish("a", "", job, &Report{Id: "report-id"}, nil, now)
+	select {
+	case <-joined.done:
+	default:
+		t.Fatal("expected waiters to be woken up")
+	}
+
+	recentId, job, _, _ := l.acquire("a", "", now.Add(time.Second))
+	if recentId != "report-id" || job != nil {
+		t.Fatalf("expected the recent report, got %q", recentId)
+	}
+
+	_, job, leader, _ = l.acquire("a", "", now.Add(2*time.Minute))
+	if job == nil || !leader {
+		t.Fatal("expected a new job once the recent report is too old")
+	}
+}
+
+func TestLimiterDeduplicatesOnlySameOptions(t *testing.T) {
+	l := newDiagnosisLimiter(10, 2, time.Minute)
+	now := time.Now()
+
+	params := JobParams{URL: "postgres://u:secret@db/d", App: "sushi"}
+	other := params
+	other.SampleWindow = 10
+
+	target := diagnosisTarget(params)
+	if diagnosisTarget(other) != target {
+		t.Fatal("expected options not to change the target")
+	}
+	if diagnosisOptions(other) == diagnosisOptions(params) {
+		t.Fatal("expected a sample window to change the options")
+	}
+
+	_, job, _, _ := l.acquire(target, diagnosisOptions(params), now)
+	if _, joined, leader, _ := l.acquire(target, diagnosisOptions(other), now); joined == job || !leader {
+		t.Fatal("expected a request with other options to run its own job")
+	}
+	if _, _, _, retry := l.acquire(target, diagnosisOptions(JobParams{URL: params.URL, Plan: "ika"}), now); retry == 0 {
+		t.Fatal("expected the per target limit to count every option")
+	}
+}
+
+func TestLimiterCaps(t *testing.T) {
+	l := newDiagnosisLimiter(2, 1, 0)
+	now := time.Now()
+
+	_, a, _, _ := l.acquire("a", "", now)
+	if _, _, _, retry := l.acquire("a", "", now); retry == 0 {
+		t.Fatal("expected the per target limit to apply")
+	}
+
+	_, b, _, _ := l.acquire("b", "", now)
+	if _, _, _, retry := l.acquire("c", "", now); retry == 0 {
+		t.Fatal("expected the global limit to apply")
+	}
+
+	l.finish("a", "", a, nil, errors.New("failed"), now)
+	if _, job, _, _ := l.acquire("c", "", now); job == nil {
+		t.Fatal("expected a slot to free up after a job finishes")
+	}
+
+	if recentId, _, _, _ := l.acquire("b", "", now); recentId != "" {
+		t.Fatal("expected no deduplication without a window")
+	}
+	l.finish("b", "", b, &Report{Id: "b"}, nil, now)
+}
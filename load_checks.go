@@ -2,26 +2,191 @@ package main
 
 import "fmt"
 
-func CheckLoad(load *float64) []Check {
+// HostMetrics are numbers only the caller can see about the machine the
+// database runs on. Every field is optional, and a missing one only skips
+// the checks that need it. Sizes are in bytes.
+type HostMetrics struct {
+	LoadAvg1m   *float64 `json:"load_avg_1m"`
+	CPUCount    *int     `json:"cpu_count"`
+	MemoryUsed  *int64   `json:"memory_used"`
+	MemoryTotal *int64   `json:"memory_total"`
+	SwapUsed    *int64   `json:"swap_used"`
+	SwapTotal   *int64   `json:"swap_total"`
+	DiskUsed    *int64   `json:"disk_used"`
+	DiskTotal   *int64   `json:"disk_total"`
+	IOPS        *float64 `json:"iops"`
+
+	// Source records where the numbers came from, the caller or one of the
+	// ways of reading them from inside the database.
+	Source string `json:"-"`
+}
+
+// CheckMetrics judges the host metrics against the plan, which fills in
+// the core count, memory and disk size when the metrics leave them out. The
+// wait profile, when the Wait Events check ran, goes into the Load check's
+// results to say what the load is made of, and stands in for the load
+// when there are no load metrics.
+func CheckMetrics(metrics HostMetrics, plan Plan, waits *waitProfileResult) []Check {
+	if metrics.CPUCount == nil && plan.CPUs > 0 {
+		metrics.CPUCount = &plan.CPUs
+	}
+	if metrics.MemoryTotal == nil && plan.Memory > 0 {
+		metrics.MemoryTotal = &plan.Memory
+	}
+	if metrics.DiskTotal == nil && plan.Disk > 0 {
+		metrics.DiskTotal = &plan.Disk
+	}
 
-	var loadCheck Check
+	v := make([]Check, 4)
+	v[0] = loadCheck(metrics.LoadAvg1m, metrics.CPUCount, waits)
+	v[1] = memoryCheck(metrics)
+	v[2] = diskCheck(metrics)
+	v[3] = iopsCheck(metrics.IOPS, plan.IOPS)
 
+	for _, check := range v {
+		if reason, ok := check.Results.(map[string]string); ok && check.Status != "skipped" && metrics.Source != "" {
+			reason["source"] = metrics.Source
+		}
+	}
+	return v
+}
+
+func CheckLoad(load *float64) []Check {
+	v := make([]Check, 1)
+	v[0] = loadCheck(load, nil, nil)
+	// a plain green load has no results here, as it always had
+	if v[0].Status == "green" {
+		v[0].Results = nil
+	}
+	return v
+}
+
+func loadCheck(load *float64, cpus *int, waits *waitProfileResult) Check {
 	reason := make(map[string]string)
+	if load == nil && waits != nil {
+		// without load metrics, count what the load average would: the
+		// sessions on cpu or waiting on io
+		estimate := float64(waits.CPU + waits.IO)
+		load = &estimate
+		reason["load_from"] = "wait_events"
+	}
 	if load == nil {
 		reason["error"] = "Load check not supported on this plan"
-		loadCheck = Check{"Load", "skipped", reason}
-	} else if *load > 2 {
-		reason["load"] = fmt.Sprintf("%v", *load)
-		loadCheck = Check{"Load", "red", reason}
-	} else if *load > 1 {
-		reason["load"] = fmt.Sprintf("%v", *load)
-		loadCheck = Check{"Load", "yellow", reason}
-	} else {
-		loadCheck = Check{"Load", "green", nil}
+		return Check{"Load", "skipped", reason}
 	}
 
-	v := make([]Check, 1)
-	v[0] = loadCheck
+	if waits != nil && waits.Active >= minActiveForBound {
+		reason["bound"] = waits.Bound
+		reason["active_sessions"] = fmt.Sprintf("%v", waits.Active)
+		reason["cpu_sessions"] = fmt.Sprintf("%v", waits.CPU)
+		reason["io_sessions"] = fmt.Sprintf("%v", waits.IO)
+		reason["lock_sessions"] = fmt.Sprintf("%v", waits.Lock)
+	}
 
-	return v
+	// without a core count fall back to treating the box as single core
+	perCore := *load
+	reason["load"] = fmt.Sprintf("%v", *load)
+	if cpus != nil && *cpus > 0 {
+		perCore = *load / float64(*cpus)
+		reason["cpu_count"] = fmt.Sprintf("%v", *cpus)
+		reason["load_per_core"] = fmt.Sprintf("%.2f", perCore)
+	}
+
+	if perCore > 2 {
+		return Check{"Load", "red", reason}
+	} else if perCore > 1 {
+		return Check{"Load", "yellow", reason}
+	}
+	return Check{"Load", "green", reason}
+}
+
+func memoryCheck(metrics HostMetrics) Check {
+	checkTitle := "Memory"
+	reason := make(map[string]string)
+	if metrics.MemoryUsed == nil || metrics.MemoryTotal == nil || *metrics.MemoryTotal <= 0 {
+		reason["error"] = "memory_used and memory_total metrics not sent"
+		return Check{checkTitle, "skipped", reason}
+	}
+
+	used := float64(*metrics.MemoryUsed) / float64(*metrics.MemoryTotal)
+	reason["memory_used"] = fmt.Sprintf("%v", *metrics.MemoryUsed)
+	reason["memory_total"] = fmt.Sprintf("%v", *metrics.MemoryTotal)
+	reason["percent_used"] = fmt.Sprintf("%.1f", used*100)
+
+	swapped := 0.0
+	if metrics.SwapUsed != nil {
+		reason["swap_used"] = fmt.Sprintf("%v", *metrics.SwapUsed)
+		if metrics.SwapTotal != nil && *metrics.SwapTotal > 0 {
+			swapped = float64(*metrics.SwapUsed) / float64(*metrics.SwapTotal)
+			reason["swap_total"] = fmt.Sprintf("%v", *metrics.SwapTotal)
+		}
+	}
+
+	return Check{checkTitle, memoryStatus(used, swapped, metrics.SwapUsed), reason}
+}
+
+func memoryStatus(used, swapped float64, swapUsed *int64) string {
+	switch {
+	case used >= 0.95 || swapped >= 0.5:
+		return "red"
+	case used >= 0.85 || (swapUsed != nil && *swapUsed > 0):
+		return "yellow"
+	}
+	return "green"
+}
+
+func diskCheck(metrics HostMetrics) Check {
+	checkTitle := "Disk"
+	reason := make(map[string]string)
+	if metrics.DiskUsed == nil || metrics.DiskTotal == nil || *metrics.DiskTotal <= 0 {
+		reason["error"] = "disk_used and disk_total metrics not sent"
+		return Check{checkTitle, "skipped", reason}
+	}
+
+	used := float64(*metrics.DiskUsed) / float64(*metrics.DiskTotal)
+	reason["disk_used"] = fmt.Sprintf("%v", *metrics.DiskUsed)
+	reason["disk_total"] = fmt.Sprintf("%v", *metrics.DiskTotal)
+	reason["percent_used"] = fmt.Sprintf("%.1f", used*100)
+
+	return Check{checkTitle, diskStatus(used), reason}
+}
+
+func diskStatus(used float64) string {
+	switch {
+	case used >= 0.9:
+		return "red"
+	case used >= 0.8:
+		return "yellow"
+	}
+	return "green"
+}
+
+// iopsCheck compares the IOPS sent against what the plan provides.
+func iopsCheck(iops *float64, planIOPS float64) Check {
+	checkTitle := "IOPS"
+	reason := make(map[string]string)
+	if iops == nil {
+		reason["error"] = "iops metric not sent"
+		return Check{checkTitle, "skipped", reason}
+	}
+	if planIOPS <= 0 {
+		reason["error"] = "IOPS check not supported on this plan"
+		return Check{checkTitle, "skipped", reason}
+	}
+
+	used := *iops / planIOPS
+	reason["iops"] = fmt.Sprintf("%v", *iops)
+	reason["plan_iops"] = fmt.Sprintf("%v", planIOPS)
+	reason["percent_used"] = fmt.Sprintf("%.1f", used*100)
+	return Check{checkTitle, iopsStatus(used), reason}
+}
+
+func iopsStatus(used float64) string {
+	switch {
+	case used >= 0.9:
+		return "red"
+	case used >= 0.75:
+		return "yellow"
+	}
+	return "green"
 }
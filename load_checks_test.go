@@ -10,6 +10,9 @@ func TestCheckLoad(t *testing.T) {
 	if checkGreen.Status != "green" {
 		t.Fatalf("Ivory wasn't green")
 	}
+	if checkGreen.Results != nil {
+		t.Fatalf("expected no results for green, got %v", checkGreen.Results)
+	}
 
 	load = 1.2
 	checkYellow := CheckLoad(&load)[0]
@@ -29,3 +32,158 @@ func TestCheckLoad(t *testing.T) {
 	}
 
 }
+
+func TestCheckMetricsGreenLoadSource(t *testing.T) {
+	load := 0.2
+	checks := CheckMetrics(HostMetrics{LoadAvg1m: &load, Source: metricsFromProcfs}, Plan{}, nil)
+	reason, ok := checks[0].Results.(map[string]string)
+	if checks[0].Status != "green" || !ok || reason["source"] != metricsFromProcfs || reason["load"] != "0.2" {
+		t.Fatalf("expected a green load to record its source, got %v %v", checks[0].Status, checks[0].Results)
+	}
+}
+
+func TestCheckLoadPerCore(t *testing.T) {
+	load := 3.0
+	cpus := 4
+	checks := CheckMetrics(HostMetrics{LoadAvg1m: &load, CPUCount: &cpus}, Plan{}, nil)
+	if checks[0].Status != "green" {
+		t.Fatalf("expected green for load 3 on 4 cores, got %v", checks[0].Status)
+	}
+
+	load = 6.0
+	checks = CheckMetrics(HostMetrics{LoadAvg1m: &load, CPUCount: &cpus}, Plan{}, nil)
+	if checks[0].Status != "yellow" {
+		t.Fatalf("expected yellow for load 6 on 4 cores, got %v", checks[0].Status)
+	}
+
+	load = 9.0
+	checks = CheckMetrics(HostMetrics{LoadAvg1m: &load, CPUCount: &cpus}, Plan{}, nil)
+	if checks[0].Status != "red" {
+		t.Fatalf("expected red for load 9 on 4 cores, got %v", checks[0].Status)
+	}
+}
+
+func TestCheckMetricsSkipsOnlyMissing(t *testing.T) {
+	used, total := int64(95), int64(100)
+	checks := CheckMetrics(HostMetrics{DiskUsed: &used, DiskTotal: &total}, Plan{}, nil)
+	if checks[0].Status != "skipped" || checks[1].Status != "skipped" {
+		t.Fatal("expected load and memory to be skipped without their metrics")
+	}
+	if checks[2].Status != "red" {
+		t.Fatalf("expected red for a nearly full disk, got %v", checks[2].Status)
+	}
+}
+
+func TestMemoryStatus(t *testing.T) {
+	if memoryStatus(0.5, 0, nil) != "green" {
+		t.Fatal("not green on low memory use")
+	}
+
+	if memoryStatus(0.9, 0, nil) != "yellow" {
+		t.Fatal("not yellow on high memory use")
+	}
+
+	swap := int64(1024)
+	if memoryStatus(0.5, 0.01, &swap) != "yellow" {
+		t.Fatal("not yellow when swapping")
+	}
+
+	if memoryStatus(0.97, 0, nil) != "red" {
+		t.Fatal("not red on nearly full memory")
+	}
+}
+
+func TestDiskStatus(t *testing.T) {
+	if diskStatus(0.5) != "green" {
+		t.Fatal("not green on low disk use")
+	}
+
+	if diskStatus(0.85) != "yellow" {
+		t.Fatal("not yellow on high disk use")
+	}
+
+	if diskStatus(0.95) != "red" {
+		t.Fatal("not red on nearly full disk")
+	}
+}
+
+func TestCheckLoadWaitProfile(t *testing.T) {
+	load := 3.0
+	waits := profileWaits([]waitingSession{
+		{1, "IO", "DataFileRead", ""},
+		{2, "IO", "DataFileRead", ""},
+		{3, "IO", "DataFileRead", ""},
+		{4, "", "", ""},
+	})
+	checks := CheckMetrics(HostMetrics{LoadAvg1m: &load}, Plan{}, &waits)
+	reason := checks[0].Results.(map[string]string)
+	if checks[0].Status != "red" || reason["bound"] != "io" || reason["io_sessions"] != "3" {
+		t.Fatalf("expected the wait profile in the load results, got %v %v", checks[0].Status, reason)
+	}
+
+	idle := profileWaits(nil)
+	checks = CheckMetrics(HostMetrics{LoadAvg1m: &load}, Plan{}, &idle)
+	if _, ok := checks[0].Results.(map[string]string)["bound"]; ok {
+		t.Fatal("expected no bound with too few active sessions")
+	}
+}
+
+func TestCheckLoadFromWaitProfile(t *testing.T) {
+	busy := profileWaits([]waitingSession{
+		{1, "IO", "DataFileRead", ""},
+		{2, "", "", ""},
+		{3, "", "", ""},
+		{4, "", "", ""},
+		{5, "", "", ""},
+		{6, "Lock", "relation", ""},
+	})
+	cpus := 4
+	checks := CheckMetrics(HostMetrics{CPUCount: &cpus}, Plan{}, &busy)
+	reason := checks[0].Results.(map[string]string)
+	if checks[0].Status != "yellow" || reason["load"] != "5" || reason["load_from"] != "wait_events" || reason["bound"] != "cpu" {
+		t.Fatalf("expected the load estimated from the wait profile, got %v %v", checks[0].Status, reason)
+	}
+
+	quiet := profileWaits([]waitingSession{{1, "", "", ""}})
+	checks = CheckMetrics(HostMetrics{}, Plan{}, &quiet)
+	reason = checks[0].Results.(map[string]string)
+	if checks[0].Status != "green" || reason["load_from"] != "wait_events" {
+		t.Fatalf("expected a green load from the wait profile, got %v %v", checks[0].Status, reason)
+	}
+
+	checks = CheckMetrics(HostMetrics{}, Plan{}, nil)
+	if checks[0].Status != "skipped" {
+		t.Fatalf("expected no load check without metrics or waits, got %v", checks[0].Status)
+	}
+}
+
+func TestCheckMetricsAgainstPlan(t *testing.T) {
+	load, memory, disk, iops := 3.0, int64(3.5*gigabyte), int64(60*gigabyte), 2500.0
+	checks := CheckMetrics(HostMetrics{LoadAvg1m: &load, MemoryUsed: &memory, DiskUsed: &disk, IOPS: &iops}, GetPlan("standard-0"), nil)
+
+	expected := []string{"yellow", "yellow", "red", "yellow"}
+	for i, check := range checks {
+		if check.Status != expected[i] {
+			t.Errorf("%d. Expected %v, but was %v", i, expected[i], check.Status)
+		}
+	}
+
+	checks = CheckMetrics(HostMetrics{IOPS: &iops}, Plan{}, nil)
+	if checks[3].Status != "skipped" {
+		t.Fatalf("expected IOPS to be skipped without the plan's IOPS, got %v", checks[3].Status)
+	}
+}
+
+func TestIOPSStatus(t *testing.T) {
+	if iopsStatus(0.5) != "green" {
+		t.Fatal("not green on low IOPS")
+	}
+
+	if iopsStatus(0.8) != "yellow" {
+		t.Fatal("not yellow on high IOPS")
+	}
+
+	if iopsStatus(0.95) != "red" {
+		t.Fatal("not red on IOPS at the plan's limit")
+	}
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"database/sql"
+	"log"
+)
+
+type migration struct {
+	Version int
+	Name    string
+	SQL     string
+}
+
+// migrations are applied in order and never edited once released; change
+// the schema by appending a new one.
+var migrations = []migration{
+	{1, "create results", `
+create extension if not exists "uuid-ossp";
+
+create table if not exists results (
+  id uuid primary key default uuid_generate_v4(),
+  created_at timestamptz default now(),
+  app text,
+  database text,
+  url text,
+  checks json
+);
+`},
+	{2, "report status, plan, summary, timings and expiry", `
+create type report_status as enum ('pending', 'running', 'done', 'failed');
+
+alter table results
+  add column status report_status not null default 'done',
+  add column plan text,
+  add column summary_status text,
+  add column timings json,
+  add column expires_at timestamptz;
+
+create index results_app_database_created_at_idx on results (app, database, created_at);
+`},
+	{3, "report compaction", `
+alter table results add column compacted_at timestamptz;
+
+create index results_expires_at_idx on results (expires_at) where expires_at is not null;
+create index results_uncompacted_created_at_idx on results (created_at) where compacted_at is null;
+`},
+	{4, "api tokens", `
+create table api_tokens (
+  id uuid primary key default uuid_generate_v4(),
+  name text not null,
+  app text,
+  token_hash text not null unique,
+  created_at timestamptz not null default now(),
+  revoked_at timestamptz
+);
+`},
+	{5, "add connection to results", `
+alter table results add column connection json;
+`},
+	{6, "add databases to results", `
+alter table results add column databases json;
+`},
+	{7, "create schedules", `
+create table schedules (
+  id uuid primary key default uuid_generate_v4(),
+  cron text not null,
+  params json not null,
+  url_env text,
+  created_at timestamptz not null default now(),
+  next_run_at timestamptz not null,
+  last_run_at timestamptz
+);
+`},
+	{8, "create webhooks", `
+create table webhooks (
+  id uuid primary key default uuid_generate_v4(),
+  app text,
+  url text not null,
+  events json not null,
+  secret text not null,
+  created_at timestamptz not null default now()
+);
+
+create table webhook_deliveries (
+  id uuid primary key default uuid_generate_v4(),
+  webhook_id uuid not null references webhooks on delete cascade,
+  event text not null,
+  report_id uuid,
+  attempt int not null,
+  status_code int,
+  error text,
+  created_at timestamptz not null default now()
+);
+
+create index webhook_deliveries_webhook_id_created_at on webhook_deliveries (webhook_id, created_at);
+`},
+	{9, "add format to webhooks", `
+alter table webhooks add column format text not null default 'json';
+`},
+	{10, "add server version and timestamps to results", `
+alter table results add column server_version text;
+alter table results add column started_at timestamptz;
+alter table results add column finished_at timestamptz;
+`},
+	{11, "index webhook deliveries by time for purging", `
+create index webhook_deliveries_created_at on webhook_deliveries (created_at);
+`},
+}
+
+// an arbitrary key so concurrently starting processes take turns migrating
+const migrationLockKey = 4815162342
+
+func migrate(db *sql.DB) error {
+	_, err := db.Exec(`create table if not exists schema_migrations (
+  version int primary key,
+  name text not null,
+  applied_at timestamptz not null default now()
+)`)
+	if err != nil {
+		return err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec("select pg_advisory_xact_lock($1)", migrationLockKey)
+	if err != nil {
+		return err
+	}
+
+	var current int
+	err = tx.QueryRow("select coalesce(max(version), 0) from schema_migrations").Scan(&current)
+	if err != nil {
+		return err
+	}
+
+	for _, m := range pendingMigrations(current) {
+		log.Printf("applying migration %d: %s", m.Version, m.Name)
+		_, err = tx.Exec(m.SQL)
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec("insert into schema_migrations (version, name) values ($1, $2)", m.Version, m.Name)
+		if err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+func pendingMigrations(current int) []migration {
+	var pending []migration
+	for _, m := range migrations {
+		if m.Version > current {
+			pending = append(pending, m)
+		}
+	}
+	return pending
+}
@@ -0,0 +1,26 @@
+package main
+
+import "testing"
+
+func TestMigrationsAreOrdered(t *testing.T) {
+	for i, m := range migrations {
+		if m.Version != i+1 {
+			t.Fatalf("expected migration %d to have version %d, got %d", i, i+1, m.Version)
+		}
+	}
+}
+
+func TestPendingMigrations(t *testing.T) {
+	if len(pendingMigrations(0)) != len(migrations) {
+		t.Fatal("expected every migration to be pending on a new database")
+	}
+
+	if len(pendingMigrations(len(migrations))) != 0 {
+		t.Fatal("expected no migrations pending on an up to date database")
+	}
+
+	pending := pendingMigrations(1)
+	if len(pending) == 0 || pending[0].Version != 2 {
+		t.Fatalf("expected pending migrations to start after version 1, got %v", pending)
+	}
+}
@@ -4,24 +4,49 @@ import (
 	"strings"
 )
 
+// Plan is what a database plan provides. CPUs, Memory, Disk (in bytes) and
+// IOPS are zero for plans whose hardware isn't known, and the metrics
+// checks then only go by the metrics sent.
+//
+// The hardware of the numbered plans is the vCPUs, RAM, storage and
+// provisioned IOPS listed in Heroku's "Heroku Postgres Production Tier
+// Technical Characterization",
+// https://devcenter.heroku.com/articles/heroku-postgres-production-tier-technical-characterization
+// Legacy plans aren't listed there, so only their connection limit is known.
 type Plan struct {
 	ConnectionLimit int
+	CPUs            int
+	Memory          int64
+	Disk            int64
+	IOPS            float64
 }
 
+const gigabyte = 1024 * 1024 * 1024
+
 func GetPlan(name string) Plan {
 	switch trimName(name) {
 	case "dev", "basic":
-		return Plan{20}
+		return Plan{ConnectionLimit: 20}
 	case "crane", "yanari":
-		return Plan{60}
-	case "kappa", "0":
-		return Plan{120}
+		return Plan{ConnectionLimit: 60}
+	case "kappa":
+		return Plan{ConnectionLimit: 120}
+	case "0":
+		return Plan{120, 2, 4 * gigabyte, 64 * gigabyte, 3000}
 	case "ronin", "tengu", "fugu":
-		return Plan{200}
-	case "ika", "2":
-		return Plan{400}
-	case "zilla", "baku", "mecha", "ryu", "4"," 6", "7":
-		return Plan{500}
+		return Plan{ConnectionLimit: 200}
+	case "ika":
+		return Plan{ConnectionLimit: 400}
+	case "2":
+		return Plan{400, 2, 8 * gigabyte, 256 * gigabyte, 3000}
+	case "zilla", "baku", "mecha", "ryu":
+		return Plan{ConnectionLimit: 500}
+	case "4":
+		return Plan{500, 4, 30 * gigabyte, 768 * gigabyte, 4000}
+	case "6":
+		return Plan{500, 16, 122 * gigabyte, 1536 * gigabyte, 9000}
+	case "7":
+		return Plan{500, 32, 244 * gigabyte, 2048 * gigabyte, 12000}
 	}
 	return Plan{}
 }
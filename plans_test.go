@@ -8,3 +8,24 @@ func TestGetPlan(t *testing.T) {
 		t.Fatalf("epxected 60 for standard-yanari, got %v", plan.ConnectionLimit)
 	}
 }
+
+func TestGetPlanHardware(t *testing.T) {
+	plan := GetPlan("standard-4")
+	if plan.ConnectionLimit != 500 || plan.CPUs != 4 || plan.IOPS != 4000 {
+		t.Fatalf("unexpected standard-4 plan %+v", plan)
+	}
+
+	if plan = GetPlan("standard-kappa"); plan.CPUs != 0 || plan.ConnectionLimit != 120 {
+		t.Fatalf("expected unknown hardware for legacy plans, got %+v", plan)
+	}
+}
+
+// Plans 6 were looked up under " 6", so they got no connection limit.
+func TestGetPlanSix(t *testing.T) {
+	for _, name := range []string{"standard-6", "premium-6", "enterprise-6"} {
+		plan := GetPlan(name)
+		if plan.ConnectionLimit != 500 || plan.CPUs != 16 || plan.IOPS != 9000 {
+			t.Errorf("unexpected %s plan %+v", name, plan)
+		}
+	}
+}
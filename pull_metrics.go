@@ -0,0 +1,204 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"github.com/jmoiron/sqlx"
+	"strconv"
+	"strings"
+)
+
+const (
+	metricsFromCaller      = "caller"
+	metricsFromSystemStats = "system_stats"
+	metricsFromProctab     = "pg_proctab"
+	metricsFromProcfs      = "pg_read_file"
+)
+
+var errNoMetricsSource = errors.New("no host metrics source available in database")
+
+// PullMetrics tries to read host metrics from inside the database for
+// callers that only send a URL. It uses the system_stats or pg_proctab
+// extensions when installed, and falls back to reading /proc directly,
+// which only works for superusers.
+func PullMetrics(connstring string) (HostMetrics, error) {
+	db, err := connectDB(connstring)
+	if err != nil {
+		return HostMetrics{}, err
+	}
+	defer db.Close()
+
+	return pullHostMetrics(db)
+}
+
+func pullHostMetrics(db *sqlx.DB) (HostMetrics, error) {
+	var extensions []struct {
+		Name string `db:"extname"`
+	}
+	err := db.Select(&extensions, `SELECT extname FROM pg_extension WHERE extname IN ('system_stats', 'pg_proctab')`)
+	if err != nil {
+		return HostMetrics{}, err
+	}
+
+	for _, ext := range extensions {
+		var metrics HostMetrics
+		switch ext.Name {
+		case "system_stats":
+			metrics, err = systemStatsMetrics(db)
+		case "pg_proctab":
+			metrics, err = proctabMetrics(db)
+		}
+		if err == nil && metrics.LoadAvg1m != nil {
+			return metrics, nil
+		}
+	}
+
+	return procfsMetrics(db)
+}
+
+func systemStatsMetrics(db *sqlx.DB) (HostMetrics, error) {
+	metrics := HostMetrics{Source: metricsFromSystemStats}
+
+	var load float64
+	err := db.QueryRow("SELECT load_avg_one_minute FROM pg_sys_load_avg()").Scan(&load)
+	if err != nil {
+		return metrics, err
+	}
+	metrics.LoadAvg1m = &load
+
+	var cpus int
+	if db.QueryRow("SELECT logical_processor FROM pg_sys_cpu_info() LIMIT 1").Scan(&cpus) == nil {
+		metrics.CPUCount = &cpus
+	}
+
+	var mem struct {
+		Total     int64 `db:"total_memory"`
+		Used      int64 `db:"used_memory"`
+		SwapTotal int64 `db:"swap_total"`
+		SwapUsed  int64 `db:"swap_used"`
+	}
+	if db.Get(&mem, "SELECT total_memory, used_memory, swap_total, swap_used FROM pg_sys_memory_info()") == nil {
+		metrics.MemoryTotal, metrics.MemoryUsed = &mem.Total, &mem.Used
+		metrics.SwapTotal, metrics.SwapUsed = &mem.SwapTotal, &mem.SwapUsed
+	}
+
+	return metrics, nil
+}
+
+func proctabMetrics(db *sqlx.DB) (HostMetrics, error) {
+	metrics := HostMetrics{Source: metricsFromProctab}
+
+	var load float64
+	err := db.QueryRow("SELECT load1 FROM pg_loadavg()").Scan(&load)
+	if err != nil {
+		return metrics, err
+	}
+	metrics.LoadAvg1m = &load
+
+	var mem proctabMemory
+	if db.Get(&mem, "SELECT memused, memfree, membuffers, memcached, swapused, swapfree FROM pg_memusage()") == nil {
+		used, total, swapUsed, swapTotal := mem.bytes()
+		metrics.MemoryUsed, metrics.MemoryTotal = &used, &total
+		metrics.SwapUsed, metrics.SwapTotal = &swapUsed, &swapTotal
+	}
+
+	return metrics, nil
+}
+
+// proctabMemory is a row of pg_memusage, in kilobytes.
+type proctabMemory struct {
+	Used     int64 `db:"memused"`
+	Free     int64 `db:"memfree"`
+	Buffers  int64 `db:"membuffers"`
+	Cached   int64 `db:"memcached"`
+	SwapUsed int64 `db:"swapused"`
+	SwapFree int64 `db:"swapfree"`
+}
+
+// bytes returns memory and swap use in bytes. memused counts the page cache
+// and buffers, which the kernel gives back as soon as anything needs it, so
+// they're left out like MemAvailable leaves them out of /proc/meminfo.
+func (m proctabMemory) bytes() (used, total, swapUsed, swapTotal int64) {
+	used = m.Used - m.Buffers - m.Cached
+	if used < 0 {
+		used = 0
+	}
+	return used * 1024, (m.Used + m.Free) * 1024, m.SwapUsed * 1024, (m.SwapUsed + m.SwapFree) * 1024
+}
+
+func procfsMetrics(db *sqlx.DB) (HostMetrics, error) {
+	metrics := HostMetrics{Source: metricsFromProcfs}
+
+	var loadavg string
+	err := db.QueryRow("SELECT pg_read_file('/proc/loadavg')").Scan(&loadavg)
+	if err != nil {
+		return metrics, errNoMetricsSource
+	}
+	load, err := parseLoadavg(loadavg)
+	if err != nil {
+		return metrics, err
+	}
+	metrics.LoadAvg1m = &load
+
+	var cpuinfo string
+	if db.QueryRow("SELECT pg_read_file('/proc/cpuinfo')").Scan(&cpuinfo) == nil {
+		if cpus := countProcessors(cpuinfo); cpus > 0 {
+			metrics.CPUCount = &cpus
+		}
+	}
+
+	var meminfo string
+	if db.QueryRow("SELECT pg_read_file('/proc/meminfo')").Scan(&meminfo) == nil {
+		mem := parseMeminfo(meminfo)
+		if total, ok := mem["MemTotal"]; ok {
+			used := total - mem["MemAvailable"]
+			metrics.MemoryTotal, metrics.MemoryUsed = &total, &used
+		}
+		if swapTotal, ok := mem["SwapTotal"]; ok {
+			swapUsed := swapTotal - mem["SwapFree"]
+			metrics.SwapTotal, metrics.SwapUsed = &swapTotal, &swapUsed
+		}
+	}
+
+	return metrics, nil
+}
+
+func parseLoadavg(s string) (float64, error) {
+	fields := strings.Fields(s)
+	if len(fields) == 0 {
+		return 0, errors.New("empty /proc/loadavg")
+	}
+	return strconv.ParseFloat(fields[0], 64)
+}
+
+func countProcessors(cpuinfo string) int {
+	count := 0
+	scanner := bufio.NewScanner(strings.NewReader(cpuinfo))
+	for scanner.Scan() {
+		if strings.HasPrefix(scanner.Text(), "processor") {
+			count++
+		}
+	}
+	return count
+}
+
+// parseMeminfo returns the /proc/meminfo values in bytes.
+func parseMeminfo(meminfo string) map[string]int64 {
+	values := make(map[string]int64)
+	scanner := bufio.NewScanner(strings.NewReader(meminfo))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 2 {
+			continue
+		}
+		n, err := strconv.ParseInt(fields[1], 10, 64)
+		if err != nil {
+			continue
+		}
+		if len(fields) > 2 && fields[2] == "kB" {
+			n *= 1024
+		}
+		values[strings.TrimSuffix(fields[0], ":")] = n
+	}
+	return values
+}
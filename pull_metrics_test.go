@@ -0,0 +1,69 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestParseLoadavg(t *testing.T) {
+	load, err := parseLoadavg("0.52 0.58 0.59 1/467 12345\n")
+	if err != nil || load != 0.52 {
+		t.Fatalf("expected 0.52, got %v (%v)", load, err)
+	}
+
+	_, err = parseLoadavg("")
+	if err == nil {
+		t.Fatal("expected an error on empty loadavg")
+	}
+}
+
+func TestCountProcessors(t *testing.T) {
+	cpuinfo := "processor\t: 0\nmodel name\t: x\n\nprocessor\t: 1\nmodel name\t: x\n"
+	if countProcessors(cpuinfo) != 2 {
+		t.Fatalf("expected 2 processors, got %v", countProcessors(cpuinfo))
+	}
+}
+
+func TestParseMeminfo(t *testing.T) {
+	meminfo := "MemTotal:        2048 kB\nMemAvailable:    1024 kB\nSwapTotal:          0 kB\nHugePages_Total:    0\n"
+	mem := parseMeminfo(meminfo)
+	if mem["MemTotal"] != 2048*1024 || mem["MemAvailable"] != 1024*1024 {
+		t.Fatalf("unexpected memory values %v", mem)
+	}
+	if _, ok := mem["SwapTotal"]; !ok {
+		t.Fatal("expected SwapTotal to be parsed")
+	}
+	if mem["HugePages_Total"] != 0 {
+		t.Fatal("expected unitless values to be kept as is")
+	}
+}
+
+func TestProctabMemory(t *testing.T) {
+	// a host whose memory is mostly page cache, as a database's usually is
+	mem := proctabMemory{Used: 15000000, Free: 1000000, Buffers: 500000, Cached: 11500000, SwapUsed: 0, SwapFree: 2000000}
+	used, total, swapUsed, swapTotal := mem.bytes()
+	if used != 3000000*1024 || total != 16000000*1024 || swapUsed != 0 || swapTotal != 2000000*1024 {
+		t.Fatalf("unexpected memory %v of %v, swap %v of %v", used, total, swapUsed, swapTotal)
+	}
+
+	check := memoryCheck(HostMetrics{MemoryUsed: &used, MemoryTotal: &total, SwapUsed: &swapUsed, SwapTotal: &swapTotal})
+	if check.Status != "green" {
+		t.Fatalf("expected page cache not to count as used memory, got %v %v", check.Status, check.Results)
+	}
+}
+
+func TestPullProcfsMetrics(t *testing.T) {
+	addr := fakeQueryPostgres(t, map[string][]string{
+		"pg_extension":  {},
+		"/proc/loadavg": {"0.52 0.58 0.59 1/467 12345\n"},
+		"/proc/cpuinfo": {"processor\t: 0\n\nprocessor\t: 1\n"},
+		"/proc/meminfo": {"MemTotal:        2048 kB\nMemAvailable:    1024 kB\n"},
+	})
+	metrics, err := PullMetrics("postgres://u@" + addr + "/db?sslmode=disable")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if metrics.Source != metricsFromProcfs || metrics.LoadAvg1m == nil || *metrics.LoadAvg1m != 0.52 ||
+		metrics.CPUCount == nil || *metrics.CPUCount != 2 || metrics.MemoryUsed == nil || *metrics.MemoryUsed != 1024*1024 {
+		t.Fatalf("unexpected metrics %+v", metrics)
+	}
+}
@@ -0,0 +1,239 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// How query text captured from pg_stat_activity is kept in reports.
+const (
+	redactFull       = "full"
+	redactNormalized = "normalized"
+	redactHidden     = "hidden"
+)
+
+const hiddenQuery = "<hidden>"
+
+func validRedaction(mode string) bool {
+	switch mode {
+	case redactFull, redactNormalized, redactHidden:
+		return true
+	}
+	return false
+}
+
+// redactChecks rewrites the query text in the results of every check that
+// captures it, according to mode. It must run before a report is stored.
+func redactChecks(checks []Check, mode string) {
+	if mode == redactFull {
+		return
+	}
+	redact := func(query string) string {
+		if mode == redactHidden {
+			return hiddenQuery
+		}
+		return normalizeQuery(query)
+	}
+
+	for _, check := range checks {
+		switch results := check.Results.(type) {
+		case []longQueriesResult:
+			for i := range results {
+				results[i].Query = redact(results[i].Query)
+			}
+		case []idleQueriesResult:
+			for i := range results {
+				results[i].Query = redact(results[i].Query)
+			}
+		case []blockingResult:
+			for i := range results {
+				results[i].Blocking_statement = redact(results[i].Blocking_statement)
+				results[i].Blocked_statement = redact(results[i].Blocked_statement)
+			}
+		case []sampleResult:
+			for i := range results {
+				for j := range results[i].TopQueries {
+					results[i].TopQueries[j].Query = redact(results[i].TopQueries[j].Query)
+				}
+				for j := range results[i].BlockingPids {
+					results[i].BlockingPids[j].Query = redact(results[i].BlockingPids[j].Query)
+				}
+			}
+		}
+	}
+}
+
+// normalizeQuery replaces literals with $n placeholders the way
+// pg_stat_statements does, numbering after any parameters the query
+// already has. Comments are dropped since they can hold anything.
+// Truncated queries are fine: an unterminated literal runs to the end.
+func normalizeQuery(query string) string {
+	var out strings.Builder
+	n := maxParam(query)
+	placeholder := func() {
+		n++
+		fmt.Fprintf(&out, "$%d", n)
+	}
+
+	for i := 0; i < len(query); {
+		c := query[i]
+		switch {
+		case c == '-' && strings.HasPrefix(query[i:], "--"):
+			end := strings.IndexByte(query[i:], '\n')
+			if end < 0 {
+				i = len(query)
+			} else {
+				i += end
+			}
+
+		case c == '/' && strings.HasPrefix(query[i:], "/*"):
+			end := strings.Index(query[i+2:], "*/")
+			if end < 0 {
+				i = len(query)
+			} else {
+				i += end + 4
+			}
+			out.WriteByte(' ')
+
+		case c == '\'':
+			i = skipQuoted(query, i, false)
+			placeholder()
+
+		case (c == 'E' || c == 'e' || c == 'B' || c == 'b' || c == 'X' || c == 'x' || c == 'N' || c == 'n') &&
+			i+1 < len(query) && query[i+1] == '\'' && !identByteBefore(query, i):
+			i = skipQuoted(query, i+1, c == 'E' || c == 'e')
+			placeholder()
+
+		case c == '"':
+			end := strings.IndexByte(query[i+1:], '"')
+			if end < 0 {
+				out.WriteString(query[i:])
+				i = len(query)
+			} else {
+				out.WriteString(query[i : i+end+2])
+				i += end + 2
+			}
+
+		case c == '$' && dollarTag(query[i:]) != "":
+			tag := dollarTag(query[i:])
+			end := strings.Index(query[i+len(tag):], tag)
+			if end < 0 {
+				i = len(query)
+			} else {
+				i += len(tag) + end + len(tag)
+			}
+			placeholder()
+
+		case c == '$' && i+1 < len(query) && isDigit(query[i+1]):
+			j := i + 1
+			for j < len(query) && isDigit(query[j]) {
+				j++
+			}
+			out.WriteString(query[i:j])
+			i = j
+
+		case (isDigit(c) || (c == '.' && i+1 < len(query) && isDigit(query[i+1]))) && !identByteBefore(query, i):
+			i = skipNumber(query, i)
+			placeholder()
+
+		case isIdentByte(c):
+			j := i
+			for j < len(query) && isIdentByte(query[j]) {
+				j++
+			}
+			out.WriteString(query[i:j])
+			i = j
+
+		default:
+			out.WriteByte(c)
+			i++
+		}
+	}
+	return out.String()
+}
+
+// skipQuoted returns the index just past the single quoted literal starting
+// at i. Backslash escapes only count in E'...' strings.
+func skipQuoted(query string, i int, backslashes bool) int {
+	for j := i + 1; j < len(query); j++ {
+		switch query[j] {
+		case '\\':
+			if backslashes {
+				j++
+			}
+		case '\'':
+			if j+1 < len(query) && query[j+1] == '\'' {
+				j++
+				continue
+			}
+			return j + 1
+		}
+	}
+	return len(query)
+}
+
+func skipNumber(query string, i int) int {
+	j := i
+	for j < len(query) && (isDigit(query[j]) || query[j] == '.') {
+		j++
+	}
+	if j < len(query) && (query[j] == 'e' || query[j] == 'E') {
+		k := j + 1
+		if k < len(query) && (query[k] == '+' || query[k] == '-') {
+			k++
+		}
+		if k < len(query) && isDigit(query[k]) {
+			j = k
+			for j < len(query) && isDigit(query[j]) {
+				j++
+			}
+		}
+	}
+	return j
+}
+
+// dollarTag returns the opening $tag$ of a dollar quoted string at the start
+// of s, or "" if there is none.
+func dollarTag(s string) string {
+	for j := 1; j < len(s); j++ {
+		switch {
+		case s[j] == '$':
+			return s[:j+1]
+		case isDigit(s[j]) && j == 1:
+			return ""
+		case !isIdentByte(s[j]):
+			return ""
+		}
+	}
+	return ""
+}
+
+func maxParam(query string) int {
+	max := 0
+	for i := 0; i < len(query); i++ {
+		if query[i] != '$' {
+			continue
+		}
+		j := i + 1
+		for j < len(query) && isDigit(query[j]) {
+			j++
+		}
+		if n, err := strconv.Atoi(query[i+1 : j]); err == nil && n > max {
+			max = n
+		}
+	}
+	return max
+}
+
+func identByteBefore(query string, i int) bool {
+	return i > 0 && isIdentByte(query[i-1])
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+func isIdentByte(c byte) bool {
+	return c == '_' || isDigit(c) || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || c >= 0x80
+}
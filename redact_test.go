@@ -0,0 +1,54 @@
+package main
+
+import (
+	"testing"
+)
+
+var normalizetests = []struct {
+	in  string
+	out string
+}{
+	{"select 1", "select $1"},
+	{"SELECT * FROM users WHERE email = 'a@b.com' AND id = 42", "SELECT * FROM users WHERE email = $1 AND id = $2"},
+	{"select 'it''s', E'a\\'b', x'ff'", "select $1, $2, $3"},
+	{"select * from t where a = $1 and b = 'x'", "select * from t where a = $1 and b = $2"},
+	{"select * from t2 where c3 = 1.5e10", "select * from t2 where c3 = $1"},
+	{`select "col1" from "t 2"`, `select "col1" from "t 2"`},
+	{"select $$secret$$, $tag$more$tag$", "select $1, $2"},
+	{"select 1 -- password is hunter2\nfrom t", "select $1 \nfrom t"},
+	{"select /* user 7 */ 2", "select   $1"},
+	{"update t set token = 'abc", "update t set token = $1"},
+}
+
+func TestNormalizeQuery(t *testing.T) {
+	for i, tt := range normalizetests {
+		out := normalizeQuery(tt.in)
+		if out != tt.out {
+			t.Errorf("%d. Expected %q to normalize to %q, but was %q", i, tt.in, tt.out, out)
+		}
+	}
+}
+
+func TestRedactChecks(t *testing.T) {
+	long := []longQueriesResult{{1, "2m", "select * from t where ssn = '123'"}}
+	blocking := []blockingResult{{Blocking_statement: "update t set a = 1", Blocked_statement: "update t set a = 2"}}
+	checks := []Check{{"Long Queries", "red", long}, {"Blocking Queries", "red", blocking}}
+
+	redactChecks(checks, redactFull)
+	if long[0].Query != "select * from t where ssn = '123'" {
+		t.Fatalf("expected full mode to keep the query, got %q", long[0].Query)
+	}
+
+	redactChecks(checks, redactNormalized)
+	if long[0].Query != "select * from t where ssn = $1" {
+		t.Fatalf("expected normalized query, got %q", long[0].Query)
+	}
+	if blocking[0].Blocked_statement != "update t set a = $1" {
+		t.Fatalf("expected normalized statement, got %q", blocking[0].Blocked_statement)
+	}
+
+	redactChecks(checks, redactHidden)
+	if long[0].Query != hiddenQuery || blocking[0].Blocking_statement != hiddenQuery {
+		t.Fatal("expected hidden mode to drop query text")
+	}
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"log"
+	"os"
+	"time"
+)
+
+// retentionPolicy decides how long reports and webhook deliveries are kept.
+// A zero duration keeps them forever, or never compacts reports.
+type retentionPolicy struct {
+	Default      time.Duration
+	ByApp        map[string]time.Duration
+	CompactAfter time.Duration
+	Deliveries   time.Duration
+}
+
+const defaultDeliveryRetention = 30 * 24 * time.Hour
+
+func loadRetentionPolicy() (retentionPolicy, error) {
+	var policy retentionPolicy
+	var err error
+
+	policy.Default, err = envDuration("REPORT_RETENTION")
+	if err != nil {
+		return policy, err
+	}
+	policy.CompactAfter, err = envDuration("REPORT_COMPACT_AFTER")
+	if err != nil {
+		return policy, err
+	}
+	policy.Deliveries = defaultDeliveryRetention
+	if os.Getenv("DELIVERY_RETENTION") != "" {
+		policy.Deliveries, err = envDuration("DELIVERY_RETENTION")
+		if err != nil {
+			return policy, err
+		}
+	}
+	policy.ByApp, err = parseDurations(os.Getenv("REPORT_RETENTION_BY_APP"))
+	return policy, err
+}
+
+// expiry returns when a report for app created at created should be
+// deleted, or nil to keep it forever.
+func (p retentionPolicy) expiry(app string, created time.Time) *time.Time {
+	retention, ok := p.ByApp[app]
+	if !ok {
+		retention = p.Default
+	}
+	if retention <= 0 {
+		return nil
+	}
+	expires := created.Add(retention)
+	return &expires
+}
+
+// purge deletes expired reports and old webhook deliveries, and compacts
+// old reports.
+func (p retentionPolicy) purge(store Store, now time.Time) {
+	deleted, err := store.Purge(now)
+	if err != nil {
+		log.Printf("purging reports: %v", err)
+	} else if deleted > 0 {
+		log.Printf("purged %d expired reports", deleted)
+	}
+
+	if p.Deliveries > 0 {
+		deleted, err = store.PurgeDeliveries(now.Add(-p.Deliveries))
+		if err != nil {
+			log.Printf("purging webhook deliveries: %v", err)
+		} else if deleted > 0 {
+			log.Printf("purged %d old webhook deliveries", deleted)
+		}
+	}
+
+	if p.CompactAfter <= 0 {
+		return
+	}
+	compacted, err := store.Compact(now.Add(-p.CompactAfter))
+	if err != nil {
+		log.Printf("compacting reports: %v", err)
+	} else if compacted > 0 {
+		log.Printf("compacted %d old reports", compacted)
+	}
+}
+
+func (p retentionPolicy) startPurger(store Store, interval time.Duration) {
+	go func() {
+		for {
+			p.purge(store, time.Now())
+			time.Sleep(interval)
+		}
+	}()
+}
+
+// compactChecks keeps only the name and status of each check, so old
+// reports still serve trend lines without holding on to query text.
+func compactChecks(checks []Check) []Check {
+	compacted := make([]Check, len(checks))
+	for i, check := range checks {
+		compacted[i] = Check{check.Name, check.Status, nil}
+	}
+	return compacted
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestRetentionExpiry(t *testing.T) {
+	now := time.Now()
+	policy := retentionPolicy{}
+	if policy.expiry("app", now) != nil {
+		t.Fatal("expected reports to be kept forever by default")
+	}
+
+	policy = retentionPolicy{Default: time.Hour, ByApp: map[string]time.Duration{"short": time.Minute}}
+	if e := policy.expiry("app", now); e == nil || !e.Equal(now.Add(time.Hour)) {
+		t.Fatalf("expected default retention, got %v", e)
+	}
+	if e := policy.expiry("short", now); e == nil || !e.Equal(now.Add(time.Minute)) {
+		t.Fatalf("expected per app retention, got %v", e)
+	}
+}
+
+func TestParseDurations(t *testing.T) {
+	durations, err := parseDurations("a=24h, b=1m")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if durations["a"] != 24*time.Hour || durations["b"] != time.Minute {
+		t.Fatalf("unexpected durations %v", durations)
+	}
+
+	if _, err = parseDurations("a"); err == nil {
+		t.Fatal("expected an error without a duration")
+	}
+}
+
+func TestPurgeAndCompact(t *testing.T) {
+	store := newMemoryStore()
+	past := time.Now().Add(-time.Minute)
+
+	expired := &Report{App: "app", ExpiresAt: &past}
+	kept := &Report{App: "app", URL: "postgres://u:@h/d", Checks: []Check{{"Long Queries", "red", []longQueriesResult{{1, "2m", "select secret"}}}}}
+	store.Save(expired)
+	store.Save(kept)
+
+	policy := retentionPolicy{CompactAfter: time.Nanosecond}
+	time.Sleep(time.Millisecond)
+	policy.purge(store, time.Now())
+
+	if _, err := store.Get(expired.Id); err != ErrReportNotFound {
+		t.Fatal("expected expired report to be purged")
+	}
+
+	compacted, err := store.Get(kept.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if compacted.CompactedAt == nil || compacted.URL != "" {
+		t.Fatalf("expected report to be compacted, got %+v", compacted)
+	}
+	if compacted.Checks[0].Status != "red" || compacted.Checks[0].Results != nil {
+		t.Fatalf("expected only the check status to be kept, got %+v", compacted.Checks[0])
+	}
+}
+
+func TestPurgeDeliveries(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pgdiagnose-retention")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	fileStore, err := newFileStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, store := range []Store{newMemoryStore(), fileStore} {
+		store.SaveDelivery(&webhookDelivery{WebhookId: "hook", Attempt: 1})
+		time.Sleep(time.Millisecond)
+		cutoff := time.Now()
+		store.SaveDelivery(&webhookDelivery{WebhookId: "hook", Attempt: 2})
+
+		policy := retentionPolicy{Deliveries: time.Hour}
+		policy.purge(store, cutoff.Add(time.Hour))
+
+		deliveries, err := store.Deliveries("hook", 10)
+		if err != nil || len(deliveries) != 1 || deliveries[0].Attempt != 2 {
+			t.Fatalf("expected only the recent delivery to be kept, got %+v (%v)", deliveries, err)
+		}
+	}
+}
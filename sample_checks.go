@@ -0,0 +1,239 @@
+package main
+
+import (
+	"github.com/jmoiron/sqlx"
+	"log"
+	"sort"
+	"time"
+)
+
+const (
+	defaultSampleInterval = time.Second
+	maxSampleWindow       = time.Minute
+	sampleTopN            = 10
+)
+
+type activitySample struct {
+	At       time.Time
+	Activity []sampledActivity
+	Blocking []blockingResult
+}
+
+type sampledActivity struct {
+	Pid           int64  `db:"pid"`
+	WaitEventType string `db:"wait_event_type"`
+	WaitEvent     string `db:"wait_event"`
+	Query         string `db:"query"`
+}
+
+type sampleResult struct {
+	Samples      int                `json:"samples"`
+	Bound        string             `json:"bound"`
+	Interval     string             `json:"interval"`
+	Window       string             `json:"window"`
+	WaitEvents   []waitEventCount   `json:"wait_events"`
+	BlockingPids []blockingPidCount `json:"blocking_pids"`
+	TopQueries   []queryCount       `json:"top_queries"`
+	Timeline     []samplePoint      `json:"timeline"`
+}
+
+type waitEventCount struct {
+	WaitEventType string `json:"wait_event_type"`
+	WaitEvent     string `json:"wait_event"`
+	Count         int    `json:"count"`
+}
+
+type blockingPidCount struct {
+	Pid     int    `json:"pid"`
+	Samples int    `json:"samples"`
+	Blocked int    `json:"blocked"`
+	Query   string `json:"query"`
+}
+
+type queryCount struct {
+	Query string `json:"query"`
+	Count int    `json:"count"`
+}
+
+type samplePoint struct {
+	At      time.Time `json:"at"`
+	Active  int       `json:"active"`
+	Waiting int       `json:"waiting"`
+	Blocked int       `json:"blocked"`
+}
+
+// SampleSql polls pg_stat_activity and pg_locks every interval for the whole
+// window, catching contention that comes and goes between snapshot reports.
+func SampleSql(connstring string, interval, window time.Duration, filter activityFilter) ([]Check, error) {
+	db, err := connectDB(connstring)
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+
+	filter, err = filterForServer(db, filter)
+	if err != nil {
+		return nil, err
+	}
+
+	return []Check{sampleCheck(db, interval, window, filter)}, nil
+}
+
+func sampleCheck(db *sqlx.DB, interval, window time.Duration, filter activityFilter) Check {
+	checkTitle := "Activity Sample"
+
+	if interval <= 0 {
+		interval = defaultSampleInterval
+	}
+	if window > maxSampleWindow {
+		window = maxSampleWindow
+	}
+
+	var samples []activitySample
+	deadline := time.Now().Add(window)
+	for {
+		sample := activitySample{At: time.Now()}
+		err := db.Select(&sample.Activity, filter.query(sampleActivitySQL), filter.args()...)
+		if err != nil {
+			return makeErrorCheck(checkTitle, err)
+		}
+		err = db.Select(&sample.Blocking, blockingSQL)
+		if err != nil {
+			log.Println(err)
+		}
+		samples = append(samples, sample)
+
+		if time.Now().Add(interval).After(deadline) {
+			break
+		}
+		time.Sleep(interval)
+	}
+
+	result := aggregateSamples(samples)
+	result.Interval = interval.String()
+	result.Window = window.String()
+	return Check{checkTitle, sampleStatus(result), []sampleResult{result}}
+}
+
+func aggregateSamples(samples []activitySample) sampleResult {
+	result := sampleResult{Samples: len(samples)}
+
+	waits := make(map[waitEventCount]int)
+	bound := make(map[string]int)
+	queries := make(map[string]int)
+	blockers := make(map[int]*blockingPidCount)
+
+	for _, sample := range samples {
+		point := samplePoint{At: sample.At, Active: len(sample.Activity)}
+		for _, a := range sample.Activity {
+			bound[waitCategory(a.WaitEventType)]++
+			if a.WaitEventType != "" {
+				point.Waiting++
+				waits[waitEventCount{WaitEventType: a.WaitEventType, WaitEvent: a.WaitEvent}]++
+			}
+			queries[a.Query]++
+		}
+
+		blocked := make(map[int]bool)
+		seen := make(map[int]bool)
+		for _, b := range sample.Blocking {
+			blocked[b.Blocked_pid] = true
+			bc, ok := blockers[b.Blocking_pid]
+			if !ok {
+				bc = &blockingPidCount{Pid: b.Blocking_pid, Query: b.Blocking_statement}
+				blockers[b.Blocking_pid] = bc
+			}
+			if !seen[b.Blocking_pid] {
+				seen[b.Blocking_pid] = true
+				bc.Samples++
+			}
+			bc.Blocked++
+		}
+		point.Blocked = len(blocked)
+		result.Timeline = append(result.Timeline, point)
+	}
+
+	for w, count := range waits {
+		w.Count = count
+		result.WaitEvents = append(result.WaitEvents, w)
+	}
+	sort.Sort(byWaitCount(result.WaitEvents))
+	result.Bound = boundOn(bound["cpu"], bound["io"], bound["lock"])
+
+	for q, count := range queries {
+		result.TopQueries = append(result.TopQueries, queryCount{q, count})
+	}
+	sort.Sort(byQueryCount(result.TopQueries))
+	if len(result.TopQueries) > sampleTopN {
+		result.TopQueries = result.TopQueries[:sampleTopN]
+	}
+
+	for _, bc := range blockers {
+		result.BlockingPids = append(result.BlockingPids, *bc)
+	}
+	sort.Sort(byBlockingSamples(result.BlockingPids))
+	if len(result.BlockingPids) > sampleTopN {
+		result.BlockingPids = result.BlockingPids[:sampleTopN]
+	}
+
+	return result
+}
+
+// sampleStatus is yellow if blocking showed up at all during the window and
+// red once it was there for at least half of the samples.
+func sampleStatus(result sampleResult) string {
+	blockedSamples := 0
+	for _, point := range result.Timeline {
+		if point.Blocked > 0 {
+			blockedSamples++
+		}
+	}
+
+	switch {
+	case blockedSamples == 0:
+		return "green"
+	case blockedSamples*2 >= len(result.Timeline):
+		return "red"
+	}
+	return "yellow"
+}
+
+type byWaitCount []waitEventCount
+
+func (s byWaitCount) Len() int      { return len(s) }
+func (s byWaitCount) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
+func (s byWaitCount) Less(i, j int) bool {
+	if s[i].Count != s[j].Count {
+		return s[i].Count > s[j].Count
+	}
+	return s[i].WaitEventType+s[i].WaitEvent < s[j].WaitEventType+s[j].WaitEvent
+}
+
+type byQueryCount []queryCount
+
+func (s byQueryCount) Len() int      { return len(s) }
+func (s byQueryCount) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
+func (s byQueryCount) Less(i, j int) bool {
+	if s[i].Count != s[j].Count {
+		return s[i].Count > s[j].Count
+	}
+	return s[i].Query < s[j].Query
+}
+
+type byBlockingSamples []blockingPidCount
+
+func (s byBlockingSamples) Len() int      { return len(s) }
+func (s byBlockingSamples) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
+func (s byBlockingSamples) Less(i, j int) bool {
+	if s[i].Samples != s[j].Samples {
+		return s[i].Samples > s[j].Samples
+	}
+	return s[i].Pid < s[j].Pid
+}
+
+const sampleActivitySQL = `
+	SELECT pid, coalesce(wait_event_type, '') as wait_event_type,
+	  coalesce(wait_event, '') as wait_event, query
+	FROM pg_stat_activity
+	WHERE state = 'active' AND %s
+	;`
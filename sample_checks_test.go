@@ -0,0 +1,63 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestAggregateSamples(t *testing.T) {
+	now := time.Now()
+	samples := []activitySample{
+		{
+			At: now,
+			Activity: []sampledActivity{
+				{1, "Lock", "transactionid", "update a"},
+				{2, "", "", "select 1"},
+			},
+			Blocking: []blockingResult{{Blocked_pid: 1, Blocking_pid: 3, Blocking_statement: "update b"}},
+		},
+		{
+			At: now.Add(time.Second),
+			Activity: []sampledActivity{
+				{1, "Lock", "transactionid", "update a"},
+			},
+		},
+	}
+
+	result := aggregateSamples(samples)
+	if result.Samples != 2 || len(result.Timeline) != 2 {
+		t.Fatalf("expected 2 samples, got %+v", result)
+	}
+	if len(result.WaitEvents) != 1 || result.WaitEvents[0].Count != 2 {
+		t.Fatalf("expected one wait event seen twice, got %+v", result.WaitEvents)
+	}
+	if result.Bound != "lock" {
+		t.Fatalf("expected lock bound, got %v", result.Bound)
+	}
+	if result.TopQueries[0].Query != "update a" || result.TopQueries[0].Count != 2 {
+		t.Fatalf("expected update a as top query, got %+v", result.TopQueries)
+	}
+	if len(result.BlockingPids) != 1 || result.BlockingPids[0].Pid != 3 {
+		t.Fatalf("expected pid 3 as blocker, got %+v", result.BlockingPids)
+	}
+	if result.Timeline[0].Waiting != 1 || result.Timeline[0].Blocked != 1 || result.Timeline[1].Blocked != 0 {
+		t.Fatalf("unexpected timeline %+v", result.Timeline)
+	}
+}
+
+func TestSampleStatus(t *testing.T) {
+	result := sampleResult{Timeline: []samplePoint{{}, {}, {}, {}}}
+	if sampleStatus(result) != "green" {
+		t.Fatal("not green without blocking")
+	}
+
+	result.Timeline[0].Blocked = 1
+	if sampleStatus(result) != "yellow" {
+		t.Fatal("not yellow on transient blocking")
+	}
+
+	result.Timeline[1].Blocked = 2
+	if sampleStatus(result) != "red" {
+		t.Fatal("not red on persistent blocking")
+	}
+}
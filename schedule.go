@@ -0,0 +1,418 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/go-martini/martini"
+	"github.com/lib/pq"
+	"log"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"time"
+)
+
+// Schedule runs a diagnosis of a target whenever its cron expression
+// matches. It takes the fields of a report request, and like fleet
+// inventories can read the url from the environment variable url_env.
+type Schedule struct {
+	Id   string `json:"id"`
+	Cron string `json:"cron"`
+	JobParams
+	URLEnv    string     `json:"url_env,omitempty"`
+	CreatedAt time.Time  `json:"created_at"`
+	NextRunAt time.Time  `json:"next_run_at"`
+	LastRunAt *time.Time `json:"last_run_at"`
+}
+
+type ScheduleStore interface {
+	// SaveSchedule assigns the schedule an id and creation time and
+	// stores it.
+	SaveSchedule(schedule *Schedule) error
+	Schedules() ([]Schedule, error)
+	DeleteSchedule(id string) error
+	// ClaimSchedule moves a schedule that is due at due on to next, and
+	// reports whether it did. Only one of several servers sharing a
+	// results database claims each run.
+	ClaimSchedule(id string, due, next time.Time) (bool, error)
+}
+
+var ErrScheduleNotFound = errors.New("schedule not found")
+
+// public returns the schedule without the secrets needed to run it.
+func (s Schedule) public() Schedule {
+	s.URL = removePassword(s.URL)
+	s.TLS.Key = ""
+	s.Tunnel.SSHKey = ""
+	if u, err := url.Parse(s.Tunnel.SOCKS5); err == nil && u.User != nil {
+		u.User = url.User(u.User.Username())
+		s.Tunnel.SOCKS5 = u.String()
+	}
+	return s
+}
+
+var ErrURLEnvNotAllowed = errors.New("url_env isn't one of SCHEDULE_URL_ENVS")
+
+// params returns the report request to run, reading the url from the
+// environment if the schedule says to and the variable is in allowed.
+func (s Schedule) params(allowed []string) (JobParams, error) {
+	if s.URLEnv != "" && !containsString(allowed, s.URLEnv) {
+		return s.JobParams, ErrURLEnvNotAllowed
+	}
+	target := fleetTarget{s.JobParams, s.URLEnv}
+	err := target.resolveURL()
+	return target.JobParams, err
+}
+
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+// runDueSchedules claims every schedule due by now and starts run for it.
+func runDueSchedules(store ScheduleStore, now time.Time, run func(Schedule)) error {
+	schedules, err := store.Schedules()
+	if err != nil {
+		return err
+	}
+
+	for _, s := range schedules {
+		if s.NextRunAt.After(now) {
+			continue
+		}
+		c, err := parseCron(s.Cron)
+		if err != nil {
+			log.Printf("schedule %s: %v", s.Id, err)
+			continue
+		}
+		claimed, err := store.ClaimSchedule(s.Id, s.NextRunAt, c.next(now))
+		if err != nil {
+			log.Printf("schedule %s: %v", s.Id, err)
+			continue
+		}
+		if claimed {
+			go run(s)
+		}
+	}
+	return nil
+}
+
+// startScheduler checks for due schedules every interval. Schedules that
+// came due while no server was running run once at startup.
+func startScheduler(store ScheduleStore, interval time.Duration, run func(Schedule)) {
+	go func() {
+		for {
+			err := runDueSchedules(store, time.Now(), run)
+			if err != nil {
+				log.Printf("%v", err)
+			}
+			time.Sleep(interval)
+		}
+	}()
+}
+
+// scheduledDiagnosis runs a schedule like a report request, unless the
+// limiter says the target was just diagnosed or there's too much going on,
+// in which case this run is skipped.
+func scheduledDiagnosis(store ReportStore, config Config, notify notifier, limiter *diagnosisLimiter) func(Schedule) {
+	return func(s Schedule) {
+		params, err := s.params(config.ScheduleURLEnvs)
+		if err != nil {
+			log.Printf("schedule %s: %v", s.Id, err)
+			return
+		}
+
+		target, options := diagnosisTarget(params), diagnosisOptions(params)
+		_, job, leader, _ := limiter.acquire(target, options, time.Now())
+		if !leader {
+			log.Printf("schedule %s: skipping run, target was diagnosed recently or too many diagnoses are running", s.Id)
+			return
+		}
+		report, err := createJob(store, config, notify, params)
+		limiter.finish(target, options, job, report, err, time.Now())
+		if err != nil {
+			log.Printf("schedule %s: %v", s.Id, err)
+		}
+	}
+}
+
+func createSchedule(req *http.Request, store ScheduleStore, token *apiToken, config Config) (int, string) {
+	var s Schedule
+	err := json.NewDecoder(req.Body).Decode(&s)
+	if err != nil {
+		return 400, `{"error": "expected a JSON schedule"}`
+	}
+
+	s.sanitize()
+	if s.App == "" {
+		s.App = token.App
+	}
+	if !token.canAccess(s.App) {
+		return 403, `{"error": "token can't create schedules for this app"}`
+	}
+	// runs are compared to the app and database's latest report to tell
+	// which checks changed status
+	if s.App == "" || s.Database == "" {
+		return 400, `{"error": "set app and database, so each run can be compared to the last"}`
+	}
+
+	c, err := parseCron(s.Cron)
+	if err != nil {
+		return 400, `{"error": "bad cron expression"}`
+	}
+	// Variables hold the server's secrets, so only admin tokens can name
+	// one, and only one set aside for schedules.
+	if s.URLEnv != "" && token.App != "" {
+		return 400, `{"error": "only tokens for every app can set url_env"}`
+	}
+	params, err := s.params(config.ScheduleURLEnvs)
+	if err == ErrURLEnvNotAllowed {
+		return 400, `{"error": "url_env must be one of SCHEDULE_URL_ENVS"}`
+	}
+	if err != nil || removePassword(params.URL) == "" {
+		return 400, `{"error": "set url to a postgres url or url_env to a variable holding one"}`
+	}
+
+	s.NextRunAt = c.next(time.Now())
+	err = store.SaveSchedule(&s)
+	if err != nil {
+		log.Printf("%v", err)
+		return 500, `{"error": "Couldn't save schedule"}`
+	}
+
+	js, err := PrettyJSON(s.public())
+	if err != nil {
+		log.Printf("%v", err)
+		return 500, `{"error": "Couldn't send schedule"}`
+	}
+	return 201, js
+}
+
+func listSchedules(store ScheduleStore, token *apiToken) (int, string) {
+	schedules, err := store.Schedules()
+	if err != nil {
+		log.Printf("%v", err)
+		return 500, `{"error": "Couldn't list schedules"}`
+	}
+
+	visible := []Schedule{}
+	for _, s := range schedules {
+		if token.canAccess(s.App) {
+			visible = append(visible, s.public())
+		}
+	}
+	js, err := PrettyJSON(visible)
+	if err != nil {
+		log.Printf("%v", err)
+		return 500, `{"error": "Couldn't list schedules"}`
+	}
+	return 200, js
+}
+
+func deleteSchedule(params martini.Params, store ScheduleStore, token *apiToken) (int, string) {
+	schedules, err := store.Schedules()
+	if err == nil {
+		err = ErrScheduleNotFound
+		for _, s := range schedules {
+			if s.Id == params["id"] && token.canAccess(s.App) {
+				err = store.DeleteSchedule(s.Id)
+			}
+		}
+	}
+	if err != nil {
+		if err != ErrScheduleNotFound {
+			log.Printf("%v", err)
+		}
+		return 404, ""
+	}
+	return 204, ""
+}
+
+func (s *postgresStore) SaveSchedule(schedule *Schedule) error {
+	params, err := json.Marshal(schedule.JobParams)
+	if err != nil {
+		return err
+	}
+	row := s.db.QueryRow(
+		`INSERT INTO schedules (cron, params, url_env, next_run_at)
+		values ($1, $2, nullif($3, ''), $4) returning id, created_at`,
+		schedule.Cron, string(params), schedule.URLEnv, schedule.NextRunAt)
+	return row.Scan(&schedule.Id, &schedule.CreatedAt)
+}
+
+func (s *postgresStore) Schedules() ([]Schedule, error) {
+	rows, err := s.db.Query(`SELECT id, cron, params, coalesce(url_env, ''), created_at, next_run_at, last_run_at
+		FROM schedules ORDER BY created_at`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var schedules []Schedule
+	for rows.Next() {
+		var schedule Schedule
+		var params string
+		var lastRunAt pq.NullTime
+		err = rows.Scan(&schedule.Id, &schedule.Cron, &params, &schedule.URLEnv,
+			&schedule.CreatedAt, &schedule.NextRunAt, &lastRunAt)
+		if err != nil {
+			return nil, err
+		}
+		err = json.Unmarshal([]byte(params), &schedule.JobParams)
+		if err != nil {
+			return nil, err
+		}
+		if lastRunAt.Valid {
+			schedule.LastRunAt = &lastRunAt.Time
+		}
+		schedules = append(schedules, schedule)
+	}
+	return schedules, rows.Err()
+}
+
+func (s *postgresStore) DeleteSchedule(id string) error {
+	res, err := s.db.Exec("DELETE FROM schedules WHERE id = $1", id)
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrScheduleNotFound
+	}
+	return nil
+}
+
+func (s *postgresStore) ClaimSchedule(id string, due, next time.Time) (bool, error) {
+	res, err := s.db.Exec(
+		"UPDATE schedules SET next_run_at = $3, last_run_at = now() WHERE id = $1 AND next_run_at = $2",
+		id, due, next)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n == 1, err
+}
+
+func (s *memoryStore) SaveSchedule(schedule *Schedule) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	schedule.Id = newUUID()
+	schedule.CreatedAt = time.Now()
+	s.schedules = append(s.schedules, *schedule)
+	return nil
+}
+
+func (s *memoryStore) Schedules() ([]Schedule, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return append([]Schedule{}, s.schedules...), nil
+}
+
+func (s *memoryStore) DeleteSchedule(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var err error
+	s.schedules, err = deleteScheduleFrom(s.schedules, id)
+	return err
+}
+
+func (s *memoryStore) ClaimSchedule(id string, due, next time.Time) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return claimSchedule(s.schedules, id, due, next), nil
+}
+
+func (s *fileStore) schedulesPath() string {
+	return filepath.Join(s.dir, "schedules")
+}
+
+func (s *fileStore) readSchedules() ([]Schedule, error) {
+	var schedules []Schedule
+	err := s.readJSON(s.schedulesPath(), &schedules)
+	return schedules, err
+}
+
+func (s *fileStore) writeSchedules(schedules []Schedule) error {
+	return s.writeJSON(s.schedulesPath(), schedules)
+}
+
+func (s *fileStore) SaveSchedule(schedule *Schedule) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	schedules, err := s.readSchedules()
+	if err != nil {
+		return err
+	}
+	schedule.Id = newUUID()
+	schedule.CreatedAt = time.Now()
+	return s.writeSchedules(append(schedules, *schedule))
+}
+
+func (s *fileStore) Schedules() ([]Schedule, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.readSchedules()
+}
+
+func (s *fileStore) DeleteSchedule(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	schedules, err := s.readSchedules()
+	if err != nil {
+		return err
+	}
+	schedules, err = deleteScheduleFrom(schedules, id)
+	if err != nil {
+		return err
+	}
+	return s.writeSchedules(schedules)
+}
+
+func (s *fileStore) ClaimSchedule(id string, due, next time.Time) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	schedules, err := s.readSchedules()
+	if err != nil {
+		return false, err
+	}
+	if !claimSchedule(schedules, id, due, next) {
+		return false, nil
+	}
+	return true, s.writeSchedules(schedules)
+}
+
+func deleteScheduleFrom(schedules []Schedule, id string) ([]Schedule, error) {
+	for i, s := range schedules {
+		if s.Id == id {
+			return append(schedules[:i], schedules[i+1:]...), nil
+		}
+	}
+	return schedules, ErrScheduleNotFound
+}
+
+func claimSchedule(schedules []Schedule, id string, due, next time.Time) bool {
+	for i, s := range schedules {
+		if s.Id == id && s.NextRunAt.Equal(due) {
+			now := time.Now()
+			schedules[i].NextRunAt = next
+			schedules[i].LastRunAt = &now
+			return true
+		}
+	}
+	return false
+}
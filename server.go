@@ -12,22 +12,22 @@ import (
 	"net/url"
 	"os"
 	"regexp"
+	"strconv"
+	"strings"
 	"time"
 )
 
 type JobParams struct {
-	URL     string `json:"url" binding:"required"`
-	Metrics []struct {
-		LoadAvg1m *float64 `json:"load_avg_1m"`
-	}
-	Plan     string
-	App      string
-	Database string
-}
-
-type ResponseWithCode struct {
-	Code int
-	Body string
+	URL            string `json:"url" binding:"required"`
+	Metrics        []HostMetrics
+	Plan           string
+	App            string
+	Database       string
+	SampleWindow   int           `json:"sample_window"`
+	SampleInterval int           `json:"sample_interval"`
+	AllDatabases   bool          `json:"all_databases"`
+	TLS            TLSOptions    `json:"tls"`
+	Tunnel         TunnelOptions `json:"tunnel"`
 }
 
 var validParams = regexp.MustCompile(`\A[a-zA-Z0-9\-_]+\z`)
@@ -42,6 +42,13 @@ func (params *JobParams) sanitize() {
 	if !validParams.MatchString(params.Database) {
 		params.Database = ""
 	}
+	// sampling stops at maxSampleWindow, so waiting any longer for it
+	// would only hold the request open
+	if max := int(maxSampleWindow.Seconds()); params.SampleWindow > max {
+		params.SampleWindow = max
+	} else if params.SampleWindow < 0 {
+		params.SampleWindow = 0
+	}
 }
 
 func removePassword(s string) string {
@@ -60,96 +67,340 @@ func removePassword(s string) string {
 	return str
 }
 
-func getResultJSON(id string, db *sql.DB) (json string, err error) {
-	row := db.QueryRow("SELECT row_to_json(results, true) FROM results WHERE id = $1", id)
-	err = row.Scan(&json)
+func createJob(store ReportStore, config Config, notify notifier, params JobParams) (*Report, error) {
+	running, err := startJob(store, config, params)
 	if err != nil {
-		log.Print("%v", err)
-		return "", err
+		return nil, err
 	}
-	return json, nil
+	return runJob(store, config, notify, params, running)
 }
 
-func createJob(db *sql.DB, params JobParams) (id string, err error) {
+// startJob saves the report as running, so it can be followed while the
+// diagnosis runs.
+func startJob(store ReportStore, config Config, params JobParams) (*Report, error) {
 	params.sanitize()
 	sanitizedURL := removePassword(params.URL)
 	if sanitizedURL == "" {
-		return "", errors.New("bad postgres url")
+		return nil, errors.New("bad postgres url")
 	}
 
+	startedAt := time.Now()
+	running := &Report{
+		Status:    reportRunning,
+		App:       params.App,
+		Database:  params.Database,
+		Plan:      params.Plan,
+		URL:       sanitizedURL,
+		ExpiresAt: config.Retention.expiry(params.App, time.Now()),
+		StartedAt: &startedAt,
+	}
+	err := store.Save(running)
+	if err != nil {
+		log.Printf("%v", err)
+		return nil, err
+	}
+	return running, nil
+}
+
+// runJob diagnoses the target of a report saved by startJob, and marks the
+// report done, or failed if the diagnosis doesn't finish.
+func runJob(store ReportStore, config Config, notify notifier, params JobParams, running *Report) (report *Report, err error) {
+	params.sanitize()
 	plan := GetPlan(params.Plan)
 
-	checks, err := CheckSql(params.URL, plan)
+	defer func() {
+		if err == nil {
+			return
+		}
+		failedAt := time.Now()
+		running.Status, running.FinishedAt = reportFailed, &failedAt
+		if err := store.Update(running); err != nil {
+			log.Printf("%v", err)
+		}
+	}()
+
+	target, err := openTarget(params.URL, params.TLS.merge(config.TLS), params.Tunnel)
+	if err != nil {
+		return nil, err
+	}
+	connstring := params.URL
+	if target != nil {
+		defer target.Close()
+		connstring = target.Connstring
+	}
+
+	var checks []Check
+	var databases []databaseReport
+	var timings checkTimings
+	if params.AllDatabases {
+		checks, databases, timings, err = CheckAllDatabases(connstring, plan, config.Activity)
+	} else {
+		checks, timings, err = CheckSql(connstring, plan, config.Activity)
+	}
 	if err != nil {
-		return "", err
+		if target != nil && target.Err() != nil {
+			err = target.Err()
+		}
+		return nil, err
 	}
 
-	fmt.Println(params.Metrics)
+	serverVersion, err := ServerVersion(connstring)
+	if err != nil {
+		log.Printf("%v", err)
+	}
 
-	loadChecks := func() []Check {
-		if len(params.Metrics) > 0 {
-			return CheckLoad(params.Metrics[0].LoadAvg1m)
-		} else {
-			return CheckLoad(nil)
+	var previous *Report
+	if params.App != "" && params.Database != "" {
+		previous, err = store.Latest(params.App, params.Database)
+	}
+	if err != nil {
+		log.Printf("%v", err)
+	}
+	compareXactCheck(checks, previous)
+	for i, d := range databases {
+		compareXactCheck(d.Checks, previous.forDatabase(d.Name))
+		if d.Status != "skipped" {
+			databases[i].Status = summaryStatus(d.Checks)
 		}
-	}()
-	checks = append(checks, loadChecks...)
+	}
 
-	checksJSON, _ := PrettyJSON(checks)
+	var metrics HostMetrics
+	if len(params.Metrics) > 0 {
+		metrics = params.Metrics[0]
+		metrics.Source = metricsFromCaller
+	} else {
+		metrics, err = PullMetrics(connstring)
+		if err != nil {
+			log.Printf("%v", err)
+		}
+	}
+	checks = append(checks, CheckMetrics(metrics, plan, waitProfile(checks))...)
 
-	row := db.QueryRow(
-		"INSERT INTO results (app,database,url,checks) values ($1,$2,$3,$4) returning id",
-		params.App, params.Database, sanitizedURL, checksJSON)
+	if params.SampleWindow > 0 {
+		sampleChecks, err := SampleSql(connstring,
+			time.Duration(params.SampleInterval)*time.Second,
+			time.Duration(params.SampleWindow)*time.Second,
+			config.Activity)
+		if err != nil {
+			return nil, err
+		}
+		checks = append(checks, sampleChecks...)
+	}
 
-	err = row.Scan(&id)
+	redactChecks(allChecks(checks, databases), config.Redaction)
+	finishedAt := time.Now()
+
+	report = running
+	report.Status = reportDone
+	report.SummaryStatus = summaryStatus(allChecks(checks, databases))
+	report.Checks = checks
+	report.Databases = databases
+	report.Timings = timings
+	report.Connection = target.Info()
+	report.ServerVersion = serverVersion
+	report.FinishedAt = &finishedAt
+	err = store.Update(report)
 	if err != nil {
-		log.Print("%v", err)
-		return "", err
+		log.Printf("%v", err)
+		return nil, err
 	}
 
-	fmt.Println("new job id: ", id)
+	log.Printf("new job id: %s", report.Id)
+
+	for _, e := range reportEvents(report, previous) {
+		notify.Notify(e)
+	}
 
-	return id, nil
+	return report, nil
 }
 
-func create(params JobParams, db *sql.DB) (int, string) {
-	c := make(chan ResponseWithCode, 1)
-	go func() {
-		id, err := createJob(db, params)
+// createTimeout is how long a request waits for its report before getting
+// the running report instead, on top of any sample window.
+var createTimeout = 25 * time.Second
+
+func create(res http.ResponseWriter, params JobParams, store ReportStore, config Config, notify notifier, token *apiToken, limiter *diagnosisLimiter) (int, string) {
+	params.sanitize()
+	if params.App == "" {
+		params.App = token.App
+	}
+	if !token.canAccess(params.App) {
+		return 403, `{"error": "token can't create reports for this app"}`
+	}
+
+	target, options := diagnosisTarget(params), diagnosisOptions(params)
+	recentId, job, leader, retryAfter := limiter.acquire(target, options, time.Now())
+	switch {
+	case retryAfter > 0:
+		res.Header().Set("Retry-After", strconv.Itoa(int(retryAfter.Seconds())))
+		return 429, `{"error": "Too many diagnoses running, try again later"}`
+	case recentId != "":
+		report, err := store.Get(recentId)
 		if err != nil {
-			log.Print("%v", err)
-			c <- ResponseWithCode{500, `{"error": "Couldn't create job"}`}
+			log.Printf("%v", err)
+			return 500, `{"error": "Couldn't send report"}`
 		}
-
-		json, err2 := getResultJSON(id, db)
-		if err2 != nil {
-			log.Print("%v", err2)
-			c <- ResponseWithCode{500, `{"error": "Couldn't send report"}`}
+		return reportResponse(200, report)
+	case leader:
+		running, err := startJob(store, config, params)
+		if err != nil {
+			limiter.finish(target, options, job, nil, err, time.Now())
+			log.Printf("%v", err)
+			return 500, `{"error": "Couldn't create job"}`
 		}
+		job.start(running.Id)
+		go func() {
+			report, err := runJob(store, config, notify, params, running)
+			limiter.finish(target, options, job, report, err, time.Now())
+		}()
+	}
 
-		c <- ResponseWithCode{201, json}
-	}()
+	timeout := createTimeout
+	if params.SampleWindow > 0 {
+		timeout += time.Duration(params.SampleWindow) * time.Second
+	}
 
 	select {
-	case res := <-c:
-		return res.Code, res.Body
-	case <-time.After(time.Second * 25):
+	case <-job.done:
+		if job.err != nil {
+			log.Printf("%v", job.err)
+			return 500, `{"error": "Couldn't create job"}`
+		}
+		if leader {
+			return reportResponse(201, job.report)
+		}
+		return reportResponse(200, job.report)
+	case <-time.After(timeout):
+		// a diagnosis that takes longer, such as one of many databases,
+		// goes on, and the running report can be followed by its id
+		select {
+		case <-job.started:
+			report, err := store.Get(job.reportId)
+			if err == nil {
+				return reportResponse(202, report)
+			}
+			log.Printf("%v", err)
+		default:
+		}
 		return 500, `{"error": "Couldn't finish job in time"}`
 	}
+}
 
+func reportResponse(code int, report *Report) (int, string) {
+	json, err := PrettyJSON(report)
+	if err != nil {
+		log.Printf("%v", err)
+		return 500, `{"error": "Couldn't send report"}`
+	}
+	return code, json
 }
 
-func getReport(params martini.Params, db *sql.DB) (int, string) {
-	json, err := getResultJSON(params["id"], db)
+// findReport returns the report only if the token may see it, so that
+// scoped tokens can't tell other apps' reports from missing ones.
+func findReport(id string, store ReportStore, token *apiToken) (*Report, error) {
+	report, err := store.Get(id)
 	if err != nil {
+		return nil, err
+	}
+	if !token.canAccess(report.App) {
+		return nil, ErrReportNotFound
+	}
+	return report, nil
+}
+
+func getReport(params martini.Params, res http.ResponseWriter, req *http.Request, store ReportStore, config Config, token *apiToken) (int, string) {
+	report, err := findReport(params["id"], store, token)
+	if err != nil {
+		if err != ErrReportNotFound {
+			log.Printf("%v", err)
+		}
 		return 404, ""
 	}
 
-	return 200, json
+	query := req.URL.Query()
+	if format := query.Get("format"); format != "" {
+		return exportResponse(res, report, format, query.Get("check"), config)
+	}
+	return negotiateReport(res, req, report)
 }
 
-func health(db *sql.DB) (int, string) {
-	_, err := db.Exec("select 1")
+// exportResponse sends the report in a format asked for with ?format=,
+// which wins over the Accept header.
+func exportResponse(res http.ResponseWriter, report *Report, format, check string, config Config) (int, string) {
+	if !validExportFormat(format) {
+		return errorResponse(400, "unknown format, use one of "+strings.Join(exportFormats, ", "))
+	}
+
+	link := ""
+	if config.BaseURL != "" {
+		link = reportLink(config, report.Id)
+	}
+	body, err := exportReport(report, format, check, link)
+	if err != nil {
+		if format == formatCSV && check != "" {
+			return errorResponse(400, "the report has no check with that name")
+		}
+		log.Printf("%v", err)
+		return 500, "Couldn't export report"
+	}
+	res.Header().Set("Content-Type", contentTypes[format])
+	return 200, body
+}
+
+// errorResponse sends message as a JSON error. Messages are fixed text,
+// never request input.
+func errorResponse(code int, message string) (int, string) {
+	js, err := PrettyJSON(map[string]string{"error": message})
+	if err != nil {
+		log.Printf("%v", err)
+		return 500, ""
+	}
+	return code, js
+}
+
+// negotiateReport sends the report as an HTML page to browsers, and as
+// JSON to everyone else. Either way caches have to key on Accept.
+func negotiateReport(res http.ResponseWriter, req *http.Request, report *Report) (int, string) {
+	res.Header().Add("Vary", "Accept")
+	if !wantsHTML(req) {
+		return reportResponse(200, report)
+	}
+
+	page, err := renderHTML(report)
+	if err != nil {
+		log.Printf("%v", err)
+		return 500, "Couldn't render report"
+	}
+	res.Header().Set("Content-Type", "text/html; charset=utf-8")
+	return 200, page
+}
+
+// getReportSchema publishes the JSON Schema of ?format=envelope reports.
+func getReportSchema(res http.ResponseWriter) (int, string) {
+	schema, err := PrettyJSON(reportSchema())
+	if err != nil {
+		log.Printf("%v", err)
+		return 500, ""
+	}
+	res.Header().Set("Content-Type", "application/schema+json")
+	return 200, schema
+}
+
+func deleteReport(params martini.Params, store ReportStore, token *apiToken) (int, string) {
+	_, err := findReport(params["id"], store, token)
+	if err == nil {
+		err = store.Delete(params["id"])
+	}
+	if err != nil {
+		if err != ErrReportNotFound {
+			log.Printf("%v", err)
+		}
+		return 404, ""
+	}
+	return 204, ""
+}
+
+func health(store ReportStore) (int, string) {
+	err := store.Ping()
 	if err != nil {
 		log.Println(err)
 		return 500, "database error"
@@ -157,7 +408,7 @@ func health(db *sql.DB) (int, string) {
 	return 200, "ok"
 }
 
-func setupDB() *sql.DB {
+func setupDB() (*sql.DB, error) {
 	connstring := os.Getenv("DATABASE_URL")
 	if connstring == "" {
 		connstring = "dbname=pgdiagnose sslmode=disable"
@@ -165,17 +416,22 @@ func setupDB() *sql.DB {
 
 	db, err := sql.Open("postgres", connstring)
 	if err != nil {
-		log.Fatal(err)
+		return nil, err
 	}
 
 	_, err = db.Exec("select 1")
 	if err != nil {
-		log.Fatal(err)
+		db.Close()
+		return nil, err
 	}
-	return db
+	return db, nil
 }
 
 func main() {
+	if len(os.Args) > 1 {
+		os.Exit(runCommand(os.Args[1:]))
+	}
+
 	m := martini.Classic()
 
 	if martini.Env == "production" {
@@ -186,9 +442,39 @@ func main() {
 			}
 		})
 	}
-	m.Map(setupDB())
-	m.Post("/reports", binding.Json(JobParams{}), create)
-	m.Get("/reports/:id", getReport)
+	config, err := loadConfig()
+	if err != nil {
+		log.Fatal(err)
+	}
+	store, err := setupStore(os.Getenv("REPORT_STORE"))
+	if err != nil {
+		log.Fatal(err)
+	}
+	config.Retention.startPurger(store, time.Hour)
+	limiter := newDiagnosisLimiter(config.MaxDiagnoses, config.MaxDiagnosesPerTarget, config.DedupeWindow)
+	notify := notifiers{logNotifier{}, newWebhookNotifier(store, config)}
+	startScheduler(store, 30*time.Second, scheduledDiagnosis(store, config, notify, limiter))
+
+	m.Map(config)
+	m.Map(limiter)
+	m.MapTo(notify, (*notifier)(nil))
+	m.MapTo(store, (*ReportStore)(nil))
+	m.MapTo(store, (*TokenStore)(nil))
+	m.MapTo(store, (*ScheduleStore)(nil))
+	m.MapTo(store, (*WebhookStore)(nil))
+	m.Post("/reports", authenticate, binding.Json(JobParams{}), create)
+	m.Get("/reports/:id", authenticate, getReport)
+	m.Get("/schema/report.json", getReportSchema)
+	m.Delete("/reports/:id", authenticate, deleteReport)
+	m.Post("/reports/:id/share", authenticate, shareReport)
+	m.Get("/r/:token", getSharedReport)
+	m.Post("/schedules", authenticate, createSchedule)
+	m.Get("/schedules", authenticate, listSchedules)
+	m.Delete("/schedules/:id", authenticate, deleteSchedule)
+	m.Post("/webhooks", authenticate, createWebhook)
+	m.Get("/webhooks", authenticate, listWebhooks)
+	m.Delete("/webhooks/:id", authenticate, deleteWebhook)
+	m.Get("/webhooks/:id/deliveries", authenticate, listDeliveries)
 	m.Get("/health", health)
 	m.Run()
 }
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/go-martini/martini"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Scopes a share link can grant.
+const (
+	shareRead    = "read"
+	shareSummary = "summary"
+)
+
+const (
+	defaultShareTTL = 24 * time.Hour
+	maxShareTTL     = 7 * 24 * time.Hour
+)
+
+var (
+	errBadShareToken     = errors.New("bad share token")
+	errExpiredShareToken = errors.New("expired share token")
+)
+
+// shareClaims is what a share link grants. It is signed with the server's
+// share secret, so links can't be forged or extended.
+type shareClaims struct {
+	ReportId string `json:"id"`
+	Expires  int64  `json:"exp"`
+	Scope    string `json:"scope"`
+}
+
+func signShareToken(claims shareClaims, secret []byte) (string, error) {
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+	encoded := base64.RawURLEncoding.EncodeToString(payload)
+	return encoded + "." + base64.RawURLEncoding.EncodeToString(shareMAC(encoded, secret)), nil
+}
+
+func verifyShareToken(token string, secret []byte, now time.Time) (shareClaims, error) {
+	var claims shareClaims
+
+	parts := strings.Split(token, ".")
+	if len(parts) != 2 {
+		return claims, errBadShareToken
+	}
+	mac, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil || !hmac.Equal(mac, shareMAC(parts[0], secret)) {
+		return claims, errBadShareToken
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return claims, errBadShareToken
+	}
+	err = json.Unmarshal(payload, &claims)
+	if err != nil {
+		return claims, errBadShareToken
+	}
+
+	if now.Unix() >= claims.Expires {
+		return claims, errExpiredShareToken
+	}
+	return claims, nil
+}
+
+func shareMAC(payload string, secret []byte) []byte {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(payload))
+	return mac.Sum(nil)
+}
+
+// newShareLink returns the path of a link to the report and when it expires.
+func newShareLink(reportId, scope string, ttl time.Duration, secret []byte) (string, time.Time, error) {
+	if ttl < 0 {
+		return "", time.Time{}, fmt.Errorf("ttl can't be negative")
+	} else if ttl == 0 {
+		ttl = defaultShareTTL
+	}
+	if ttl > maxShareTTL {
+		return "", time.Time{}, fmt.Errorf("links can't last longer than %v", maxShareTTL)
+	}
+	if scope == "" {
+		scope = shareRead
+	}
+	if scope != shareRead && scope != shareSummary {
+		return "", time.Time{}, fmt.Errorf("unknown scope %q", scope)
+	}
+
+	expires := time.Now().Add(ttl)
+	token, err := signShareToken(shareClaims{reportId, expires.Unix(), scope}, secret)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	return "/r/" + token, expires, nil
+}
+
+func shareReport(params martini.Params, req *http.Request, store ReportStore, config Config, token *apiToken) (int, string) {
+	if len(config.ShareSecret) == 0 {
+		return 501, `{"error": "sharing is not configured"}`
+	}
+
+	report, err := findReport(params["id"], store, token)
+	if err != nil {
+		return 404, ""
+	}
+
+	var ttl time.Duration
+	if s := req.URL.Query().Get("ttl"); s != "" {
+		ttl, err = time.ParseDuration(s)
+		if err != nil {
+			return 400, `{"error": "bad ttl"}`
+		}
+	}
+
+	link, expires, err := newShareLink(report.Id, req.URL.Query().Get("scope"), ttl, config.ShareSecret)
+	if err != nil {
+		js, _ := json.Marshal(map[string]string{"error": err.Error()})
+		return 400, string(js)
+	}
+
+	js, err := PrettyJSON(map[string]interface{}{"url": link, "expires_at": expires})
+	if err != nil {
+		return 500, ""
+	}
+	return 201, js
+}
+
+func getSharedReport(params martini.Params, res http.ResponseWriter, req *http.Request, store ReportStore, config Config) (int, string) {
+	if len(config.ShareSecret) == 0 {
+		return 404, ""
+	}
+
+	claims, err := verifyShareToken(params["token"], config.ShareSecret, time.Now())
+	if err == errExpiredShareToken {
+		return 410, `{"error": "link expired"}`
+	} else if err != nil {
+		return 404, ""
+	}
+
+	report, err := store.Get(claims.ReportId)
+	if err != nil {
+		if err != ErrReportNotFound {
+			log.Printf("%v", err)
+		}
+		return 404, ""
+	}
+
+	// shared links never expose the connection url
+	report.URL = ""
+	if claims.Scope == shareSummary {
+		report.Checks = compactChecks(report.Checks)
+		for i := range report.Databases {
+			report.Databases[i].Checks = compactChecks(report.Databases[i].Checks)
+		}
+	}
+
+	return negotiateReport(res, req, report)
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"github.com/go-martini/martini"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestShareToken(t *testing.T) {
+	secret := []byte("secret")
+	now := time.Now()
+	claims := shareClaims{"report-id", now.Add(time.Hour).Unix(), shareRead}
+
+	token, err := signShareToken(claims, secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := verifyShareToken(token, secret, now)
+	if err != nil || got != claims {
+		t.Fatalf("expected %+v, got %+v (%v)", claims, got, err)
+	}
+
+	if _, err = verifyShareToken(token, []byte("other"), now); err != errBadShareToken {
+		t.Fatalf("expected a token signed with another secret to be rejected, got %v", err)
+	}
+
+	if _, err = verifyShareToken(token, secret, now.Add(2*time.Hour)); err != errExpiredShareToken {
+		t.Fatalf("expected an expired token to be rejected, got %v", err)
+	}
+
+	forged, _ := signShareToken(shareClaims{"report-id", now.Add(time.Hour * 1000).Unix(), shareRead}, []byte("other"))
+	tampered := strings.Split(forged, ".")[0] + "." + strings.Split(token, ".")[1]
+	if _, err = verifyShareToken(tampered, secret, now); err != errBadShareToken {
+		t.Fatalf("expected a tampered token to be rejected, got %v", err)
+	}
+
+	if _, err = verifyShareToken("garbage", secret, now); err != errBadShareToken {
+		t.Fatalf("expected garbage to be rejected, got %v", err)
+	}
+}
+
+func TestNewShareLink(t *testing.T) {
+	secret := []byte("secret")
+	link, expires, err := newShareLink("report-id", "", 0, secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(link, "/r/") || expires.Before(time.Now().Add(defaultShareTTL-time.Minute)) {
+		t.Fatalf("unexpected link %v expiring %v", link, expires)
+	}
+
+	claims, err := verifyShareToken(strings.TrimPrefix(link, "/r/"), secret, time.Now())
+	if err != nil || claims.Scope != shareRead || claims.ReportId != "report-id" {
+		t.Fatalf("unexpected claims %+v (%v)", claims, err)
+	}
+
+	if _, _, err = newShareLink("report-id", "", maxShareTTL+time.Hour, secret); err == nil {
+		t.Fatal("expected links longer than the maximum to be refused")
+	}
+
+	if _, _, err = newShareLink("report-id", "", -time.Hour, secret); err == nil {
+		t.Fatal("expected negative ttl to be refused")
+	}
+
+	if _, _, err = newShareLink("report-id", "write", time.Hour, secret); err == nil {
+		t.Fatal("expected unknown scopes to be refused")
+	}
+}
+
+func TestSharedSummaryHidesDatabaseResults(t *testing.T) {
+	secret := []byte("secret")
+	store := newMemoryStore()
+	report := &Report{
+		Checks: []Check{{"Long Queries", "red", []longQueriesResult{{1, "00:02:00", "select 1"}}}},
+		Databases: []databaseReport{
+			{"orders", "red", []Check{{"Bloat", "red", []bloatResult{{"table", "orders_items", 20, "1 GB"}}}}},
+		},
+	}
+	store.Save(report)
+
+	link, _, err := newShareLink(report.Id, shareSummary, time.Hour, secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req, _ := http.NewRequest("GET", link, nil)
+	res := httptest.NewRecorder()
+	code, body := getSharedReport(martini.Params{"token": strings.TrimPrefix(link, "/r/")}, res, req, store, Config{ShareSecret: secret})
+	if code != 200 {
+		t.Fatalf("expected 200, got %d %s", code, body)
+	}
+	if res.Header().Get("Vary") != "Accept" {
+		t.Fatalf("expected shared reports to vary on Accept, got %q", res.Header().Get("Vary"))
+	}
+	for _, hidden := range []string{"select 1", "orders_items"} {
+		if strings.Contains(body, hidden) {
+			t.Errorf("expected %q to be left out of a summary", hidden)
+		}
+	}
+	if !strings.Contains(body, `"name": "Bloat"`) {
+		t.Error("expected per database check statuses in a summary")
+	}
+}
@@ -0,0 +1,622 @@
+package main
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/lib/pq"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+type Report struct {
+	Id            string       `json:"id"`
+	CreatedAt     time.Time    `json:"created_at"`
+	Status        string       `json:"status"`
+	App           string       `json:"app"`
+	Database      string       `json:"database"`
+	Plan          string       `json:"plan"`
+	URL           string       `json:"url"`
+	SummaryStatus string       `json:"summary_status"`
+	Checks        []Check      `json:"checks"`
+	Timings       checkTimings `json:"timings"`
+	ExpiresAt     *time.Time   `json:"expires_at"`
+	CompactedAt   *time.Time   `json:"compacted_at,omitempty"`
+	// Connection records the TLS used to reach the target.
+	Connection *connectionInfo `json:"connection,omitempty"`
+	// Databases holds the per database checks of reports run on every
+	// database of a server, while Checks holds the server wide ones.
+	Databases []databaseReport `json:"databases,omitempty"`
+	// ServerVersion is the target's server_version, and StartedAt and
+	// FinishedAt bracket the diagnosis. Older reports have none of them.
+	ServerVersion string     `json:"server_version,omitempty"`
+	StartedAt     *time.Time `json:"started_at,omitempty"`
+	FinishedAt    *time.Time `json:"finished_at,omitempty"`
+}
+
+// report lifecycle, matching the report_status enum in the results database.
+// Reports are saved as running when their diagnosis starts, and updated to
+// done or failed when it ends, so the enum's pending is never used.
+const (
+	reportRunning = "running"
+	reportDone    = "done"
+	reportFailed  = "failed"
+)
+
+// done reports whether the report's diagnosis finished. Reports from before
+// the lifecycle have no status, and were only ever saved once done.
+func (r Report) done() bool {
+	return r.Status == reportDone || r.Status == ""
+}
+
+// ReportStore is where finished reports are kept. Postgres is the default,
+// the file and memory stores let the CLI, tests and small deployments run
+// without a metadata database.
+type ReportStore interface {
+	// Save assigns the report an id and creation time and stores it.
+	Save(report *Report) error
+	// Update stores the new contents of a saved report.
+	Update(report *Report) error
+	Get(id string) (*Report, error)
+	// Latest returns the most recent done report for an app and database,
+	// or nil if there is none.
+	Latest(app, database string) (*Report, error)
+	Delete(id string) error
+	// Purge deletes reports that expired before now.
+	Purge(now time.Time) (int64, error)
+	// Compact drops the raw results and URL of reports created before
+	// before, keeping the status of each check.
+	Compact(before time.Time) (int64, error)
+	Ping() error
+}
+
+// Store is everything pgdiagnose keeps in its results database.
+type Store interface {
+	ReportStore
+	TokenStore
+	ScheduleStore
+	WebhookStore
+}
+
+var ErrReportNotFound = errors.New("report not found")
+
+var validReportId = regexp.MustCompile(`\A[0-9a-f\-]+\z`)
+
+func setupStore(kind string) (Store, error) {
+	switch kind {
+	case "", "postgres":
+		db, err := setupDB()
+		if err != nil {
+			return nil, err
+		}
+		err = migrate(db)
+		if err != nil {
+			db.Close()
+			return nil, err
+		}
+		return &postgresStore{db}, nil
+	case "memory":
+		return newMemoryStore(), nil
+	case "file":
+		dir := os.Getenv("REPORT_DIR")
+		if dir == "" {
+			dir = "reports"
+		}
+		return newFileStore(dir)
+	}
+	return nil, fmt.Errorf("unknown report store %q", kind)
+}
+
+type postgresStore struct {
+	db *sql.DB
+}
+
+const reportColumns = `id, created_at, status, coalesce(app, ''), coalesce(database, ''),
+  coalesce(plan, ''), coalesce(url, ''), coalesce(summary_status, ''), checks,
+  coalesce(timings, '{}'), expires_at, compacted_at, coalesce(connection, 'null'),
+  coalesce(databases, 'null'), coalesce(server_version, ''), started_at, finished_at`
+
+func (s *postgresStore) Save(report *Report) error {
+	checksJSON, err := PrettyJSON(report.Checks)
+	if err != nil {
+		return err
+	}
+	timingsJSON, err := PrettyJSON(report.Timings)
+	if err != nil {
+		return err
+	}
+	connectionJSON, err := PrettyJSON(report.Connection)
+	if err != nil {
+		return err
+	}
+	databasesJSON, err := PrettyJSON(report.Databases)
+	if err != nil {
+		return err
+	}
+	row := s.db.QueryRow(
+		`INSERT INTO results (status,app,database,plan,url,summary_status,checks,timings,expires_at,connection,databases,
+		  server_version,started_at,finished_at)
+		values ($1,$2,$3,$4,$5,$6,$7,$8,$9,$10,$11,$12,$13,$14) returning id, created_at`,
+		report.Status, report.App, report.Database, report.Plan, report.URL,
+		report.SummaryStatus, checksJSON, timingsJSON, report.ExpiresAt, connectionJSON, databasesJSON,
+		report.ServerVersion, report.StartedAt, report.FinishedAt)
+	return row.Scan(&report.Id, &report.CreatedAt)
+}
+
+func (s *postgresStore) Update(report *Report) error {
+	checksJSON, err := PrettyJSON(report.Checks)
+	if err != nil {
+		return err
+	}
+	timingsJSON, err := PrettyJSON(report.Timings)
+	if err != nil {
+		return err
+	}
+	connectionJSON, err := PrettyJSON(report.Connection)
+	if err != nil {
+		return err
+	}
+	databasesJSON, err := PrettyJSON(report.Databases)
+	if err != nil {
+		return err
+	}
+	res, err := s.db.Exec(
+		`UPDATE results SET status = $2, summary_status = $3, checks = $4, timings = $5, expires_at = $6,
+		  connection = $7, databases = $8, server_version = $9, started_at = $10, finished_at = $11
+		WHERE id = $1`,
+		report.Id, report.Status, report.SummaryStatus, checksJSON, timingsJSON, report.ExpiresAt,
+		connectionJSON, databasesJSON, report.ServerVersion, report.StartedAt, report.FinishedAt)
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrReportNotFound
+	}
+	return nil
+}
+
+func (s *postgresStore) Get(id string) (*Report, error) {
+	row := s.db.QueryRow("SELECT "+reportColumns+" FROM results WHERE id = $1", id)
+	return scanReport(row)
+}
+
+func (s *postgresStore) Latest(app, database string) (*Report, error) {
+	row := s.db.QueryRow(
+		"SELECT "+reportColumns+" FROM results WHERE app = $1 AND database = $2 AND status = 'done' ORDER BY created_at DESC LIMIT 1",
+		app, database)
+	report, err := scanReport(row)
+	if err == ErrReportNotFound {
+		return nil, nil
+	}
+	return report, err
+}
+
+func (s *postgresStore) Delete(id string) error {
+	res, err := s.db.Exec("DELETE FROM results WHERE id = $1", id)
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrReportNotFound
+	}
+	return nil
+}
+
+func (s *postgresStore) Purge(now time.Time) (int64, error) {
+	res, err := s.db.Exec("DELETE FROM results WHERE expires_at < $1", now)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+func (s *postgresStore) Compact(before time.Time) (int64, error) {
+	res, err := s.db.Exec(`
+		UPDATE results SET
+		  checks = (
+		    SELECT coalesce(json_agg(json_build_object('name', c->>'name', 'status', c->>'status', 'results', null)), '[]')
+		    FROM json_array_elements(checks) c
+		  ),
+		  databases = (
+		    SELECT json_agg(json_build_object('name', d->>'name', 'status', d->>'status', 'checks', (
+		      SELECT coalesce(json_agg(json_build_object('name', c->>'name', 'status', c->>'status', 'results', null)), '[]')
+		      FROM json_array_elements(d->'checks') c
+		    )))
+		    FROM json_array_elements(databases) d
+		  ),
+		  url = NULL,
+		  compacted_at = now()
+		WHERE created_at < $1 AND compacted_at IS NULL`, before)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+func (s *postgresStore) Ping() error {
+	_, err := s.db.Exec("select 1")
+	return err
+}
+
+func scanReport(row *sql.Row) (*Report, error) {
+	var report Report
+	var checksJSON, timingsJSON, connectionJSON, databasesJSON string
+	var expiresAt, compactedAt, startedAt, finishedAt pq.NullTime
+	err := row.Scan(&report.Id, &report.CreatedAt, &report.Status, &report.App,
+		&report.Database, &report.Plan, &report.URL, &report.SummaryStatus,
+		&checksJSON, &timingsJSON, &expiresAt, &compactedAt, &connectionJSON, &databasesJSON,
+		&report.ServerVersion, &startedAt, &finishedAt)
+	if err == sql.ErrNoRows {
+		return nil, ErrReportNotFound
+	} else if err != nil {
+		return nil, err
+	}
+	if expiresAt.Valid {
+		report.ExpiresAt = &expiresAt.Time
+	}
+	if compactedAt.Valid {
+		report.CompactedAt = &compactedAt.Time
+	}
+	if startedAt.Valid {
+		report.StartedAt = &startedAt.Time
+	}
+	if finishedAt.Valid {
+		report.FinishedAt = &finishedAt.Time
+	}
+
+	err = json.Unmarshal([]byte(checksJSON), &report.Checks)
+	if err != nil {
+		return nil, err
+	}
+	err = json.Unmarshal([]byte(timingsJSON), &report.Timings)
+	if err != nil {
+		return nil, err
+	}
+	err = json.Unmarshal([]byte(connectionJSON), &report.Connection)
+	if err != nil {
+		return nil, err
+	}
+	err = json.Unmarshal([]byte(databasesJSON), &report.Databases)
+	if err != nil {
+		return nil, err
+	}
+	return &report, nil
+}
+
+type memoryStore struct {
+	mu         sync.Mutex
+	reports    map[string]Report
+	tokens     []apiToken
+	schedules  []Schedule
+	webhooks   []Webhook
+	deliveries []webhookDelivery
+}
+
+func newMemoryStore() *memoryStore {
+	return &memoryStore{reports: make(map[string]Report)}
+}
+
+func (s *memoryStore) Save(report *Report) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	report.Id = newUUID()
+	report.CreatedAt = time.Now()
+	s.reports[report.Id] = *report
+	return nil
+}
+
+func (s *memoryStore) Update(report *Report) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.reports[report.Id]; !ok {
+		return ErrReportNotFound
+	}
+	s.reports[report.Id] = *report
+	return nil
+}
+
+func (s *memoryStore) Get(id string) (*Report, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	report, ok := s.reports[id]
+	if !ok {
+		return nil, ErrReportNotFound
+	}
+	return &report, nil
+}
+
+func (s *memoryStore) Latest(app, database string) (*Report, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var latest *Report
+	for _, report := range s.reports {
+		if report.App != app || report.Database != database || !report.done() {
+			continue
+		}
+		if latest == nil || report.CreatedAt.After(latest.CreatedAt) {
+			r := report
+			latest = &r
+		}
+	}
+	return latest, nil
+}
+
+func (s *memoryStore) Delete(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.reports[id]; !ok {
+		return ErrReportNotFound
+	}
+	delete(s.reports, id)
+	return nil
+}
+
+func (s *memoryStore) Purge(now time.Time) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var n int64
+	for id, report := range s.reports {
+		if report.ExpiresAt != nil && report.ExpiresAt.Before(now) {
+			delete(s.reports, id)
+			n++
+		}
+	}
+	return n, nil
+}
+
+func (s *memoryStore) Compact(before time.Time) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var n int64
+	for id, report := range s.reports {
+		if report.CompactedAt == nil && report.CreatedAt.Before(before) {
+			compactReport(&report)
+			s.reports[id] = report
+			n++
+		}
+	}
+	return n, nil
+}
+
+func (s *memoryStore) Ping() error {
+	return nil
+}
+
+// fileStore keeps each report as a JSON file named after its id.
+type fileStore struct {
+	mu  sync.Mutex
+	dir string
+}
+
+func newFileStore(dir string) (*fileStore, error) {
+	err := os.MkdirAll(dir, 0700)
+	if err != nil {
+		return nil, err
+	}
+	return &fileStore{dir: dir}, nil
+}
+
+func (s *fileStore) path(id string) string {
+	return filepath.Join(s.dir, id+".json")
+}
+
+func (s *fileStore) Save(report *Report) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	report.Id = newUUID()
+	report.CreatedAt = time.Now()
+	return s.write(report)
+}
+
+func (s *fileStore) Update(report *Report) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !validReportId.MatchString(report.Id) {
+		return ErrReportNotFound
+	}
+	if _, err := os.Stat(s.path(report.Id)); os.IsNotExist(err) {
+		return ErrReportNotFound
+	}
+	return s.write(report)
+}
+
+func (s *fileStore) write(report *Report) error {
+	return s.writeJSON(s.path(report.Id), report)
+}
+
+// readJSON reads a JSON file of the store into v, leaving v alone if the
+// file doesn't exist yet.
+func (s *fileStore) readJSON(path string, v interface{}) error {
+	js, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	return json.Unmarshal(js, v)
+}
+
+// writeJSON writes v to path, through a temporary file renamed into place
+// so readers never see a partial file.
+func (s *fileStore) writeJSON(path string, v interface{}) error {
+	js, err := PrettyJSON(v)
+	if err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	err = ioutil.WriteFile(tmp, []byte(js), 0600)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+func (s *fileStore) Get(id string) (*Report, error) {
+	if !validReportId.MatchString(id) {
+		return nil, ErrReportNotFound
+	}
+
+	js, err := ioutil.ReadFile(s.path(id))
+	if os.IsNotExist(err) {
+		return nil, ErrReportNotFound
+	} else if err != nil {
+		return nil, err
+	}
+
+	var report Report
+	err = json.Unmarshal(js, &report)
+	if err != nil {
+		return nil, err
+	}
+	return &report, nil
+}
+
+func (s *fileStore) Latest(app, database string) (*Report, error) {
+	reports, err := s.all()
+	if err != nil {
+		return nil, err
+	}
+
+	for i := len(reports) - 1; i >= 0; i-- {
+		if reports[i].App == app && reports[i].Database == database && reports[i].done() {
+			return &reports[i], nil
+		}
+	}
+	return nil, nil
+}
+
+// all returns every stored report, oldest first.
+func (s *fileStore) all() ([]Report, error) {
+	names, err := filepath.Glob(filepath.Join(s.dir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+
+	var reports []Report
+	for _, name := range names {
+		report, err := s.Get(strings.TrimSuffix(filepath.Base(name), ".json"))
+		if err != nil {
+			return nil, err
+		}
+		reports = append(reports, *report)
+	}
+	sort.Sort(byCreatedAt(reports))
+	return reports, nil
+}
+
+func (s *fileStore) Delete(id string) error {
+	if !validReportId.MatchString(id) {
+		return ErrReportNotFound
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	err := os.Remove(s.path(id))
+	if os.IsNotExist(err) {
+		return ErrReportNotFound
+	}
+	return err
+}
+
+func (s *fileStore) Purge(now time.Time) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	reports, err := s.all()
+	if err != nil {
+		return 0, err
+	}
+
+	var n int64
+	for _, report := range reports {
+		if report.ExpiresAt != nil && report.ExpiresAt.Before(now) {
+			err = os.Remove(s.path(report.Id))
+			if err != nil {
+				return n, err
+			}
+			n++
+		}
+	}
+	return n, nil
+}
+
+func (s *fileStore) Compact(before time.Time) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	reports, err := s.all()
+	if err != nil {
+		return 0, err
+	}
+
+	var n int64
+	for _, report := range reports {
+		if report.CompactedAt == nil && report.CreatedAt.Before(before) {
+			compactReport(&report)
+			err = s.write(&report)
+			if err != nil {
+				return n, err
+			}
+			n++
+		}
+	}
+	return n, nil
+}
+
+func (s *fileStore) Ping() error {
+	_, err := os.Stat(s.dir)
+	return err
+}
+
+func compactReport(report *Report) {
+	now := time.Now()
+	report.Checks = compactChecks(report.Checks)
+	for i := range report.Databases {
+		report.Databases[i].Checks = compactChecks(report.Databases[i].Checks)
+	}
+	report.URL = ""
+	report.CompactedAt = &now
+}
+
+type byCreatedAt []Report
+
+func (s byCreatedAt) Len() int           { return len(s) }
+func (s byCreatedAt) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s byCreatedAt) Less(i, j int) bool { return s[i].CreatedAt.Before(s[j].CreatedAt) }
+
+func newUUID() string {
+	b := make([]byte, 16)
+	_, err := rand.Read(b)
+	if err != nil {
+		panic(err)
+	}
+	b[6] = (b[6] & 0x0f) | 0x40
+	b[8] = (b[8] & 0x3f) | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+func testReportStore(t *testing.T, store ReportStore) {
+	if err := store.Ping(); err != nil {
+		t.Fatalf("ping failed: %v", err)
+	}
+
+	latest, err := store.Latest("app", "db")
+	if err != nil || latest != nil {
+		t.Fatalf("expected no latest report in an empty store, got %v (%v)", latest, err)
+	}
+
+	first := &Report{App: "app", Database: "db", URL: "postgres://u:@h/d", Checks: []Check{{"Load", "green", nil}}}
+	if err = store.Save(first); err != nil {
+		t.Fatalf("save failed: %v", err)
+	}
+	if first.Id == "" || first.CreatedAt.IsZero() {
+		t.Fatal("expected save to assign an id and creation time")
+	}
+
+	second := &Report{App: "app", Database: "db"}
+	if err = store.Save(second); err != nil {
+		t.Fatalf("save failed: %v", err)
+	}
+	if err = store.Save(&Report{App: "other", Database: "db"}); err != nil {
+		t.Fatalf("save failed: %v", err)
+	}
+
+	got, err := store.Get(first.Id)
+	if err != nil {
+		t.Fatalf("get failed: %v", err)
+	}
+	if got.URL != first.URL || len(got.Checks) != 1 || got.Checks[0].Name != "Load" {
+		t.Fatalf("expected %+v, got %+v", first, got)
+	}
+
+	latest, err = store.Latest("app", "db")
+	if err != nil || latest == nil || latest.Id != second.Id {
+		t.Fatalf("expected %v as latest, got %+v (%v)", second.Id, latest, err)
+	}
+
+	running := &Report{Status: reportRunning, App: "app", Database: "db"}
+	if err = store.Save(running); err != nil {
+		t.Fatalf("save failed: %v", err)
+	}
+	latest, err = store.Latest("app", "db")
+	if err != nil || latest == nil || latest.Id != second.Id {
+		t.Fatalf("expected a running report not to be the latest, got %+v (%v)", latest, err)
+	}
+	running.Status, running.SummaryStatus = reportDone, "green"
+	if err = store.Update(running); err != nil {
+		t.Fatalf("update failed: %v", err)
+	}
+	latest, err = store.Latest("app", "db")
+	if err != nil || latest == nil || latest.Id != running.Id || latest.SummaryStatus != "green" {
+		t.Fatalf("expected the updated report as latest, got %+v (%v)", latest, err)
+	}
+	if err = store.Delete(running.Id); err != nil {
+		t.Fatalf("delete failed: %v", err)
+	}
+	if err = store.Update(running); err != ErrReportNotFound {
+		t.Fatalf("expected not found updating a deleted report, got %v", err)
+	}
+
+	_, err = store.Get("00000000-0000-4000-8000-000000000000")
+	if err != ErrReportNotFound {
+		t.Fatalf("expected not found, got %v", err)
+	}
+
+	if err = store.Delete(first.Id); err != nil {
+		t.Fatalf("delete failed: %v", err)
+	}
+	if _, err = store.Get(first.Id); err != ErrReportNotFound {
+		t.Fatalf("expected deleted report to be gone, got %v", err)
+	}
+	if err = store.Delete(first.Id); err != ErrReportNotFound {
+		t.Fatalf("expected not found deleting twice, got %v", err)
+	}
+
+	past := time.Now().Add(-time.Minute)
+	expiring := &Report{App: "app", Database: "db", ExpiresAt: &past}
+	if err = store.Save(expiring); err != nil {
+		t.Fatalf("save failed: %v", err)
+	}
+	if n, err := store.Purge(time.Now()); err != nil || n != 1 {
+		t.Fatalf("expected one purged report, got %v (%v)", n, err)
+	}
+
+	if n, err := store.Compact(time.Now().Add(time.Minute)); err != nil || n != 2 {
+		t.Fatalf("expected two compacted reports, got %v (%v)", n, err)
+	}
+	if n, err := store.Compact(time.Now().Add(time.Minute)); err != nil || n != 0 {
+		t.Fatalf("expected compacted reports to stay compacted, got %v (%v)", n, err)
+	}
+}
+
+func TestMemoryStore(t *testing.T) {
+	testReportStore(t, newMemoryStore())
+}
+
+func TestFileStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pgdiagnose")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	store, err := newFileStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testReportStore(t, store)
+
+	if _, err = store.Get("../../etc/passwd"); err != ErrReportNotFound {
+		t.Fatalf("expected not found for a path outside the store, got %v", err)
+	}
+}
+
+func TestSetupStoreUnknownKind(t *testing.T) {
+	if _, err := setupStore("redis"); err == nil {
+		t.Fatal("expected an error for an unknown store")
+	}
+}
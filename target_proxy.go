@@ -0,0 +1,557 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// TLSOptions configure TLS to a target database beyond what the postgres
+// driver supports. Certificates and keys are PEM.
+type TLSOptions struct {
+	Mode     string `json:"sslmode"`
+	RootCert string `json:"sslrootcert"`
+	Cert     string `json:"sslcert"`
+	Key      string `json:"sslkey"`
+}
+
+// merge returns o with empty fields filled in from defaults.
+func (o TLSOptions) merge(defaults TLSOptions) TLSOptions {
+	if o.Mode == "" {
+		o.Mode = defaults.Mode
+	}
+	if o.RootCert == "" {
+		o.RootCert = defaults.RootCert
+	}
+	if o.Cert == "" && o.Key == "" {
+		o.Cert, o.Key = defaults.Cert, defaults.Key
+	}
+	return o
+}
+
+func loadTLSOptions() (TLSOptions, error) {
+	options := TLSOptions{Mode: os.Getenv("TARGET_SSLMODE")}
+	for _, f := range []struct {
+		env string
+		pem *string
+	}{
+		{"TARGET_SSLROOTCERT", &options.RootCert},
+		{"TARGET_SSLCERT", &options.Cert},
+		{"TARGET_SSLKEY", &options.Key},
+	} {
+		path := os.Getenv(f.env)
+		if path == "" {
+			continue
+		}
+		pem, err := ioutil.ReadFile(path)
+		if err != nil {
+			return options, fmt.Errorf("%s: %v", f.env, err)
+		}
+		*f.pem = string(pem)
+	}
+	if options.Mode != "" && !validSSLMode(options.Mode) {
+		return options, fmt.Errorf("TARGET_SSLMODE: unknown mode %q", options.Mode)
+	}
+	return options, nil
+}
+
+func validSSLMode(mode string) bool {
+	switch mode {
+	case "disable", "allow", "prefer", "require", "verify-ca", "verify-full":
+		return true
+	}
+	return false
+}
+
+// connectionInfo records how pgdiagnose connected to a target, so security
+// reviewers can audit it.
+type connectionInfo struct {
+	SSLMode           string     `json:"sslmode"`
+	TLS               bool       `json:"tls"`
+	TLSVersion        string     `json:"tls_version,omitempty"`
+	CipherSuite       string     `json:"cipher_suite,omitempty"`
+	Verified          bool       `json:"verified"`
+	ServerCertSubject string     `json:"server_cert_subject,omitempty"`
+	ServerCertIssuer  string     `json:"server_cert_issuer,omitempty"`
+	ServerCertSHA256  string     `json:"server_cert_sha256,omitempty"`
+	ServerCertExpires *time.Time `json:"server_cert_expires,omitempty"`
+}
+
+const sslRequestCode = 80877103
+
+// targetProxy listens on a local port and forwards every connection to the
+// target database, doing the TLS negotiation itself. The postgres driver
+// connects to it without TLS, which lets pgdiagnose use root certificates,
+// client certificates and verify-ca, and see the server certificate.
+//
+// Other local processes can reach the port too, so the driver sends a
+// random token as a startup parameter, and the proxy only forwards
+// connections that start with it, dropping it on the way.
+type targetProxy struct {
+	listener net.Listener
+	host     string
+	addr     string
+	tls      *tls.Config
+	mode     string
+	dialer   dialFunc
+	cleanup  func()
+	token    string
+
+	// Connstring points the driver at the proxy instead of the target.
+	Connstring string
+
+	mu   sync.Mutex
+	info *connectionInfo
+	err  error
+}
+
+// openTarget starts a proxy for the database at connstring, reached through
+// tunnel if one is set. Targets on unix sockets are used as they are, and
+// get a nil proxy.
+func openTarget(connstring string, options TLSOptions, tunnel TunnelOptions) (*targetProxy, error) {
+	host, port, urlMode, err := targetAddress(connstring)
+	if err != nil {
+		return nil, err
+	}
+	if strings.HasPrefix(host, "/") {
+		if tunnel != (TunnelOptions{}) {
+			return nil, errors.New("can't tunnel to a unix socket")
+		}
+		return nil, nil
+	}
+
+	if options.Mode == "" {
+		options.Mode = urlMode
+	}
+	if options.Mode == "" {
+		options.Mode = "require"
+	}
+	if !validSSLMode(options.Mode) {
+		return nil, fmt.Errorf("unknown sslmode %q", options.Mode)
+	}
+
+	tlsConfig, err := targetTLSConfig(host, options)
+	if err != nil {
+		return nil, err
+	}
+
+	token := make([]byte, 16)
+	_, err = rand.Read(token)
+	if err != nil {
+		return nil, err
+	}
+
+	dialer, cleanup, err := tunnel.dialer()
+	if err != nil {
+		return nil, err
+	}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		cleanup()
+		return nil, err
+	}
+
+	p := &targetProxy{
+		listener: listener,
+		host:     host,
+		addr:     net.JoinHostPort(host, port),
+		tls:      tlsConfig,
+		mode:     options.Mode,
+		dialer:   dialer,
+		cleanup:  cleanup,
+		token:    hex.EncodeToString(token),
+	}
+	_, localPort, _ := net.SplitHostPort(listener.Addr().String())
+	p.Connstring = redirectConnstring(connstring, "127.0.0.1", localPort, p.token)
+
+	go p.serve()
+	return p, nil
+}
+
+func (p *targetProxy) Close() error {
+	err := p.listener.Close()
+	p.cleanup()
+	return err
+}
+
+// Err returns why the proxy couldn't reach the target, which the driver
+// only sees as a closed connection.
+func (p *targetProxy) Err() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.err
+}
+
+// Info returns how the first connection through the proxy was made.
+func (p *targetProxy) Info() *connectionInfo {
+	if p == nil {
+		return nil
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.info
+}
+
+func (p *targetProxy) serve() {
+	for {
+		local, err := p.listener.Accept()
+		if err != nil {
+			return
+		}
+		go p.forward(local)
+	}
+}
+
+func (p *targetProxy) forward(local net.Conn) {
+	defer local.Close()
+
+	local.SetDeadline(time.Now().Add(connectTimeout))
+	startup, err := readStartup(local, p.token)
+	if err != nil {
+		log.Printf("refusing a local connection to the proxy for %s: %v", p.addr, err)
+		return
+	}
+	local.SetDeadline(time.Time{})
+
+	remote, info, answer, err := p.dial(startup)
+	if err != nil {
+		err = fmt.Errorf("connecting to %s: %v", p.addr, err)
+		log.Printf("%v", err)
+		p.mu.Lock()
+		p.err = err
+		p.mu.Unlock()
+		return
+	}
+	defer remote.Close()
+
+	p.mu.Lock()
+	if p.info == nil {
+		p.info = info
+	}
+	p.mu.Unlock()
+
+	_, err = local.Write(answer)
+	if err != nil {
+		return
+	}
+
+	done := make(chan struct{}, 2)
+	go func() {
+		io.Copy(remote, local)
+		done <- struct{}{}
+	}()
+	go func() {
+		io.Copy(local, remote)
+		done <- struct{}{}
+	}()
+	<-done
+}
+
+const (
+	proxyTokenParam  = "pgdiagnose_proxy_token"
+	protocolVersion3 = 196608
+	maxStartupLength = 10000
+)
+
+// readStartup reads the startup message a local connection opens with, and
+// returns it without the proxy token, or an error if the token is missing
+// or wrong.
+func readStartup(r io.Reader, token string) ([]byte, error) {
+	header := make([]byte, 8)
+	_, err := io.ReadFull(r, header)
+	if err != nil {
+		return nil, err
+	}
+	length := binary.BigEndian.Uint32(header[0:4])
+	if length < 8 || length > maxStartupLength || binary.BigEndian.Uint32(header[4:8]) != protocolVersion3 {
+		return nil, errors.New("not a startup message")
+	}
+	body := make([]byte, length-8)
+	_, err = io.ReadFull(r, body)
+	if err != nil {
+		return nil, err
+	}
+
+	// the body is pairs of null terminated names and values, ending with
+	// an empty name
+	fields := bytes.Split(body, []byte{0})
+	message := bytes.NewBuffer(header)
+	authorized := false
+	for i := 0; i+1 < len(fields) && len(fields[i]) > 0; i += 2 {
+		if string(fields[i]) == proxyTokenParam {
+			authorized = subtle.ConstantTimeCompare(fields[i+1], []byte(token)) == 1
+			continue
+		}
+		message.Write(fields[i])
+		message.WriteByte(0)
+		message.Write(fields[i+1])
+		message.WriteByte(0)
+	}
+	if !authorized {
+		return nil, errors.New("missing or wrong proxy token")
+	}
+	message.WriteByte(0)
+
+	startup := message.Bytes()
+	binary.BigEndian.PutUint32(startup[0:4], uint32(len(startup)))
+	return startup, nil
+}
+
+// connectTimeout bounds negotiating TLS with a target, so one that accepts
+// connections and then says nothing can't hold up a diagnosis.
+var connectTimeout = 10 * time.Second
+
+// dial connects to the target the way libpq would for the proxy's sslmode
+// and sends it startup. It returns the first byte of the answer, which the
+// caller has to pass on before anything else.
+//
+// With allow, libpq tries without TLS first and again with TLS if the
+// server turns the connection down, and prefer is the other way round: TLS
+// first, and again without if the server refuses TLS or turns the
+// connection down. The server turns a connection down with an error
+// message as the answer to startup.
+func (p *targetProxy) dial(startup []byte) (net.Conn, *connectionInfo, []byte, error) {
+	switch p.mode {
+	case "disable":
+		return p.connect(startup, false, false)
+	case "allow":
+		conn, info, answer, err := p.connect(startup, false, false)
+		if err == nil && answer[0] != 'E' {
+			return conn, info, answer, nil
+		}
+		if conn != nil {
+			conn.Close()
+		}
+		return p.connect(startup, true, false)
+	case "prefer":
+		conn, info, answer, err := p.connect(startup, true, true)
+		if err == nil && (answer[0] != 'E' || !info.TLS) {
+			return conn, info, answer, nil
+		}
+		if conn != nil {
+			conn.Close()
+		}
+		return p.connect(startup, false, false)
+	default:
+		return p.connect(startup, true, false)
+	}
+}
+
+// connect makes one attempt at dial, with TLS or without. When TLS is
+// optional and the server refuses it, the attempt goes on without.
+func (p *targetProxy) connect(startup []byte, useTLS, optional bool) (net.Conn, *connectionInfo, []byte, error) {
+	info := &connectionInfo{SSLMode: p.mode}
+
+	conn, err := p.dialer(p.addr)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	err = conn.SetDeadline(time.Now().Add(connectTimeout))
+	if err != nil {
+		conn.Close()
+		return nil, nil, nil, err
+	}
+
+	if useTLS {
+		conn, err = p.negotiateTLS(conn, info, optional)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+	}
+
+	answer := make([]byte, 1)
+	_, err = conn.Write(startup)
+	if err == nil {
+		_, err = io.ReadFull(conn, answer)
+	}
+	if err == nil {
+		err = conn.SetDeadline(time.Time{})
+	}
+	if err != nil {
+		conn.Close()
+		return nil, nil, nil, err
+	}
+	return conn, info, answer, nil
+}
+
+// negotiateTLS asks the server on conn for TLS and records how it went in
+// info. It closes conn if that fails.
+func (p *targetProxy) negotiateTLS(conn net.Conn, info *connectionInfo, optional bool) (net.Conn, error) {
+	request := make([]byte, 8)
+	binary.BigEndian.PutUint32(request[0:4], 8)
+	binary.BigEndian.PutUint32(request[4:8], sslRequestCode)
+	_, err := conn.Write(request)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	answer := make([]byte, 1)
+	_, err = io.ReadFull(conn, answer)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if answer[0] != 'S' {
+		if optional {
+			return conn, nil
+		}
+		conn.Close()
+		return nil, errors.New("server does not support TLS")
+	}
+
+	tlsConn := tls.Client(conn, p.tls)
+	err = tlsConn.Handshake()
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	state := tlsConn.ConnectionState()
+	info.TLS = true
+	info.TLSVersion = tls.VersionName(state.Version)
+	info.CipherSuite = tls.CipherSuiteName(state.CipherSuite)
+	info.Verified = !p.tls.InsecureSkipVerify || p.tls.VerifyPeerCertificate != nil
+	if len(state.PeerCertificates) > 0 {
+		cert := state.PeerCertificates[0]
+		sum := sha256.Sum256(cert.Raw)
+		info.ServerCertSubject = cert.Subject.String()
+		info.ServerCertIssuer = cert.Issuer.String()
+		info.ServerCertSHA256 = hex.EncodeToString(sum[:])
+		info.ServerCertExpires = &cert.NotAfter
+	}
+	return tlsConn, nil
+}
+
+func targetTLSConfig(host string, options TLSOptions) (*tls.Config, error) {
+	config := &tls.Config{ServerName: host}
+
+	var roots *x509.CertPool
+	if options.RootCert != "" {
+		roots = x509.NewCertPool()
+		if !roots.AppendCertsFromPEM([]byte(options.RootCert)) {
+			return nil, errors.New("no certificates found in sslrootcert")
+		}
+		config.RootCAs = roots
+	}
+
+	if options.Cert != "" || options.Key != "" {
+		cert, err := tls.X509KeyPair([]byte(options.Cert), []byte(options.Key))
+		if err != nil {
+			return nil, fmt.Errorf("bad sslcert or sslkey: %v", err)
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+
+	switch options.Mode {
+	case "verify-full":
+	case "verify-ca":
+		config.InsecureSkipVerify = true
+		config.VerifyPeerCertificate = verifyChainOnly(roots)
+	case "require":
+		// like libpq, require verifies the chain when given a root cert
+		config.InsecureSkipVerify = true
+		if roots != nil {
+			config.VerifyPeerCertificate = verifyChainOnly(roots)
+		}
+	default:
+		config.InsecureSkipVerify = true
+	}
+	return config, nil
+}
+
+// verifyChainOnly checks the server certificate was issued by one of roots,
+// or the system roots if nil, without checking the host name.
+func verifyChainOnly(roots *x509.CertPool) func([][]byte, [][]*x509.Certificate) error {
+	return func(raw [][]byte, _ [][]*x509.Certificate) error {
+		if len(raw) == 0 {
+			return errors.New("server sent no certificate")
+		}
+		certs := make([]*x509.Certificate, len(raw))
+		for i, der := range raw {
+			cert, err := x509.ParseCertificate(der)
+			if err != nil {
+				return err
+			}
+			certs[i] = cert
+		}
+
+		intermediates := x509.NewCertPool()
+		for _, cert := range certs[1:] {
+			intermediates.AddCert(cert)
+		}
+		_, err := certs[0].Verify(x509.VerifyOptions{Roots: roots, Intermediates: intermediates})
+		return err
+	}
+}
+
+// targetAddress returns the host, port and sslmode of a postgres:// url or
+// key=value connection string, with the driver's defaults.
+func targetAddress(connstring string) (host, port, sslmode string, err error) {
+	host, port = "localhost", "5432"
+
+	if strings.HasPrefix(connstring, "postgres://") || strings.HasPrefix(connstring, "postgresql://") {
+		u, err := url.Parse(connstring)
+		if err != nil {
+			return "", "", "", err
+		}
+		if h := u.Hostname(); h != "" {
+			host = h
+		}
+		if p := u.Port(); p != "" {
+			port = p
+		}
+		return host, port, u.Query().Get("sslmode"), nil
+	}
+
+	for _, field := range strings.Fields(connstring) {
+		parts := strings.SplitN(field, "=", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		value := strings.Trim(parts[1], "'")
+		switch parts[0] {
+		case "host":
+			host = value
+		case "port":
+			port = value
+		case "sslmode":
+			sslmode = value
+		}
+	}
+	return host, port, sslmode, nil
+}
+
+// redirectConnstring points connstring at host and port without TLS, which
+// the proxy there takes care of, sending it token.
+func redirectConnstring(connstring, host, port, token string) string {
+	if strings.HasPrefix(connstring, "postgres://") || strings.HasPrefix(connstring, "postgresql://") {
+		u, err := url.Parse(connstring)
+		if err != nil {
+			return connstring
+		}
+		u.Host = net.JoinHostPort(host, port)
+		q := u.Query()
+		q.Set("sslmode", "disable")
+		q.Set(proxyTokenParam, token)
+		u.RawQuery = q.Encode()
+		return u.String()
+	}
+	return fmt.Sprintf("%s host=%s port=%s sslmode=disable %s=%s", connstring, host, port, proxyTokenParam, token)
+}
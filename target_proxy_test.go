@@ -0,0 +1,367 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/binary"
+	"encoding/pem"
+	"io"
+	"math/big"
+	"net"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testCA issues a certificate for host signed by a throwaway CA, and
+// returns the CA and the server certificate as PEM.
+func testCA(t *testing.T, host string) (caPEM string, cert tls.Certificate) {
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caTemplate := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, caTemplate, caTemplate, &caKey.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: host},
+		DNSNames:     []string{host},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, caTemplate, &key.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	caPEM = string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: caDER}))
+	return caPEM, tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+// fakeTLSPostgres answers SSLRequests like postgres and then echoes
+// whatever it reads over TLS.
+func fakeTLSPostgres(t *testing.T, cert tls.Certificate) string {
+	return fakePostgres(t, &cert, false)
+}
+
+// fakePostgres answers SSLRequests like postgres, refusing TLS when cert is
+// nil, and then echoes whatever it reads. Without plaintext it turns down
+// connections that don't use TLS, as a hostssl line in pg_hba.conf would.
+func fakePostgres(t *testing.T, cert *tls.Certificate, plaintext bool) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				for {
+					header := make([]byte, 8)
+					if _, err := io.ReadFull(conn, header); err != nil {
+						return
+					}
+					if binary.BigEndian.Uint32(header[4:8]) == sslRequestCode {
+						if cert == nil {
+							conn.Write([]byte("N"))
+							continue
+						}
+						conn.Write([]byte("S"))
+						tlsConn := tls.Server(conn, &tls.Config{Certificates: []tls.Certificate{*cert}})
+						io.Copy(tlsConn, tlsConn)
+						return
+					}
+					if !plaintext {
+						conn.Write([]byte("E\x00\x00\x00\x0cSFATAL\x00\x00"))
+						return
+					}
+					conn.Write(header)
+					io.Copy(conn, conn)
+					return
+				}
+			}()
+		}
+	}()
+	t.Cleanup(func() { listener.Close() })
+	_, port, _ := net.SplitHostPort(listener.Addr().String())
+	return port
+}
+
+// startupMessage is a postgres startup message with the given names and
+// values.
+func startupMessage(params ...string) []byte {
+	message := []byte{0, 0, 0, 0, 0, 3, 0, 0}
+	for _, p := range params {
+		message = append(append(message, p...), 0)
+	}
+	message = append(message, 0)
+	binary.BigEndian.PutUint32(message[0:4], uint32(len(message)))
+	return message
+}
+
+// roundTrip sends a startup message with the proxy's token through p to
+// a fake server that echoes it, and checks it comes back without the token.
+func roundTrip(t *testing.T, p *targetProxy) error {
+	u, err := url.Parse(p.Connstring)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := net.Dial("tcp", u.Host)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	conn.Write(startupMessage("user", "u", proxyTokenParam, u.Query().Get(proxyTokenParam)))
+	expected := startupMessage("user", "u")
+	answer := make([]byte, len(expected))
+	_, err = io.ReadFull(conn, answer)
+	if err == nil && !bytes.Equal(answer, expected) {
+		t.Fatalf("expected the startup message without the token, got %q", answer)
+	}
+	return err
+}
+
+func TestTargetProxyTLS(t *testing.T) {
+	caPEM, cert := testCA(t, "localhost")
+	port := fakeTLSPostgres(t, cert)
+	url := "postgres://u@localhost:" + port + "/db"
+
+	tests := []struct {
+		options  TLSOptions
+		ok       bool
+		verified bool
+	}{
+		{TLSOptions{Mode: "require"}, true, false},
+		{TLSOptions{Mode: "require", RootCert: caPEM}, true, true},
+		{TLSOptions{Mode: "verify-ca", RootCert: caPEM}, true, true},
+		{TLSOptions{Mode: "verify-full", RootCert: caPEM}, true, true},
+		// not signed by a system root
+		{TLSOptions{Mode: "verify-full"}, false, false},
+		{TLSOptions{Mode: "verify-ca"}, false, false},
+	}
+
+	for i, test := range tests {
+		p, err := openTarget(url, test.options, TunnelOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = roundTrip(t, p)
+		p.Close()
+
+		if (err == nil) != test.ok {
+			t.Errorf("%d. Expected ok %v, but got %v", i, test.ok, err)
+			continue
+		}
+		if !test.ok {
+			if p.Err() == nil {
+				t.Errorf("%d. Expected the proxy to keep the connection error", i)
+			}
+			continue
+		}
+		info := p.Info()
+		if info == nil || !info.TLS || info.Verified != test.verified || info.ServerCertSubject != "CN=localhost" {
+			t.Errorf("%d. Unexpected connection info %+v", i, info)
+		}
+	}
+}
+
+func TestTargetProxyFallsBack(t *testing.T) {
+	_, cert := testCA(t, "localhost")
+	both := fakePostgres(t, &cert, true)
+	noTLS := fakePostgres(t, nil, true)
+	onlyTLS := fakePostgres(t, &cert, false)
+
+	tests := []struct {
+		port    string
+		mode    string
+		usesTLS bool
+	}{
+		// allow tries without TLS first
+		{both, "allow", false},
+		{noTLS, "allow", false},
+		{onlyTLS, "allow", true},
+		// prefer tries with TLS first
+		{both, "prefer", true},
+		{noTLS, "prefer", false},
+		{onlyTLS, "prefer", true},
+		{noTLS, "disable", false},
+	}
+
+	for i, test := range tests {
+		p, err := openTarget("postgres://u@localhost:"+test.port+"/db", TLSOptions{Mode: test.mode}, TunnelOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = roundTrip(t, p)
+		p.Close()
+
+		if err != nil {
+			t.Errorf("%d. Expected %v to connect, but got %v", i, test.mode, err)
+			continue
+		}
+		if info := p.Info(); info == nil || info.TLS != test.usesTLS {
+			t.Errorf("%d. Expected TLS %v, but was %+v", i, test.usesTLS, info)
+		}
+	}
+}
+
+func TestTargetProxyRequiresTLS(t *testing.T) {
+	p, err := openTarget("postgres://u@localhost:"+fakePostgres(t, nil, true)+"/db", TLSOptions{Mode: "require"}, TunnelOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+	if roundTrip(t, p) == nil || p.Err() == nil {
+		t.Fatal("expected require to refuse a server without TLS")
+	}
+}
+
+func TestTargetProxyVerifiesHostName(t *testing.T) {
+	caPEM, cert := testCA(t, "db.example.com")
+	port := fakeTLSPostgres(t, cert)
+	url := "postgres://u@localhost:" + port + "/db"
+
+	p, _ := openTarget(url, TLSOptions{Mode: "verify-full", RootCert: caPEM}, TunnelOptions{})
+	if roundTrip(t, p) == nil {
+		t.Fatal("expected verify-full to reject a certificate for another host")
+	}
+	p.Close()
+
+	p, _ = openTarget(url, TLSOptions{Mode: "verify-ca", RootCert: caPEM}, TunnelOptions{})
+	if err := roundTrip(t, p); err != nil {
+		t.Fatalf("expected verify-ca to accept a certificate for another host, got %v", err)
+	}
+	p.Close()
+}
+
+func TestTargetProxyTimesOut(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		for {
+			// accept and never answer the SSLRequest
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+
+	defer func(timeout time.Duration) { connectTimeout = timeout }(connectTimeout)
+	connectTimeout = 100 * time.Millisecond
+
+	_, port, _ := net.SplitHostPort(listener.Addr().String())
+	p, err := openTarget("postgres://u@localhost:"+port+"/db", TLSOptions{Mode: "require"}, TunnelOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+
+	done := make(chan error, 1)
+	go func() { done <- roundTrip(t, p) }()
+	select {
+	case <-done:
+	case <-time.After(3 * time.Second):
+		t.Fatal("expected the proxy to give up on a target that never answers")
+	}
+	if p.Err() == nil || !strings.Contains(p.Err().Error(), "timeout") {
+		t.Fatalf("expected a timeout, got %v", p.Err())
+	}
+}
+
+func TestTargetProxyRefusesOtherClients(t *testing.T) {
+	_, cert := testCA(t, "localhost")
+	port := fakeTLSPostgres(t, cert)
+	p, err := openTarget("postgres://u@localhost:"+port+"/db", TLSOptions{Mode: "require"}, TunnelOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+
+	u, _ := url.Parse(p.Connstring)
+	for i, message := range [][]byte{
+		startupMessage("user", "u"),
+		startupMessage("user", "u", proxyTokenParam, "guess"),
+		[]byte("GET / HTTP/1.0\r\n\r\n"),
+	} {
+		conn, err := net.Dial("tcp", u.Host)
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		conn.Write(message)
+		if n, err := conn.Read(make([]byte, 1)); n != 0 || err == nil {
+			t.Errorf("%d. Expected the connection to be closed, got %d bytes (%v)", i, n, err)
+		}
+		conn.Close()
+	}
+	if p.Info() != nil {
+		t.Fatal("expected no connection to the target")
+	}
+}
+
+func TestTargetAddress(t *testing.T) {
+	tests := []struct {
+		connstring string
+		host, port string
+		sslmode    string
+	}{
+		{"postgres://u:p@db.example.com:5433/d?sslmode=verify-full", "db.example.com", "5433", "verify-full"},
+		{"postgres://u@db.example.com/d", "db.example.com", "5432", ""},
+		{"dbname=d host=/tmp sslmode=disable", "/tmp", "5432", "disable"},
+		{"dbname=d", "localhost", "5432", ""},
+	}
+
+	for i, test := range tests {
+		host, port, sslmode, err := targetAddress(test.connstring)
+		if err != nil || host != test.host || port != test.port || sslmode != test.sslmode {
+			t.Errorf("%d. Expected %s %s %s, but was %s %s %s (%v)", i, test.host, test.port, test.sslmode, host, port, sslmode, err)
+		}
+	}
+}
+
+func TestRedirectConnstring(t *testing.T) {
+	s := redirectConnstring("postgres://u:p@db.example.com:5433/d?sslmode=verify-full", "127.0.0.1", "6000", "tok")
+	if s != "postgres://u:p@127.0.0.1:6000/d?pgdiagnose_proxy_token=tok&sslmode=disable" {
+		t.Errorf("Unexpected url %s", s)
+	}
+
+	s = redirectConnstring("dbname=d host=db.example.com", "127.0.0.1", "6000", "tok")
+	if s != "dbname=d host=db.example.com host=127.0.0.1 port=6000 sslmode=disable pgdiagnose_proxy_token=tok" {
+		t.Errorf("Unexpected connection string %s", s)
+	}
+}
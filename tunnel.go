@@ -0,0 +1,372 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// TunnelOptions reach a target that isn't directly reachable, through either
+// an SSH jump host or a SOCKS5 proxy.
+type TunnelOptions struct {
+	// SSH is the jump host as user@host[:port]. SSHKey is the PEM private
+	// key to log in with, and SSHKnownHosts the known_hosts lines to check
+	// the jump host against, which default to the system's.
+	SSH           string `json:"ssh"`
+	SSHKey        string `json:"ssh_key"`
+	SSHKnownHosts string `json:"ssh_known_hosts"`
+
+	// SOCKS5 is the proxy as socks5://[user:password@]host:port.
+	SOCKS5 string `json:"socks5"`
+}
+
+type dialFunc func(addr string) (net.Conn, error)
+
+const tunnelTimeout = 10 * time.Second
+
+// sshCommand is the ssh client, which tests replace.
+var sshCommand = "ssh"
+
+func directDial(addr string) (net.Conn, error) {
+	return net.DialTimeout("tcp", addr, tunnelTimeout)
+}
+
+func noCleanup() {}
+
+// dialer returns how to reach addresses through the tunnel, and a cleanup
+// to call once done with it.
+func (o TunnelOptions) dialer() (dialFunc, func(), error) {
+	switch {
+	case o.SSH != "" && o.SOCKS5 != "":
+		return nil, nil, errors.New("tunnel through either ssh or socks5, not both")
+	case o.SSH != "":
+		if o.SSHKey == "" {
+			return nil, nil, errors.New("ssh tunnel needs ssh_key")
+		}
+		tunnel, err := newSSHTunnel(o)
+		if err != nil {
+			return nil, nil, err
+		}
+		return tunnel.dial, tunnel.close, nil
+	case o.SOCKS5 != "":
+		proxy, err := url.Parse(o.SOCKS5)
+		if err != nil {
+			return nil, nil, err
+		}
+		if proxy.Scheme != "socks5" || proxy.Host == "" {
+			return nil, nil, fmt.Errorf("expected socks5://host:port, got %q", o.SOCKS5)
+		}
+		return func(addr string) (net.Conn, error) {
+			return socks5Dial(proxy, addr)
+		}, noCleanup, nil
+	}
+	return directDial, noCleanup, nil
+}
+
+// socks5Dial connects to addr through the proxy, letting the proxy resolve
+// the host name since private names often only resolve behind it.
+func socks5Dial(proxy *url.URL, addr string) (net.Conn, error) {
+	host, portString, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.Atoi(portString)
+	if err != nil {
+		return nil, err
+	}
+	if len(host) > 255 {
+		return nil, errors.New("host name too long for socks5")
+	}
+
+	conn, err := net.DialTimeout("tcp", proxy.Host, tunnelTimeout)
+	if err != nil {
+		return nil, err
+	}
+	conn.SetDeadline(time.Now().Add(tunnelTimeout))
+
+	err = socks5Handshake(conn, proxy.User, host, port)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("socks5 proxy %s: %v", proxy.Host, err)
+	}
+	conn.SetDeadline(time.Time{})
+	return conn, nil
+}
+
+func socks5Handshake(conn net.Conn, user *url.Userinfo, host string, port int) error {
+	method := byte(0x00)
+	if user != nil {
+		method = 0x02
+	}
+	_, err := conn.Write([]byte{5, 1, method})
+	if err != nil {
+		return err
+	}
+
+	reply := make([]byte, 2)
+	if _, err = io.ReadFull(conn, reply); err != nil {
+		return err
+	}
+	if reply[0] != 5 || reply[1] != method {
+		return errors.New("no acceptable authentication method")
+	}
+
+	if user != nil {
+		password, _ := user.Password()
+		name := user.Username()
+		if len(name) > 255 || len(password) > 255 {
+			return errors.New("user name or password too long")
+		}
+		auth := []byte{1, byte(len(name))}
+		auth = append(auth, name...)
+		auth = append(auth, byte(len(password)))
+		auth = append(auth, password...)
+		if _, err = conn.Write(auth); err != nil {
+			return err
+		}
+		if _, err = io.ReadFull(conn, reply); err != nil {
+			return err
+		}
+		if reply[1] != 0 {
+			return errors.New("authentication failed")
+		}
+	}
+
+	request := []byte{5, 1, 0, 3, byte(len(host))}
+	request = append(request, host...)
+	request = append(request, 0, 0)
+	binary.BigEndian.PutUint16(request[len(request)-2:], uint16(port))
+	if _, err = conn.Write(request); err != nil {
+		return err
+	}
+
+	header := make([]byte, 4)
+	if _, err = io.ReadFull(conn, header); err != nil {
+		return err
+	}
+	if header[1] != 0 {
+		return fmt.Errorf("connect failed with code %d", header[1])
+	}
+
+	// skip the bound address, which we don't need
+	var skip int
+	switch header[3] {
+	case 1:
+		skip = net.IPv4len
+	case 4:
+		skip = net.IPv6len
+	case 3:
+		length := make([]byte, 1)
+		if _, err = io.ReadFull(conn, length); err != nil {
+			return err
+		}
+		skip = int(length[0])
+	default:
+		return errors.New("bad address type in reply")
+	}
+	_, err = io.ReadFull(conn, make([]byte, skip+2))
+	return err
+}
+
+// sshTunnel reaches addresses through the jump host. Its key and known
+// hosts are written once to a private directory, which close removes.
+type sshTunnel struct {
+	jumpHost       string
+	dir            string
+	keyFile        string
+	knownHostsFile string
+}
+
+func newSSHTunnel(o TunnelOptions) (*sshTunnel, error) {
+	dir, err := ioutil.TempDir("", "pgdiagnose-ssh")
+	if err != nil {
+		return nil, err
+	}
+	t := &sshTunnel{jumpHost: o.SSH, dir: dir, keyFile: filepath.Join(dir, "key")}
+
+	err = writePrivateFile(t.keyFile, o.SSHKey)
+	if err == nil && o.SSHKnownHosts != "" {
+		t.knownHostsFile = filepath.Join(dir, "known_hosts")
+		err = writePrivateFile(t.knownHostsFile, o.SSHKnownHosts)
+	}
+	if err != nil {
+		t.close()
+		return nil, err
+	}
+	return t, nil
+}
+
+func (t *sshTunnel) close() {
+	os.RemoveAll(t.dir)
+}
+
+// dial connects to addr with the ssh client's stdio forwarding, like a
+// ProxyJump would.
+func (t *sshTunnel) dial(addr string) (net.Conn, error) {
+	args, err := sshArgs(t.jumpHost, t.keyFile, t.knownHostsFile, addr)
+	if err != nil {
+		return nil, err
+	}
+
+	cmd := exec.Command(sshCommand, args...)
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	err = cmd.Start()
+	if err != nil {
+		return nil, err
+	}
+	return &sshConn{cmd: cmd, stdin: stdin, stdout: stdout}, nil
+}
+
+func sshArgs(jumpHost, keyFile, knownHostsFile, addr string) ([]string, error) {
+	at := strings.LastIndex(jumpHost, "@")
+	if at <= 0 {
+		return nil, fmt.Errorf("expected user@host for the ssh jump host, got %q", jumpHost)
+	}
+	user, hostPort := jumpHost[:at], jumpHost[at+1:]
+	host, port, err := net.SplitHostPort(hostPort)
+	if err != nil {
+		host, port = hostPort, "22"
+	}
+
+	args := []string{
+		"-o", "BatchMode=yes",
+		"-o", "ExitOnForwardFailure=yes",
+		"-o", fmt.Sprintf("ConnectTimeout=%d", int(tunnelTimeout.Seconds())),
+		"-o", "IdentitiesOnly=yes",
+		"-i", keyFile,
+	}
+	if knownHostsFile != "" {
+		args = append(args, "-o", "StrictHostKeyChecking=yes", "-o", "UserKnownHostsFile="+knownHostsFile)
+	}
+	args = append(args, "-p", port, "-l", user, "-W", addr, "--", host)
+	return args, nil
+}
+
+// writePrivateFile writes content to a new file only the owner can read,
+// ending it with a newline as ssh expects.
+func writePrivateFile(name, content string) error {
+	if !strings.HasSuffix(content, "\n") {
+		content += "\n"
+	}
+	return ioutil.WriteFile(name, []byte(content), 0600)
+}
+
+// sshConn is a connection over an ssh client's stdin and stdout. Pipes to a
+// process can't time out, so a deadline that passes kills the client
+// instead, which ends the connection for good.
+type sshConn struct {
+	cmd    *exec.Cmd
+	stdin  io.WriteCloser
+	stdout io.ReadCloser
+
+	mu         sync.Mutex
+	readTimer  *time.Timer
+	writeTimer *time.Timer
+	expired    bool
+}
+
+func (c *sshConn) Read(b []byte) (int, error) {
+	n, err := c.stdout.Read(b)
+	return n, c.timeoutErr(err)
+}
+
+func (c *sshConn) Write(b []byte) (int, error) {
+	n, err := c.stdin.Write(b)
+	return n, c.timeoutErr(err)
+}
+
+func (c *sshConn) Close() error {
+	c.mu.Lock()
+	stopTimer(c.readTimer)
+	stopTimer(c.writeTimer)
+	c.mu.Unlock()
+
+	c.stdin.Close()
+	c.cmd.Process.Kill()
+	c.cmd.Wait()
+	return nil
+}
+
+func (c *sshConn) LocalAddr() net.Addr  { return sshAddr{} }
+func (c *sshConn) RemoteAddr() net.Addr { return sshAddr{} }
+
+func (c *sshConn) SetDeadline(t time.Time) error {
+	c.SetReadDeadline(t)
+	return c.SetWriteDeadline(t)
+}
+
+func (c *sshConn) SetReadDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.setTimer(&c.readTimer, t)
+}
+
+func (c *sshConn) SetWriteDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.setTimer(&c.writeTimer, t)
+}
+
+// setTimer replaces timer with one that expires the connection at t, or
+// none for the zero time. It's called with c.mu held.
+func (c *sshConn) setTimer(timer **time.Timer, t time.Time) error {
+	if c.expired {
+		return os.ErrDeadlineExceeded
+	}
+	stopTimer(*timer)
+	*timer = nil
+	if !t.IsZero() {
+		*timer = time.AfterFunc(time.Until(t), c.expire)
+	}
+	return nil
+}
+
+func (c *sshConn) expire() {
+	c.mu.Lock()
+	c.expired = true
+	c.mu.Unlock()
+	c.cmd.Process.Kill()
+}
+
+// timeoutErr reports errors after the client was killed for a passed
+// deadline as timeouts, like a net.Conn would.
+func (c *sshConn) timeoutErr(err error) error {
+	if err == nil {
+		return nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.expired {
+		return os.ErrDeadlineExceeded
+	}
+	return err
+}
+
+func stopTimer(timer *time.Timer) {
+	if timer != nil {
+		timer.Stop()
+	}
+}
+
+type sshAddr struct{}
+
+func (sshAddr) Network() string { return "ssh" }
+func (sshAddr) String() string  { return "ssh" }
@@ -0,0 +1,294 @@
+package main
+
+import (
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// fakeSOCKS5 accepts user/password authentication as u/p and connects to
+// whatever it's asked to, recording the requested addresses.
+func fakeSOCKS5(t *testing.T, requested chan<- string) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go serveSOCKS5(conn, requested)
+		}
+	}()
+	t.Cleanup(func() { listener.Close() })
+	return listener.Addr().String()
+}
+
+func serveSOCKS5(conn net.Conn, requested chan<- string) {
+	defer conn.Close()
+	greeting := make([]byte, 3)
+	if _, err := io.ReadFull(conn, greeting); err != nil || greeting[2] != 2 {
+		conn.Write([]byte{5, 0xff})
+		return
+	}
+	conn.Write([]byte{5, 2})
+
+	read := func() string {
+		length := make([]byte, 1)
+		io.ReadFull(conn, length)
+		b := make([]byte, length[0])
+		io.ReadFull(conn, b)
+		return string(b)
+	}
+	io.ReadFull(conn, make([]byte, 1))
+	user, password := read(), read()
+	if user != "u" || password != "p" {
+		conn.Write([]byte{1, 1})
+		return
+	}
+	conn.Write([]byte{1, 0})
+
+	io.ReadFull(conn, make([]byte, 4))
+	host := read()
+	port := make([]byte, 2)
+	io.ReadFull(conn, port)
+	addr := net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(port))))
+	requested <- addr
+
+	target, err := net.Dial("tcp", addr)
+	if err != nil {
+		conn.Write([]byte{5, 5, 0, 1, 0, 0, 0, 0, 0, 0})
+		return
+	}
+	defer target.Close()
+	conn.Write([]byte{5, 0, 0, 1, 127, 0, 0, 1, 0, 0})
+
+	go io.Copy(target, conn)
+	io.Copy(conn, target)
+}
+
+func TestTargetProxySOCKS5(t *testing.T) {
+	caPEM, cert := testCA(t, "localhost")
+	port := fakeTLSPostgres(t, cert)
+	requested := make(chan string, 1)
+	proxy := fakeSOCKS5(t, requested)
+
+	p, err := openTarget("postgres://u@localhost:"+port+"/db",
+		TLSOptions{Mode: "verify-full", RootCert: caPEM},
+		TunnelOptions{SOCKS5: "socks5://u:p@" + proxy})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+
+	if err = roundTrip(t, p); err != nil {
+		t.Fatal(err)
+	}
+	if addr := <-requested; addr != "localhost:"+port {
+		t.Fatalf("expected the proxy to resolve localhost:%s, but was asked for %s", port, addr)
+	}
+}
+
+func TestSOCKS5BadPassword(t *testing.T) {
+	requested := make(chan string, 1)
+	proxy := fakeSOCKS5(t, requested)
+
+	dial, _, err := TunnelOptions{SOCKS5: "socks5://u:wrong@" + proxy}.dialer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = dial("localhost:5432"); err == nil {
+		t.Fatal("expected a wrong socks5 password to fail")
+	}
+}
+
+func TestTunnelDialer(t *testing.T) {
+	tests := []struct {
+		options TunnelOptions
+		ok      bool
+	}{
+		{TunnelOptions{}, true},
+		{TunnelOptions{SOCKS5: "socks5://proxy:1080"}, true},
+		{TunnelOptions{SOCKS5: "http://proxy:1080"}, false},
+		{TunnelOptions{SSH: "me@bastion", SSHKey: "key"}, true},
+		{TunnelOptions{SSH: "me@bastion"}, false},
+		{TunnelOptions{SSH: "me@bastion", SSHKey: "key", SOCKS5: "socks5://proxy:1080"}, false},
+	}
+
+	for i, test := range tests {
+		_, cleanup, err := test.options.dialer()
+		if err == nil {
+			cleanup()
+		}
+		if (err == nil) != test.ok {
+			t.Errorf("%d. Expected ok %v, but was %v", i, test.ok, err)
+		}
+	}
+}
+
+func TestSSHArgs(t *testing.T) {
+	args, err := sshArgs("me@bastion.example.com:2222", "/tmp/key", "/tmp/known", "db.internal:5432")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{
+		"-o", "BatchMode=yes",
+		"-o", "ExitOnForwardFailure=yes",
+		"-o", "ConnectTimeout=10",
+		"-o", "IdentitiesOnly=yes",
+		"-i", "/tmp/key",
+		"-o", "StrictHostKeyChecking=yes", "-o", "UserKnownHostsFile=/tmp/known",
+		"-p", "2222", "-l", "me", "-W", "db.internal:5432", "--", "bastion.example.com",
+	}
+	if !reflect.DeepEqual(args, expected) {
+		t.Fatalf("Expected %v, but was %v", expected, args)
+	}
+
+	args, err = sshArgs("me@bastion", "/tmp/key", "", "db.internal:5432")
+	if err != nil || args[len(args)-7] != "22" {
+		t.Fatalf("expected the default ssh port, got %v (%v)", args, err)
+	}
+
+	if _, err = sshArgs("bastion", "/tmp/key", "", "db.internal:5432"); err == nil {
+		t.Fatal("expected a jump host without a user to be rejected")
+	}
+}
+
+// TestHelperSSH stands in for the ssh client when run by
+// TestTargetProxySSH, forwarding stdio to the -W address.
+func TestHelperSSH(t *testing.T) {
+	if os.Getenv("PGDIAGNOSE_HELPER_SSH") != "1" {
+		return
+	}
+	var addr string
+	for i, arg := range os.Args {
+		if arg == "-W" {
+			addr = os.Args[i+1]
+		}
+	}
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		os.Exit(255)
+	}
+	go io.Copy(conn, os.Stdin)
+	io.Copy(os.Stdout, conn)
+	os.Exit(0)
+}
+
+func TestTargetProxySSH(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pgdiagnose-ssh")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	script := filepath.Join(dir, "ssh")
+	err = ioutil.WriteFile(script, []byte("#!/bin/sh\nPGDIAGNOSE_HELPER_SSH=1 exec "+os.Args[0]+" -test.run=TestHelperSSH -- \"$@\"\n"), 0700)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func(command string) { sshCommand = command }(sshCommand)
+	sshCommand = script
+
+	caPEM, cert := testCA(t, "localhost")
+	port := fakeTLSPostgres(t, cert)
+
+	p, err := openTarget("postgres://u@localhost:"+port+"/db",
+		TLSOptions{Mode: "verify-full", RootCert: caPEM},
+		TunnelOptions{SSH: "me@bastion", SSHKey: "key"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+
+	if err = roundTrip(t, p); err != nil {
+		t.Fatal(err)
+	}
+	if info := p.Info(); info == nil || !info.Verified {
+		t.Fatalf("expected a verified connection through the jump host, got %+v", info)
+	}
+}
+
+func TestSSHTunnelFiles(t *testing.T) {
+	tunnel, err := newSSHTunnel(TunnelOptions{SSH: "me@bastion", SSHKey: "key", SSHKnownHosts: "bastion ssh-ed25519 AAAA"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir, err := os.Stat(tunnel.dir)
+	if err != nil || dir.Mode().Perm() != 0700 {
+		t.Fatalf("expected a private directory, got %v (%v)", dir, err)
+	}
+	for _, name := range []string{tunnel.keyFile, tunnel.knownHostsFile} {
+		if filepath.Dir(name) != tunnel.dir {
+			t.Errorf("expected %s in %s", name, tunnel.dir)
+		}
+		file, err := os.Stat(name)
+		if err != nil || file.Mode().Perm() != 0600 {
+			t.Errorf("expected %s to be private, got %v (%v)", name, file, err)
+		}
+	}
+	key, _ := ioutil.ReadFile(tunnel.keyFile)
+	if string(key) != "key\n" {
+		t.Errorf("Expected %q, but was %q", "key\n", key)
+	}
+
+	tunnel.close()
+	if _, err = os.Stat(tunnel.dir); !os.IsNotExist(err) {
+		t.Fatalf("expected close to remove %s, got %v", tunnel.dir, err)
+	}
+}
+
+func TestSSHConnDeadline(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pgdiagnose-ssh")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// A jump host that accepts the connection but never answers.
+	script := filepath.Join(dir, "ssh")
+	err = ioutil.WriteFile(script, []byte("#!/bin/sh\nexec sleep 60\n"), 0700)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func(command string) { sshCommand = command }(sshCommand)
+	sshCommand = script
+
+	dial, cleanup, err := TunnelOptions{SSH: "me@bastion", SSHKey: "key"}.dialer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cleanup()
+	conn, err := dial("db.internal:5432")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// A cleared deadline doesn't fire.
+	conn.SetDeadline(time.Now().Add(50 * time.Millisecond))
+	conn.SetDeadline(time.Time{})
+	time.Sleep(100 * time.Millisecond)
+	if _, err = conn.Write([]byte("ping")); err != nil {
+		t.Fatalf("expected a cleared deadline to leave the connection open, got %v", err)
+	}
+
+	conn.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	_, err = conn.Read(make([]byte, 1))
+	if netErr, ok := err.(net.Error); !ok || !netErr.Timeout() {
+		t.Fatalf("expected a timeout, got %v", err)
+	}
+	if err = conn.SetDeadline(time.Now().Add(time.Second)); err == nil {
+		t.Fatal("expected an expired connection to stay expired")
+	}
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"github.com/jmoiron/sqlx"
+	"sort"
+)
+
+type waitProfileResult struct {
+	Bound       string           `json:"bound"`
+	Active      int              `json:"active"`
+	CPU         int              `json:"cpu"`
+	IO          int              `json:"io"`
+	Lock        int              `json:"lock"`
+	Client      int              `json:"client"`
+	Other       int              `json:"other"`
+	WaitEvents  []waitEventCount `json:"wait_events"`
+	LockWaiters []lockWaiter     `json:"lock_waiters"`
+}
+
+type lockWaiter struct {
+	Pid          int64  `db:"pid" json:"pid"`
+	WaitEvent    string `db:"wait_event" json:"wait_event"`
+	BlockingPids string `db:"blocking_pids" json:"blocking_pids"`
+}
+
+type waitingSession struct {
+	Pid           int64  `db:"pid"`
+	WaitEventType string `db:"wait_event_type"`
+	WaitEvent     string `db:"wait_event"`
+	BlockingPids  string `db:"blocking_pids"`
+}
+
+const (
+	// with only a couple of active sessions there is no real bottleneck
+	minActiveForBound = 4
+	lockWaitersRed    = 5
+)
+
+func waitEventsCheck(db *sqlx.DB, filter activityFilter) Check {
+	checkTitle := "Wait Events"
+	var sessions []waitingSession
+	err := db.Select(&sessions, filter.query(waitEventsSQL), filter.args()...)
+	if err != nil {
+		return makeErrorCheck(checkTitle, err)
+	}
+	result := profileWaits(sessions)
+	return Check{checkTitle, waitEventsStatus(result), []waitProfileResult{result}}
+}
+
+// waitCategory folds wait_event_type into the handful of resources a
+// session can be bound on. An active session without a wait event is on CPU.
+func waitCategory(waitEventType string) string {
+	switch waitEventType {
+	case "":
+		return "cpu"
+	case "IO":
+		return "io"
+	case "Lock", "LWLock", "BufferPin":
+		return "lock"
+	case "Client":
+		return "client"
+	}
+	return "other"
+}
+
+func profileWaits(sessions []waitingSession) waitProfileResult {
+	result := waitProfileResult{Active: len(sessions)}
+	waits := make(map[waitEventCount]int)
+
+	for _, s := range sessions {
+		switch waitCategory(s.WaitEventType) {
+		case "cpu":
+			result.CPU++
+		case "io":
+			result.IO++
+		case "lock":
+			result.Lock++
+		case "client":
+			result.Client++
+		default:
+			result.Other++
+		}
+
+		if s.WaitEventType != "" {
+			waits[waitEventCount{WaitEventType: s.WaitEventType, WaitEvent: s.WaitEvent}]++
+		}
+		if s.WaitEventType == "Lock" {
+			result.LockWaiters = append(result.LockWaiters, lockWaiter{s.Pid, s.WaitEvent, s.BlockingPids})
+		}
+	}
+
+	for w, count := range waits {
+		w.Count = count
+		result.WaitEvents = append(result.WaitEvents, w)
+	}
+	sort.Sort(byWaitCount(result.WaitEvents))
+
+	result.Bound = boundOn(result.CPU, result.IO, result.Lock)
+	return result
+}
+
+// boundOn names the resource most active sessions are on. Ties go to lock,
+// then io: waiting on either points at something to fix, while being on cpu
+// is what an active session does anyway.
+func boundOn(cpu, io, lock int) string {
+	if cpu+io+lock == 0 {
+		return "idle"
+	}
+	bound, most := "lock", lock
+	if io > most {
+		bound, most = "io", io
+	}
+	if cpu > most {
+		bound = "cpu"
+	}
+	return bound
+}
+
+// waitProfile finds the result of the Wait Events check among checks, if
+// it ran.
+func waitProfile(checks []Check) *waitProfileResult {
+	for _, check := range checks {
+		results, ok := check.Results.([]waitProfileResult)
+		if check.Name == "Wait Events" && ok && len(results) > 0 {
+			return &results[0]
+		}
+	}
+	return nil
+}
+
+func waitEventsStatus(result waitProfileResult) string {
+	if len(result.LockWaiters) >= lockWaitersRed {
+		return "red"
+	}
+	if result.Active >= minActiveForBound && (result.Bound == "lock" || result.Bound == "io") {
+		return "yellow"
+	}
+	return "green"
+}
+
+const waitEventsSQL = `
+	SELECT pid, coalesce(wait_event_type, '') as wait_event_type,
+	  coalesce(wait_event, '') as wait_event,
+	  array_to_string(pg_blocking_pids(pid), ',') as blocking_pids
+	FROM pg_stat_activity
+	WHERE state = 'active' AND %s
+	;`
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestProfileWaits(t *testing.T) {
+	sessions := []waitingSession{
+		{1, "", "", ""},
+		{2, "IO", "DataFileRead", ""},
+		{3, "Lock", "transactionid", "7"},
+		{4, "Lock", "transactionid", "7"},
+		{5, "Client", "ClientRead", ""},
+	}
+
+	result := profileWaits(sessions)
+	if result.Active != 5 || result.CPU != 1 || result.IO != 1 || result.Lock != 2 || result.Client != 1 {
+		t.Fatalf("unexpected counts %+v", result)
+	}
+	if result.Bound != "lock" {
+		t.Fatalf("expected lock bound, got %v", result.Bound)
+	}
+	if len(result.LockWaiters) != 2 || result.LockWaiters[0].BlockingPids != "7" {
+		t.Fatalf("expected lock waiters tied to blocking pid 7, got %+v", result.LockWaiters)
+	}
+	if result.WaitEvents[0].WaitEvent != "transactionid" || result.WaitEvents[0].Count != 2 {
+		t.Fatalf("expected transactionid as top wait event, got %+v", result.WaitEvents)
+	}
+
+	if profileWaits(nil).Bound != "idle" {
+		t.Fatal("expected idle without active sessions")
+	}
+}
+
+var boundtests = []struct {
+	cpu, io, lock int
+	expected      string
+}{
+	{0, 0, 0, "idle"},
+	{3, 1, 1, "cpu"},
+	{1, 3, 1, "io"},
+	{1, 1, 3, "lock"},
+	{2, 2, 2, "lock"},
+	{2, 2, 0, "io"},
+	{2, 0, 2, "lock"},
+	{0, 2, 2, "lock"},
+}
+
+func TestBoundOn(t *testing.T) {
+	for i, tt := range boundtests {
+		if actual := boundOn(tt.cpu, tt.io, tt.lock); actual != tt.expected {
+			t.Errorf("%d. Expected %v, but was %v", i, tt.expected, actual)
+		}
+	}
+}
+
+func TestWaitEventsStatus(t *testing.T) {
+	if waitEventsStatus(waitProfileResult{Active: 10, CPU: 10, Bound: "cpu"}) != "green" {
+		t.Fatal("not green when cpu bound")
+	}
+
+	if waitEventsStatus(waitProfileResult{Active: 2, IO: 2, Bound: "io"}) != "green" {
+		t.Fatal("not green with too few active sessions")
+	}
+
+	if waitEventsStatus(waitProfileResult{Active: 6, IO: 5, CPU: 1, Bound: "io"}) != "yellow" {
+		t.Fatal("not yellow when io bound")
+	}
+
+	result := waitProfileResult{Active: 5, Lock: 5, Bound: "lock", LockWaiters: make([]lockWaiter, 5)}
+	if waitEventsStatus(result) != "red" {
+		t.Fatal("not red with many lock waiters")
+	}
+}
@@ -0,0 +1,691 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/go-martini/martini"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"strconv"
+	"syscall"
+	"time"
+)
+
+// Webhook POSTs events for an app's reports, or every report if App is
+// empty, to URL. Payloads are signed with Secret, which is only shown when
+// the webhook is created. Format picks the payload: the event as JSON by
+// default, or a chat message for Slack or markdown chats.
+type Webhook struct {
+	Id        string    `json:"id"`
+	App       string    `json:"app"`
+	URL       string    `json:"url"`
+	Events    []string  `json:"events"`
+	Format    string    `json:"format"`
+	Secret    string    `json:"secret,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// webhookDelivery is one attempt at delivering an event to a webhook.
+type webhookDelivery struct {
+	Id         string    `json:"id"`
+	WebhookId  string    `json:"webhook_id"`
+	Event      string    `json:"event"`
+	ReportId   string    `json:"report_id"`
+	Attempt    int       `json:"attempt"`
+	StatusCode int       `json:"status_code"`
+	Error      string    `json:"error,omitempty"`
+	CreatedAt  time.Time `json:"created_at"`
+}
+
+type WebhookStore interface {
+	// SaveWebhook assigns the webhook an id and creation time and stores
+	// it.
+	SaveWebhook(hook *Webhook) error
+	Webhooks() ([]Webhook, error)
+	DeleteWebhook(id string) error
+	SaveDelivery(delivery *webhookDelivery) error
+	// Deliveries returns a webhook's most recent deliveries first.
+	Deliveries(webhookId string, limit int) ([]webhookDelivery, error)
+	// PurgeDeliveries deletes the deliveries made before before.
+	PurgeDeliveries(before time.Time) (int64, error)
+}
+
+var ErrWebhookNotFound = errors.New("webhook not found")
+
+// Webhook payload formats.
+const (
+	webhookJSON     = "json"
+	webhookSlack    = "slack"
+	webhookMarkdown = "markdown"
+)
+
+const (
+	signatureHeader = "X-Pgdiagnose-Signature"
+	timestampHeader = "X-Pgdiagnose-Timestamp"
+	// the file and memory stores only keep this many deliveries
+	keptDeliveries = 1000
+)
+
+// webhookBackoff is how long to wait before each retry of a failed
+// delivery. Retries wait in memory, so delivery is best effort: retries
+// still pending when the server stops are lost.
+var webhookBackoff = []time.Duration{
+	5 * time.Second,
+	30 * time.Second,
+	2 * time.Minute,
+	10 * time.Minute,
+	30 * time.Minute,
+}
+
+// signWebhook signs the timestamp and body, so receivers can check both
+// that pgdiagnose sent a payload and that it isn't an old one replayed.
+func signWebhook(secret, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp + "."))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+func (h Webhook) wants(e event) bool {
+	if h.App != "" && h.App != e.App {
+		return false
+	}
+	for _, kind := range h.Events {
+		if kind == e.Type {
+			return true
+		}
+	}
+	return false
+}
+
+// webhookNotifier delivers events to every webhook that wants them, in the
+// background, retrying failures with webhookBackoff.
+type webhookNotifier struct {
+	store   WebhookStore
+	config  Config
+	client  *http.Client
+	backoff []time.Duration
+}
+
+func newWebhookNotifier(store WebhookStore, config Config) *webhookNotifier {
+	// Webhook hosts are checked again when dialing, since what a name
+	// resolves to can change after the webhook was created, and redirects
+	// go wherever they like. Proxies would hide where requests end up.
+	dialer := &net.Dialer{Timeout: 10 * time.Second, Control: webhookDialControl}
+	transport := &http.Transport{
+		DialContext:         dialer.DialContext,
+		TLSHandshakeTimeout: 10 * time.Second,
+	}
+	return &webhookNotifier{
+		store:   store,
+		config:  config,
+		client:  &http.Client{Timeout: 10 * time.Second, Transport: transport},
+		backoff: webhookBackoff,
+	}
+}
+
+// allowedWebhookIP reports whether webhooks may be delivered to ip, which
+// keeps them from reaching the server's own network or cloud metadata
+// services. Tests replace it to deliver to local receivers.
+var allowedWebhookIP = publicIP
+
+// lookupWebhookHost resolves webhook hosts, which tests replace.
+var lookupWebhookHost = net.LookupIP
+
+var nonPublicNets = []*net.IPNet{
+	mustParseCIDR("0.0.0.0/8"),
+	mustParseCIDR("100.64.0.0/10"),
+}
+
+func mustParseCIDR(s string) *net.IPNet {
+	_, n, err := net.ParseCIDR(s)
+	if err != nil {
+		panic(err)
+	}
+	return n
+}
+
+func publicIP(ip net.IP) bool {
+	if ip.IsLoopback() || ip.IsPrivate() || ip.IsUnspecified() || ip.IsMulticast() ||
+		ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() {
+		return false
+	}
+	for _, n := range nonPublicNets {
+		if n.Contains(ip) {
+			return false
+		}
+	}
+	return true
+}
+
+// checkWebhookHost returns an error unless every address host resolves to
+// is one webhooks may be delivered to.
+func checkWebhookHost(host string) error {
+	ips := []net.IP{net.ParseIP(host)}
+	if ips[0] == nil {
+		var err error
+		ips, err = lookupWebhookHost(host)
+		if err != nil {
+			return err
+		}
+	}
+	for _, ip := range ips {
+		if !allowedWebhookIP(ip) {
+			return fmt.Errorf("%s isn't a public address", ip)
+		}
+	}
+	return nil
+}
+
+// webhookDialControl stops connections to addresses webhooks may not be
+// delivered to, after the name was resolved.
+func webhookDialControl(network, address string, c syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || !allowedWebhookIP(ip) {
+		return fmt.Errorf("webhook address %s isn't public", host)
+	}
+	return nil
+}
+
+func (n *webhookNotifier) Notify(e event) {
+	hooks, err := n.store.Webhooks()
+	if err != nil {
+		log.Printf("%v", err)
+		return
+	}
+
+	for _, hook := range hooks {
+		if !hook.wants(e) {
+			continue
+		}
+		body, err := n.payload(hook, e)
+		if err != nil {
+			log.Printf("%v", err)
+			continue
+		}
+		go n.deliver(hook, e, body)
+	}
+}
+
+func (n *webhookNotifier) payload(hook Webhook, e event) ([]byte, error) {
+	if e.report == nil || hook.Format == "" || hook.Format == webhookJSON {
+		return json.Marshal(e)
+	}
+
+	link := reportLink(n.config, e.ReportId)
+	if hook.Format == webhookSlack {
+		return json.Marshal(renderSlack(e.report, e.Changes, link))
+	}
+	return json.Marshal(map[string]string{"text": renderMarkdown(e.report, e.Changes, link)})
+}
+
+func (n *webhookNotifier) deliver(hook Webhook, e event, body []byte) bool {
+	for attempt := 1; ; attempt++ {
+		delivery := &webhookDelivery{
+			WebhookId: hook.Id,
+			Event:     e.Type,
+			ReportId:  e.ReportId,
+			Attempt:   attempt,
+		}
+		code, err := n.post(hook, body)
+		delivery.StatusCode = code
+		if err != nil {
+			delivery.Error = err.Error()
+		}
+		if err := n.store.SaveDelivery(delivery); err != nil {
+			log.Printf("%v", err)
+		}
+
+		if delivery.Error == "" {
+			return true
+		}
+		if attempt > len(n.backoff) {
+			log.Printf("giving up delivering %s for report %s to webhook %s: %s", e.Type, e.ReportId, hook.Id, delivery.Error)
+			return false
+		}
+		time.Sleep(n.backoff[attempt-1])
+	}
+}
+
+func (n *webhookNotifier) post(hook Webhook, body []byte) (int, error) {
+	req, err := http.NewRequest("POST", hook.URL, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "pgdiagnose")
+	req.Header.Set(timestampHeader, timestamp)
+	req.Header.Set(signatureHeader, signWebhook(hook.Secret, timestamp, body))
+
+	res, err := n.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer res.Body.Close()
+	ioutil.ReadAll(res.Body)
+
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return res.StatusCode, fmt.Errorf("got %s", res.Status)
+	}
+	return res.StatusCode, nil
+}
+
+func newWebhookSecret() string {
+	b := make([]byte, 32)
+	_, err := rand.Read(b)
+	if err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
+
+func validEventType(kind string) bool {
+	for _, t := range eventTypes {
+		if t == kind {
+			return true
+		}
+	}
+	return false
+}
+
+func createWebhook(req *http.Request, store WebhookStore, token *apiToken) (int, string) {
+	var hook Webhook
+	err := json.NewDecoder(req.Body).Decode(&hook)
+	if err != nil {
+		return 400, `{"error": "expected a JSON webhook"}`
+	}
+
+	if !validParams.MatchString(hook.App) {
+		hook.App = ""
+	}
+	if hook.App == "" {
+		hook.App = token.App
+	}
+	if !token.canAccess(hook.App) {
+		return 403, `{"error": "token can't create webhooks for this app"}`
+	}
+
+	u, err := url.Parse(hook.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return 400, `{"error": "url must be an http or https url"}`
+	}
+	if err = checkWebhookHost(u.Hostname()); err != nil {
+		return 400, `{"error": "url must resolve to public addresses"}`
+	}
+	if len(hook.Events) == 0 {
+		hook.Events = []string{eventReportCompleted}
+	}
+	switch hook.Format {
+	case "":
+		hook.Format = webhookJSON
+	case webhookJSON, webhookSlack, webhookMarkdown:
+	default:
+		return 400, `{"error": "format must be json, slack or markdown"}`
+	}
+	for _, kind := range hook.Events {
+		if !validEventType(kind) {
+			return 400, `{"error": "unknown event type"}`
+		}
+	}
+
+	hook.Secret = newWebhookSecret()
+	err = store.SaveWebhook(&hook)
+	if err != nil {
+		log.Printf("%v", err)
+		return 500, `{"error": "Couldn't save webhook"}`
+	}
+	return webhookResponse(201, hook)
+}
+
+func listWebhooks(store WebhookStore, token *apiToken) (int, string) {
+	hooks, err := store.Webhooks()
+	if err != nil {
+		log.Printf("%v", err)
+		return 500, `{"error": "Couldn't list webhooks"}`
+	}
+
+	visible := []Webhook{}
+	for _, hook := range hooks {
+		if token.canAccess(hook.App) {
+			hook.Secret = ""
+			visible = append(visible, hook)
+		}
+	}
+	return webhookResponse(200, visible)
+}
+
+// findWebhook returns the webhook only if the token may see it.
+func findWebhook(id string, store WebhookStore, token *apiToken) (*Webhook, error) {
+	hooks, err := store.Webhooks()
+	if err != nil {
+		return nil, err
+	}
+	for _, hook := range hooks {
+		if hook.Id == id && token.canAccess(hook.App) {
+			return &hook, nil
+		}
+	}
+	return nil, ErrWebhookNotFound
+}
+
+func deleteWebhook(params martini.Params, store WebhookStore, token *apiToken) (int, string) {
+	_, err := findWebhook(params["id"], store, token)
+	if err == nil {
+		err = store.DeleteWebhook(params["id"])
+	}
+	if err != nil {
+		if err != ErrWebhookNotFound {
+			log.Printf("%v", err)
+		}
+		return 404, ""
+	}
+	return 204, ""
+}
+
+func listDeliveries(params martini.Params, store WebhookStore, token *apiToken) (int, string) {
+	_, err := findWebhook(params["id"], store, token)
+	if err != nil {
+		if err != ErrWebhookNotFound {
+			log.Printf("%v", err)
+		}
+		return 404, ""
+	}
+
+	deliveries, err := store.Deliveries(params["id"], 100)
+	if err != nil {
+		log.Printf("%v", err)
+		return 500, `{"error": "Couldn't list deliveries"}`
+	}
+	if deliveries == nil {
+		deliveries = []webhookDelivery{}
+	}
+	return webhookResponse(200, deliveries)
+}
+
+func webhookResponse(code int, v interface{}) (int, string) {
+	js, err := PrettyJSON(v)
+	if err != nil {
+		log.Printf("%v", err)
+		return 500, `{"error": "Couldn't send webhook"}`
+	}
+	return code, js
+}
+
+func (s *postgresStore) SaveWebhook(hook *Webhook) error {
+	events, err := json.Marshal(hook.Events)
+	if err != nil {
+		return err
+	}
+	row := s.db.QueryRow(
+		"INSERT INTO webhooks (app, url, events, format, secret) values (nullif($1, ''), $2, $3, $4, $5) returning id, created_at",
+		hook.App, hook.URL, string(events), hook.Format, hook.Secret)
+	return row.Scan(&hook.Id, &hook.CreatedAt)
+}
+
+func (s *postgresStore) Webhooks() ([]Webhook, error) {
+	rows, err := s.db.Query("SELECT id, coalesce(app, ''), url, events, format, secret, created_at FROM webhooks ORDER BY created_at")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var hooks []Webhook
+	for rows.Next() {
+		var hook Webhook
+		var events string
+		err = rows.Scan(&hook.Id, &hook.App, &hook.URL, &events, &hook.Format, &hook.Secret, &hook.CreatedAt)
+		if err != nil {
+			return nil, err
+		}
+		err = json.Unmarshal([]byte(events), &hook.Events)
+		if err != nil {
+			return nil, err
+		}
+		hooks = append(hooks, hook)
+	}
+	return hooks, rows.Err()
+}
+
+func (s *postgresStore) DeleteWebhook(id string) error {
+	res, err := s.db.Exec("DELETE FROM webhooks WHERE id = $1", id)
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrWebhookNotFound
+	}
+	return nil
+}
+
+func (s *postgresStore) SaveDelivery(delivery *webhookDelivery) error {
+	row := s.db.QueryRow(
+		`INSERT INTO webhook_deliveries (webhook_id, event, report_id, attempt, status_code, error)
+		values ($1, $2, nullif($3, '')::uuid, $4, nullif($5, 0), nullif($6, '')) returning id, created_at`,
+		delivery.WebhookId, delivery.Event, delivery.ReportId, delivery.Attempt,
+		delivery.StatusCode, delivery.Error)
+	return row.Scan(&delivery.Id, &delivery.CreatedAt)
+}
+
+func (s *postgresStore) PurgeDeliveries(before time.Time) (int64, error) {
+	res, err := s.db.Exec("DELETE FROM webhook_deliveries WHERE created_at < $1", before)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+func (s *postgresStore) Deliveries(webhookId string, limit int) ([]webhookDelivery, error) {
+	rows, err := s.db.Query(
+		`SELECT id, webhook_id, event, coalesce(report_id::text, ''), attempt, coalesce(status_code, 0), coalesce(error, ''), created_at
+		FROM webhook_deliveries WHERE webhook_id = $1 ORDER BY created_at DESC LIMIT $2`,
+		webhookId, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var deliveries []webhookDelivery
+	for rows.Next() {
+		var d webhookDelivery
+		err = rows.Scan(&d.Id, &d.WebhookId, &d.Event, &d.ReportId, &d.Attempt, &d.StatusCode, &d.Error, &d.CreatedAt)
+		if err != nil {
+			return nil, err
+		}
+		deliveries = append(deliveries, d)
+	}
+	return deliveries, rows.Err()
+}
+
+func (s *memoryStore) SaveWebhook(hook *Webhook) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	hook.Id = newUUID()
+	hook.CreatedAt = time.Now()
+	s.webhooks = append(s.webhooks, *hook)
+	return nil
+}
+
+func (s *memoryStore) Webhooks() ([]Webhook, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return append([]Webhook{}, s.webhooks...), nil
+}
+
+func (s *memoryStore) DeleteWebhook(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var err error
+	s.webhooks, err = deleteWebhookFrom(s.webhooks, id)
+	return err
+}
+
+func (s *memoryStore) SaveDelivery(delivery *webhookDelivery) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.deliveries = appendDelivery(s.deliveries, delivery)
+	return nil
+}
+
+func (s *memoryStore) Deliveries(webhookId string, limit int) ([]webhookDelivery, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return deliveriesFor(s.deliveries, webhookId, limit), nil
+}
+
+func (s *memoryStore) PurgeDeliveries(before time.Time) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var n int64
+	s.deliveries, n = deliveriesSince(s.deliveries, before)
+	return n, nil
+}
+
+func (s *fileStore) webhooksPath() string {
+	return filepath.Join(s.dir, "webhooks")
+}
+
+func (s *fileStore) deliveriesPath() string {
+	return filepath.Join(s.dir, "deliveries")
+}
+
+func (s *fileStore) SaveWebhook(hook *Webhook) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var hooks []Webhook
+	err := s.readJSON(s.webhooksPath(), &hooks)
+	if err != nil {
+		return err
+	}
+	hook.Id = newUUID()
+	hook.CreatedAt = time.Now()
+	return s.writeJSON(s.webhooksPath(), append(hooks, *hook))
+}
+
+func (s *fileStore) Webhooks() ([]Webhook, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var hooks []Webhook
+	err := s.readJSON(s.webhooksPath(), &hooks)
+	return hooks, err
+}
+
+func (s *fileStore) DeleteWebhook(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var hooks []Webhook
+	err := s.readJSON(s.webhooksPath(), &hooks)
+	if err != nil {
+		return err
+	}
+	hooks, err = deleteWebhookFrom(hooks, id)
+	if err != nil {
+		return err
+	}
+	return s.writeJSON(s.webhooksPath(), hooks)
+}
+
+func (s *fileStore) SaveDelivery(delivery *webhookDelivery) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var deliveries []webhookDelivery
+	err := s.readJSON(s.deliveriesPath(), &deliveries)
+	if err != nil {
+		return err
+	}
+	return s.writeJSON(s.deliveriesPath(), appendDelivery(deliveries, delivery))
+}
+
+func (s *fileStore) Deliveries(webhookId string, limit int) ([]webhookDelivery, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var deliveries []webhookDelivery
+	err := s.readJSON(s.deliveriesPath(), &deliveries)
+	return deliveriesFor(deliveries, webhookId, limit), err
+}
+
+func (s *fileStore) PurgeDeliveries(before time.Time) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var deliveries []webhookDelivery
+	err := s.readJSON(s.deliveriesPath(), &deliveries)
+	if err != nil {
+		return 0, err
+	}
+	deliveries, n := deliveriesSince(deliveries, before)
+	if n == 0 {
+		return 0, nil
+	}
+	return n, s.writeJSON(s.deliveriesPath(), deliveries)
+}
+
+func deleteWebhookFrom(hooks []Webhook, id string) ([]Webhook, error) {
+	for i, hook := range hooks {
+		if hook.Id == id {
+			return append(hooks[:i], hooks[i+1:]...), nil
+		}
+	}
+	return hooks, ErrWebhookNotFound
+}
+
+func appendDelivery(deliveries []webhookDelivery, delivery *webhookDelivery) []webhookDelivery {
+	delivery.Id = newUUID()
+	delivery.CreatedAt = time.Now()
+	deliveries = append(deliveries, *delivery)
+	if len(deliveries) > keptDeliveries {
+		deliveries = deliveries[len(deliveries)-keptDeliveries:]
+	}
+	return deliveries
+}
+
+// deliveriesSince returns the deliveries made at or after before, and how
+// many were dropped.
+func deliveriesSince(deliveries []webhookDelivery, before time.Time) ([]webhookDelivery, int64) {
+	var kept []webhookDelivery
+	for _, d := range deliveries {
+		if !d.CreatedAt.Before(before) {
+			kept = append(kept, d)
+		}
+	}
+	return kept, int64(len(deliveries) - len(kept))
+}
+
+func deliveriesFor(deliveries []webhookDelivery, webhookId string, limit int) []webhookDelivery {
+	var found []webhookDelivery
+	for i := len(deliveries) - 1; i >= 0 && len(found) < limit; i-- {
+		if deliveries[i].WebhookId == webhookId {
+			found = append(found, deliveries[i])
+		}
+	}
+	return found
+}
@@ -0,0 +1,248 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+type receivedWebhook struct {
+	signature, timestamp string
+	body                 []byte
+}
+
+// allowLocalWebhooks lets webhooks reach the local receivers tests use,
+// and resolves every other host to a public address, until the returned
+// func is called.
+func allowLocalWebhooks() func() {
+	allowed, lookup := allowedWebhookIP, lookupWebhookHost
+	allowedWebhookIP = func(net.IP) bool { return true }
+	lookupWebhookHost = func(string) ([]net.IP, error) { return []net.IP{net.ParseIP("93.184.216.34")}, nil }
+	return func() { allowedWebhookIP, lookupWebhookHost = allowed, lookup }
+}
+
+// webhookReceiver stands in for a webhook consumer, failing the first
+// failures requests.
+func webhookReceiver(failures int) (*httptest.Server, chan receivedWebhook) {
+	received := make(chan receivedWebhook, 10)
+	server := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		if failures > 0 {
+			failures--
+			res.WriteHeader(503)
+			return
+		}
+		body, _ := ioutil.ReadAll(req.Body)
+		received <- receivedWebhook{req.Header.Get(signatureHeader), req.Header.Get(timestampHeader), body}
+	}))
+	return server, received
+}
+
+func TestWebhookNotifier(t *testing.T) {
+	defer allowLocalWebhooks()()
+	server, received := webhookReceiver(0)
+	defer server.Close()
+
+	store := newMemoryStore()
+	hook := &Webhook{App: "sushi", URL: server.URL, Events: []string{eventReportRed}, Secret: "secret"}
+	store.SaveWebhook(hook)
+	store.SaveWebhook(&Webhook{App: "other", URL: server.URL, Events: []string{eventReportRed}, Secret: "secret"})
+
+	report := &Report{Id: "id", App: "sushi", Database: "db", SummaryStatus: "red",
+		Checks: []Check{{"Sequences", "red", nil}, {"Bloat", "green", nil}}}
+	n := newWebhookNotifier(store, Config{})
+	for _, e := range reportEvents(report, nil) {
+		n.Notify(e)
+	}
+
+	var got receivedWebhook
+	select {
+	case got = <-received:
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected a webhook delivery")
+	}
+
+	if got.signature != signWebhook("secret", got.timestamp, got.body) {
+		t.Fatalf("bad signature %s", got.signature)
+	}
+	var e event
+	if err := json.Unmarshal(got.body, &e); err != nil {
+		t.Fatal(err)
+	}
+	if e.Type != eventReportRed || e.ReportId != "id" || e.App != "sushi" || e.Database != "db" ||
+		e.SummaryStatus != "red" || !reflect.DeepEqual(e.FailingChecks, []string{"Sequences"}) {
+		t.Fatalf("unexpected payload %s", got.body)
+	}
+
+	select {
+	case extra := <-received:
+		t.Fatalf("expected only the sushi webhook to get the red event, also got %s", extra.body)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestWebhookChatPayload(t *testing.T) {
+	n := newWebhookNotifier(newMemoryStore(), Config{BaseURL: "https://pgd.example.com"})
+	report := &Report{Id: "id", App: "sushi", SummaryStatus: "red", Checks: []Check{{"Sequences", "red", nil}}}
+	e := reportEvents(report, nil)[0]
+
+	body, err := n.payload(Webhook{Format: webhookSlack}, e)
+	if err != nil || !strings.Contains(string(body), `"blocks"`) || !strings.Contains(string(body), "https://pgd.example.com/reports/id") {
+		t.Fatalf("expected a slack message linking to the report, got %s (%v)", body, err)
+	}
+
+	body, err = n.payload(Webhook{Format: webhookMarkdown}, e)
+	if err != nil || !strings.HasPrefix(string(body), `{"text":"**pgdiagnose: sushi is red**`) {
+		t.Fatalf("expected a markdown message, got %s (%v)", body, err)
+	}
+
+	body, err = n.payload(Webhook{Format: webhookJSON}, e)
+	if err != nil || !strings.Contains(string(body), `"report_id":"id"`) {
+		t.Fatalf("expected the event, got %s (%v)", body, err)
+	}
+}
+
+func TestWebhookRetries(t *testing.T) {
+	defer allowLocalWebhooks()()
+	server, received := webhookReceiver(2)
+	defer server.Close()
+
+	store := newMemoryStore()
+	hook := &Webhook{URL: server.URL, Events: []string{eventReportCompleted}, Secret: "secret"}
+	store.SaveWebhook(hook)
+
+	n := newWebhookNotifier(store, Config{})
+	n.backoff = []time.Duration{time.Millisecond, time.Millisecond}
+	if !n.deliver(*hook, event{Type: eventReportCompleted, ReportId: "id"}, []byte("{}")) {
+		t.Fatal("expected the third attempt to succeed")
+	}
+	<-received
+
+	deliveries, _ := store.Deliveries(hook.Id, 10)
+	if len(deliveries) != 3 || deliveries[0].Attempt != 3 || deliveries[0].StatusCode != 200 ||
+		deliveries[2].StatusCode != 503 || deliveries[2].Error == "" {
+		t.Fatalf("expected two failures and a success in the delivery log, got %+v", deliveries)
+	}
+
+	n.backoff = nil
+	server.Close()
+	if n.deliver(*hook, event{Type: eventReportCompleted, ReportId: "id"}, []byte("{}")) {
+		t.Fatal("expected delivery to a closed server to fail")
+	}
+}
+
+func TestWebhookWants(t *testing.T) {
+	global := Webhook{Events: []string{eventReportCompleted}}
+	scoped := Webhook{App: "sushi", Events: []string{eventReportCompleted, eventStatusChanged}}
+
+	tests := []struct {
+		hook     Webhook
+		e        event
+		expected bool
+	}{
+		{global, event{Type: eventReportCompleted, App: "any"}, true},
+		{global, event{Type: eventReportRed, App: "any"}, false},
+		{scoped, event{Type: eventStatusChanged, App: "sushi"}, true},
+		{scoped, event{Type: eventReportCompleted, App: "other"}, false},
+	}
+	for i, test := range tests {
+		if actual := test.hook.wants(test.e); actual != test.expected {
+			t.Errorf("%d. Expected %v, but was %v", i, test.expected, actual)
+		}
+	}
+}
+
+func TestCreateWebhook(t *testing.T) {
+	defer func(lookup func(string) ([]net.IP, error)) { lookupWebhookHost = lookup }(lookupWebhookHost)
+	lookupWebhookHost = func(host string) ([]net.IP, error) {
+		if host == "internal.example.com" {
+			return []net.IP{net.ParseIP("93.184.216.34"), net.ParseIP("10.0.0.5")}, nil
+		}
+		return []net.IP{net.ParseIP("93.184.216.34")}, nil
+	}
+	store := newMemoryStore()
+	token := &apiToken{App: "sushi"}
+
+	tests := []struct {
+		body string
+		code int
+	}{
+		{`{"url": "https://example.com/hook"}`, 201},
+		{`{"url": "https://example.com/hook", "app": "other"}`, 403},
+		{`{"url": "ftp://example.com/hook"}`, 400},
+		{`{"url": "https://example.com/hook", "events": ["nope"]}`, 400},
+		{`{"url": "http://127.0.0.1:5432/"}`, 400},
+		{`{"url": "http://169.254.169.254/latest/meta-data/"}`, 400},
+		{`{"url": "http://[::1]/hook"}`, 400},
+		{`{"url": "https://internal.example.com/hook"}`, 400},
+	}
+	for i, test := range tests {
+		req, _ := http.NewRequest("POST", "/webhooks", strings.NewReader(test.body))
+		code, body := createWebhook(req, store, token)
+		if code != test.code {
+			t.Errorf("%d. Expected %v, but was %v: %s", i, test.code, code, body)
+		}
+		if code == 201 && !strings.Contains(body, `"secret"`) {
+			t.Errorf("%d. Expected the secret to be shown on creation", i)
+		}
+	}
+
+	code, body := listWebhooks(store, token)
+	if code != 200 || strings.Contains(body, `"secret"`) || !strings.Contains(body, `"report.completed"`) ||
+		strings.Count(body, `"id"`) != 1 {
+		t.Fatalf("expected the webhook without its secret, got %d %s", code, body)
+	}
+	code, body = listWebhooks(store, &apiToken{App: "other"})
+	if strings.TrimSpace(body) != "[]" {
+		t.Fatalf("expected other apps' webhooks to be hidden, got %s", body)
+	}
+}
+
+func TestPublicIP(t *testing.T) {
+	tests := []struct {
+		ip       string
+		expected bool
+	}{
+		{"93.184.216.34", true},
+		{"2606:2800:220:1::", true},
+		{"127.0.0.1", false},
+		{"10.1.2.3", false},
+		{"172.16.0.1", false},
+		{"192.168.1.1", false},
+		{"169.254.169.254", false},
+		{"100.64.0.1", false},
+		{"0.0.0.0", false},
+		{"::1", false},
+		{"fd00::1", false},
+		{"fe80::1", false},
+		{"::ffff:127.0.0.1", false},
+	}
+	for i, test := range tests {
+		if actual := publicIP(net.ParseIP(test.ip)); actual != test.expected {
+			t.Errorf("%d. Expected %v, but was %v", i, test.expected, actual)
+		}
+	}
+}
+
+func TestWebhookRefusesPrivateAddresses(t *testing.T) {
+	server, received := webhookReceiver(0)
+	defer server.Close()
+
+	// A webhook whose name resolved to a public address when it was
+	// created, but points at the server's network now.
+	hook := Webhook{URL: server.URL, Events: []string{eventReportCompleted}, Secret: "secret"}
+	n := newWebhookNotifier(newMemoryStore(), Config{})
+	if code, err := n.post(hook, []byte("{}")); err == nil {
+		t.Fatalf("expected delivery to a loopback address to be refused, got %d", code)
+	}
+	select {
+	case <-received:
+		t.Fatal("expected the local receiver not to be reached")
+	default:
+	}
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/jmoiron/sqlx"
+	"time"
+)
+
+const xactCheckTitle = "Transactions"
+
+type xactResult struct {
+	Database         string     `db:"datname" json:"database"`
+	XactCommit       int64      `db:"xact_commit" json:"xact_commit"`
+	XactRollback     int64      `db:"xact_rollback" json:"xact_rollback"`
+	RollbackRatio    float64    `db:"-" json:"rollback_ratio"`
+	Deadlocks        int64      `db:"deadlocks" json:"deadlocks"`
+	Conflicts        int64      `db:"conflicts" json:"conflicts"`
+	ChecksumFailures int64      `db:"checksum_failures" json:"checksum_failures"`
+	StatsReset       string     `db:"stats_reset" json:"stats_reset"`
+	Delta            *xactDelta `db:"-" json:"delta,omitempty"`
+}
+
+// xactDelta holds the counters accumulated since the previous report for
+// the same app and database, and their rates per second, so that a burst of
+// rollbacks last week doesn't keep the check red forever.
+type xactDelta struct {
+	PreviousReport     string  `json:"previous_report"`
+	Seconds            float64 `json:"seconds"`
+	XactCommit         int64   `json:"xact_commit"`
+	XactRollback       int64   `json:"xact_rollback"`
+	RollbackRatio      float64 `json:"rollback_ratio"`
+	Deadlocks          int64   `json:"deadlocks"`
+	Conflicts          int64   `json:"conflicts"`
+	CommitsPerSecond   float64 `json:"commits_per_second"`
+	RollbacksPerSecond float64 `json:"rollbacks_per_second"`
+	DeadlocksPerSecond float64 `json:"deadlocks_per_second"`
+	ConflictsPerSecond float64 `json:"conflicts_per_second"`
+}
+
+const (
+	// too few transactions make the ratio meaningless
+	minXactsForRatio    = 1000
+	rollbackRatioYellow = 0.05
+	rollbackRatioRed    = 0.2
+)
+
+func xactCheck(db *sqlx.DB) Check {
+	version, err := serverVersionNum(db)
+	if err != nil {
+		return makeErrorCheck(xactCheckTitle, err)
+	}
+
+	query := xactSQL
+	if version < 120000 {
+		query = xactPre12SQL
+	}
+
+	var results []xactResult
+	err = db.Select(&results, query)
+	if err != nil {
+		return makeErrorCheck(xactCheckTitle, err)
+	}
+	for i := range results {
+		results[i].RollbackRatio = rollbackRatio(results[i].XactCommit, results[i].XactRollback)
+	}
+
+	return Check{xactCheckTitle, xactStatus(results), results}
+}
+
+func rollbackRatio(commits, rollbacks int64) float64 {
+	if commits+rollbacks < minXactsForRatio {
+		return 0
+	}
+	return float64(rollbacks) / float64(commits+rollbacks)
+}
+
+func xactStatus(results []xactResult) string {
+	status := "green"
+	for _, r := range results {
+		if r.ChecksumFailures > 0 {
+			return "red"
+		}
+
+		ratio, deadlocks, conflicts := r.RollbackRatio, r.Deadlocks, r.Conflicts
+		if r.Delta != nil {
+			ratio, deadlocks, conflicts = r.Delta.RollbackRatio, r.Delta.Deadlocks, r.Delta.Conflicts
+		}
+
+		if ratio >= rollbackRatioRed {
+			return "red"
+		}
+		if ratio >= rollbackRatioYellow || deadlocks > 0 || conflicts > 0 {
+			status = "yellow"
+		}
+	}
+	return status
+}
+
+// compareXactCheck turns the lifetime counters of the Transactions check into
+// rates since the previous report, as long as the stats weren't reset in
+// between. The lifetime counters stay in the result so the next report can
+// compare against this one.
+func compareXactCheck(checks []Check, previous *Report) {
+	if previous == nil {
+		return
+	}
+
+	var before []xactResult
+	for _, check := range previous.Checks {
+		if check.Name != xactCheckTitle || check.Status == "skipped" {
+			continue
+		}
+		js, err := json.Marshal(check.Results)
+		if err != nil {
+			return
+		}
+		if err = json.Unmarshal(js, &before); err != nil {
+			return
+		}
+	}
+
+	for i, check := range checks {
+		current, ok := check.Results.([]xactResult)
+		if check.Name != xactCheckTitle || !ok {
+			continue
+		}
+		for j := range current {
+			current[j].Delta = xactDeltaSince(current[j], before, previous)
+		}
+		checks[i].Status = xactStatus(current)
+	}
+}
+
+// xactDeltaSince is nil when there is nothing to compare against, including
+// when any counter went down: a restart or a stats reset that stats_reset
+// didn't show.
+func xactDeltaSince(current xactResult, before []xactResult, previous *Report) *xactDelta {
+	for _, b := range before {
+		if b.Database != current.Database || b.StatsReset != current.StatsReset {
+			continue
+		}
+
+		d := &xactDelta{
+			PreviousReport: previous.Id,
+			Seconds:        time.Since(previous.CreatedAt).Seconds(),
+			XactCommit:     current.XactCommit - b.XactCommit,
+			XactRollback:   current.XactRollback - b.XactRollback,
+			Deadlocks:      current.Deadlocks - b.Deadlocks,
+			Conflicts:      current.Conflicts - b.Conflicts,
+		}
+		if d.XactCommit < 0 || d.XactRollback < 0 || d.Deadlocks < 0 || d.Conflicts < 0 || d.Seconds <= 0 {
+			return nil
+		}
+		d.RollbackRatio = rollbackRatio(d.XactCommit, d.XactRollback)
+		d.CommitsPerSecond = float64(d.XactCommit) / d.Seconds
+		d.RollbacksPerSecond = float64(d.XactRollback) / d.Seconds
+		d.DeadlocksPerSecond = float64(d.Deadlocks) / d.Seconds
+		d.ConflictsPerSecond = float64(d.Conflicts) / d.Seconds
+		return d
+	}
+	return nil
+}
+
+const (
+	xactSQL = `
+	SELECT datname, xact_commit, xact_rollback, deadlocks, conflicts,
+	  coalesce(checksum_failures, 0) as checksum_failures,
+	  coalesce(stats_reset::text, '') as stats_reset
+	FROM pg_stat_database
+	WHERE datname = current_database()
+	;`
+
+	xactPre12SQL = `
+	SELECT datname, xact_commit, xact_rollback, deadlocks, conflicts,
+	  0 as checksum_failures,
+	  coalesce(stats_reset::text, '') as stats_reset
+	FROM pg_stat_database
+	WHERE datname = current_database()
+	;`
+)
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestXactStatus(t *testing.T) {
+	values := make([]xactResult, 0)
+	if xactStatus(values) != "green" {
+		t.Fatal("not green on empty results")
+	}
+
+	values = []xactResult{{XactCommit: 10000, XactRollback: 10}}
+	values[0].RollbackRatio = rollbackRatio(values[0].XactCommit, values[0].XactRollback)
+	if xactStatus(values) != "green" {
+		t.Fatal("not green on low rollback ratio")
+	}
+
+	values = []xactResult{{XactCommit: 10000, XactRollback: 1000}}
+	values[0].RollbackRatio = rollbackRatio(values[0].XactCommit, values[0].XactRollback)
+	if xactStatus(values) != "yellow" {
+		t.Fatal("not yellow on medium rollback ratio")
+	}
+
+	values = []xactResult{{XactCommit: 10000, XactRollback: 5000}}
+	values[0].RollbackRatio = rollbackRatio(values[0].XactCommit, values[0].XactRollback)
+	if xactStatus(values) != "red" {
+		t.Fatal("not red on high rollback ratio")
+	}
+
+	values = []xactResult{{XactCommit: 1, XactRollback: 5}}
+	values[0].RollbackRatio = rollbackRatio(values[0].XactCommit, values[0].XactRollback)
+	if xactStatus(values) != "green" {
+		t.Fatal("not green with too few transactions to judge")
+	}
+
+	values = []xactResult{{Deadlocks: 1}}
+	if xactStatus(values) != "yellow" {
+		t.Fatal("not yellow on deadlocks")
+	}
+
+	values = []xactResult{{ChecksumFailures: 1}}
+	if xactStatus(values) != "red" {
+		t.Fatal("not red on checksum failures")
+	}
+}
+
+func TestCompareXactCheck(t *testing.T) {
+	before := []xactResult{{Database: "db", XactCommit: 10000, XactRollback: 5000, Deadlocks: 3, StatsReset: "r"}}
+	previous := &Report{Id: "prev-id", CreatedAt: time.Now().Add(-time.Hour), Checks: []Check{{xactCheckTitle, "red", before}}}
+
+	current := []xactResult{{Database: "db", XactCommit: 20000, XactRollback: 5010, Deadlocks: 3, StatsReset: "r"}}
+	current[0].RollbackRatio = rollbackRatio(current[0].XactCommit, current[0].XactRollback)
+	checks := []Check{{xactCheckTitle, xactStatus(current), current}}
+
+	compareXactCheck(checks, previous)
+	if checks[0].Status != "green" {
+		t.Fatalf("expected green once lifetime rollbacks are discounted, got %v", checks[0].Status)
+	}
+	if current[0].Delta == nil || current[0].Delta.XactRollback != 10 || current[0].Delta.PreviousReport != "prev-id" {
+		t.Fatalf("unexpected delta %+v", current[0].Delta)
+	}
+	if rate := current[0].Delta.CommitsPerSecond; rate < 2.7 || rate > 2.8 {
+		t.Fatalf("expected about 10000 commits an hour, got %v a second", rate)
+	}
+
+	current = []xactResult{{Database: "db", XactCommit: 20000, XactRollback: 5010, StatsReset: "other"}}
+	checks = []Check{{xactCheckTitle, "green", current}}
+	compareXactCheck(checks, previous)
+	if current[0].Delta != nil {
+		t.Fatal("expected no delta across a stats reset")
+	}
+
+	current = []xactResult{{Database: "db", XactCommit: 20000, XactRollback: 5010, Deadlocks: 1, StatsReset: "r"}}
+	checks = []Check{{xactCheckTitle, "green", current}}
+	compareXactCheck(checks, previous)
+	if current[0].Delta != nil {
+		t.Fatal("expected no delta when a counter went down")
+	}
+}
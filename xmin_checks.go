@@ -0,0 +1,100 @@
+package main
+
+import (
+	"github.com/jmoiron/sqlx"
+)
+
+type preparedXactResult struct {
+	Gid      string `db:"gid" json:"gid"`
+	Owner    string `db:"owner" json:"owner"`
+	Database string `db:"database" json:"database"`
+	Age      string `db:"age" json:"age"`
+	XminAge  int64  `db:"xmin_age" json:"xmin_age"`
+}
+
+func preparedXactsCheck(db *sqlx.DB) Check {
+	checkTitle := "Prepared Transactions"
+	var results []preparedXactResult
+	err := db.Select(&results, preparedXactsSQL)
+	if err != nil {
+		return makeErrorCheck(checkTitle, err)
+	}
+	return Check{checkTitle, preparedXactsStatus(results), results}
+}
+
+func preparedXactsStatus(results []preparedXactResult) string {
+	if len(results) == 0 {
+		return "green"
+	} else {
+		return "red"
+	}
+}
+
+type xminHorizonResult struct {
+	Kind     string `db:"kind" json:"kind"`
+	Name     string `db:"name" json:"name"`
+	Owner    string `db:"owner" json:"owner"`
+	Database string `db:"database" json:"database"`
+	Duration string `db:"duration" json:"duration"`
+	XminAge  int64  `db:"xmin_age" json:"xmin_age"`
+}
+
+const (
+	// vacuum can't freeze past the oldest xmin, and anti-wraparound
+	// autovacuum kicks in at 200 million by default
+	xminAgeReported = 1000000
+	xminAgeRed      = 100000000
+)
+
+func xminHorizonCheck(db *sqlx.DB) Check {
+	checkTitle := "Xmin Horizon"
+	var results []xminHorizonResult
+	err := db.Select(&results, xminHorizonSQL, xminAgeReported)
+	if err != nil {
+		return makeErrorCheck(checkTitle, err)
+	}
+	return Check{checkTitle, xminHorizonStatus(results), results}
+}
+
+func xminHorizonStatus(results []xminHorizonResult) string {
+	status := "green"
+	for _, r := range results {
+		if r.XminAge >= xminAgeRed {
+			return "red"
+		}
+		status = "yellow"
+	}
+	return status
+}
+
+const (
+	preparedXactsSQL = `
+	SELECT gid, owner, database, (now() - prepared)::text as age,
+	  age(transaction) as xmin_age
+	FROM pg_prepared_xacts
+	WHERE now() - prepared > '5 minutes'::interval
+	ORDER BY prepared
+	;`
+
+	xminHorizonSQL = `
+	SELECT * FROM (
+	  SELECT 'backend' as kind, pid::text as name,
+	    coalesce(usename, '') as owner, coalesce(datname, '') as database,
+	    coalesce((now() - xact_start)::text, '') as duration,
+	    age(backend_xmin) as xmin_age
+	  FROM pg_stat_activity
+	  WHERE backend_xmin IS NOT NULL AND pid <> pg_backend_pid()
+	  UNION ALL
+	  SELECT 'replication slot', slot_name::text, '', coalesce(database, ''), '',
+	    greatest(age(xmin), age(catalog_xmin))
+	  FROM pg_replication_slots
+	  WHERE xmin IS NOT NULL OR catalog_xmin IS NOT NULL
+	  UNION ALL
+	  SELECT 'prepared transaction', gid, owner, database, (now() - prepared)::text,
+	    age(transaction)
+	  FROM pg_prepared_xacts
+	) holders
+	WHERE xmin_age > $1
+	ORDER BY xmin_age DESC
+	;`
+)
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestPreparedXactsStatus(t *testing.T) {
+	values := make([]preparedXactResult, 0)
+	if preparedXactsStatus(values) != "green" {
+		t.Fatal("not green on empty results")
+	}
+
+	values = make([]preparedXactResult, 1)
+	if preparedXactsStatus(values) != "red" {
+		t.Fatal("not red when there are results")
+	}
+}
+
+func TestXminHorizonStatus(t *testing.T) {
+	values := make([]xminHorizonResult, 0)
+	if xminHorizonStatus(values) != "green" {
+		t.Fatal("not green on empty results")
+	}
+
+	values = []xminHorizonResult{{Kind: "backend", XminAge: 2000000}}
+	if xminHorizonStatus(values) != "yellow" {
+		t.Fatal("not yellow when something holds back the horizon")
+	}
+
+	values = append(values, xminHorizonResult{Kind: "replication slot", XminAge: 150000000})
+	if xminHorizonStatus(values) != "red" {
+		t.Fatal("not red when the horizon is held back for very long")
+	}
+}